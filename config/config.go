@@ -0,0 +1,220 @@
+// Package config loads the Metachat configuration from JSON, YAML or TOML files.
+//
+// String values may refer to environment variables as ${NAME} ($${NAME} is kept as is), and any key
+// with the "_file" suffix is replaced by the key without the suffix set to the contents of the file
+// it points to, so that secrets can be kept out of the configuration:
+//
+//	messengers:
+//	  - name: corp-slack
+//	    type: slack
+//	    token_file: /run/secrets/slack-token
+//	    verificationToken: ${SLACK_VERIFICATION_TOKEN}
+//
+// The configuration is validated against the configuration structures of metachat and of the registered
+// messenger types, reporting unknown fields and missing required values with their line numbers.
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// Configuration formats.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+const fileSuffix = "_file"
+
+var envRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type (
+	// Config structure.
+	Config struct {
+		metachat.Config
+		RoomsFile      string `json:"roomsFile"`
+		IdentitiesFile string `json:"identitiesFile"`
+	}
+
+	// Error is a configuration error at the line of the configuration file.
+	Error struct {
+		File    string
+		Line    int
+		Message string
+	}
+
+	// Errors is a list of configuration errors.
+	Errors []*Error
+)
+
+// Load reads the configuration file. The format is determined by the file extension, JSON is used
+// for unknown extensions. Relative secret file paths are resolved against the configuration directory.
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	config, err := parseConfig(content, FormatOf(path), filepath.Dir(path))
+	switch e := err.(type) {
+	case *Error:
+		e.File = path
+
+	case Errors:
+		for _, item := range e {
+			item.File = path
+		}
+	}
+
+	return config, err
+}
+
+// Parse parses the configuration in the provided format.
+func Parse(content []byte, format string) (*Config, error) {
+	return parseConfig(content, format, "")
+}
+
+// FormatOf returns the configuration format matching the file extension.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+
+	case ".toml":
+		return FormatTOML
+	}
+
+	return FormatJSON
+}
+
+func parseConfig(content []byte, format, dir string) (*Config, error) {
+	root, err := parse(content, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs Errors
+	errs = append(errs, substitute(root, dir)...)
+	errs = append(errs, validate(root)...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	data, err := json.Marshal(root.toValue())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	config := &Config{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, &Error{Line: root.line, Message: err.Error()}
+	}
+
+	return config, nil
+}
+
+// substitute expands environment variables and replaces the "_file" keys with the contents of the files.
+func substitute(n *node, dir string) Errors {
+	var errs Errors
+
+	switch n.kind {
+	case scalarNode:
+		text, ok := n.value.(string)
+		if !ok {
+			return nil
+		}
+
+		n.value = envRegexp.ReplaceAllStringFunc(text, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+
+			name := envRegexp.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				errs = append(errs, &Error{Line: n.line, Message: "environment variable " + name + " is not set"})
+			}
+
+			return value
+		})
+
+	case listNode:
+		for _, item := range n.items {
+			errs = append(errs, substitute(item, dir)...)
+		}
+
+	case mapNode:
+		entries := make([]entry, 0, len(n.entries))
+		for _, e := range n.entries {
+			errs = append(errs, substitute(e.value, dir)...)
+			if !strings.HasSuffix(e.key, fileSuffix) {
+				entries = append(entries, e)
+				continue
+			}
+
+			key := strings.TrimSuffix(e.key, fileSuffix)
+			if _, ok := n.find(key); ok {
+				errs = append(errs, &Error{Line: e.line, Message: "both " + key + " and " + e.key + " are set"})
+				continue
+			}
+
+			value, err := readSecret(e.value, dir)
+			if err != nil {
+				errs = append(errs, &Error{Line: e.line, Message: e.key + ": " + err.Error()})
+			}
+
+			entries = append(entries, entry{key: key, line: e.line, value: &node{kind: scalarNode, line: e.value.line,
+				value: value}})
+		}
+
+		n.entries = entries
+	}
+
+	return errs
+}
+
+func readSecret(n *node, dir string) (string, error) {
+	path, ok := n.value.(string)
+	if n.kind != scalarNode || !ok {
+		return "", errors.New("secret file path must be a string")
+	}
+
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return "line " + strconv.Itoa(e.Line) + ": " + e.Message
+	}
+
+	return e.File + ":" + strconv.Itoa(e.Line) + ": " + e.Message
+}
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// fakeConfig is the configuration of the fake messenger type the tests validate against.
+type fakeConfig struct {
+	Token string `json:"token" required:"true"`
+	Limit int    `json:"limit"`
+}
+
+func init() {
+	metachat.Register("fake", func(string, json.RawMessage) (metachat.Messenger, error) {
+		return nil, nil
+	}, fakeConfig{})
+}
+
+func TestParseExpandsEnvironment(t *testing.T) {
+	setenv(t, "METACHAT_TEST_PORT", "8080")
+	setenv(t, "METACHAT_TEST_TOKEN", "secret")
+
+	config, err := Parse([]byte("port: ${METACHAT_TEST_PORT}\nmessengers:\n  - name: chat\n    type: fake\n"+
+		"    token: ${METACHAT_TEST_TOKEN}-$${METACHAT_TEST_TOKEN}\n"), FormatYAML)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Port != 8080 {
+		t.Errorf("got port %d", config.Port)
+	}
+
+	if token := fakeSettings(t, config).Token; token != "secret-${METACHAT_TEST_TOKEN}" {
+		t.Errorf("got token %q", token)
+	}
+
+	_, err = Parse([]byte("port: 8080\nrooms:\n  - name: ${METACHAT_TEST_MISSING}\n"), FormatYAML)
+	want := "line 3: environment variable METACHAT_TEST_MISSING is not set\nline 3: rooms[0].name: missing required value"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v instead of %s", err, want)
+	}
+}
+
+func TestLoadReadsSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "metachat.yaml")
+	write := func(content string) {
+		t.Helper()
+
+		err := ioutil.WriteFile(path, []byte("port: 8080\nmessengers:\n  - name: chat\n    type: fake\n"+content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("    token_file: token\n")
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token := fakeSettings(t, config).Token; token != "secret" {
+		t.Errorf("got token %q", token)
+	}
+
+	write("    token_file: missing\n")
+
+	_, err = Load(path)
+	if want := path + ":5: token_file: open "; err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got %v instead of %s...", err, want)
+	}
+
+	write("    token: secret\n    token_file: token\n")
+
+	_, err = Load(path)
+	if want := path + ":6: both token and token_file are set"; err == nil || err.Error() != want {
+		t.Errorf("got %v instead of %s", err, want)
+	}
+}
+
+func TestParseReportsSchemaErrorsWithLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		errs    []string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			content: "{\"port\": 8080,\n  \"rooms\": [\n    {\"chats\": [],\n     \"colour\": \"red\"}],\n" +
+				"  \"messengers\": [{\n    \"name\": \"chat\", \"type\": \"fake\",\n    \"limit\": \"many\"}]}",
+			errs: []string{
+				"line 4: rooms[0].colour: unknown field",
+				"line 3: rooms[0].name: missing required value",
+				"line 7: messengers[0].limit: expected an integer",
+				"line 5: messengers[0].token: missing required value",
+			},
+		},
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			content: "port: 8080\nrooms:\n  - chats: []\n    colour: red\nmessengers:\n  - name: chat\n" +
+				"    limit: many\n    type: fake\n",
+			errs: []string{
+				"line 4: rooms[0].colour: unknown field",
+				"line 3: rooms[0].name: missing required value",
+				"line 7: messengers[0].limit: expected an integer",
+				"line 6: messengers[0].token: missing required value",
+			},
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			content: "port = 8080\n\n[[rooms]]\nchats = []\ncolour = \"red\"\n\n" +
+				"[[messengers]]\nname = \"chat\"\ntype = \"fake\"\nlimit = \"many\"\n",
+			errs: []string{
+				"line 10: messengers[0].limit: expected an integer",
+				"line 7: messengers[0].token: missing required value",
+				"line 5: rooms[0].colour: unknown field",
+				"line 3: rooms[0].name: missing required value",
+			},
+		},
+		{
+			name:    "unknown type",
+			format:  FormatYAML,
+			content: "port: 8080\nmessengers:\n  - name: chat\n    type: carrier-pigeon\n",
+			errs:    []string{"line 4: messengers[0].type: unknown messenger type 'carrier-pigeon', known types are fake"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.content), test.format)
+			if err == nil || err.Error() != strings.Join(test.errs, "\n") {
+				t.Errorf("got %v instead of %s", err, strings.Join(test.errs, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseReportsDecodeErrorsWithLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		err     string
+	}{
+		{
+			name:    "json number",
+			format:  FormatJSON,
+			content: "{\n  \"port\": 8080,\n  \"rooms\": [\n    {\"name\": \"team\",\n     \"coalesce\": 5}\n  ]\n}",
+			err:     "line 5: rooms[0].coalesce: invalid duration 5",
+		},
+		{
+			name:    "yaml string",
+			format:  FormatYAML,
+			content: "port: 8080\nrooms:\n  - name: team\n    coalesce: soon\n",
+			err:     `line 4: rooms[0].coalesce: time: invalid duration "soon"`,
+		},
+		{
+			name:    "toml number",
+			format:  FormatTOML,
+			content: "port = 8080\n\n[[rooms]]\nname = \"team\"\ncoalesce = 5\n",
+			err:     "line 5: rooms[0].coalesce: invalid duration 5",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.content), test.format)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got %v instead of %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestLoadReportsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metachat.yaml")
+	err = ioutil.WriteFile(path, []byte("port: 8080\nrooms:\n  - name: team\n    coalesce: 5\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load(path)
+	if want := path + ":4: rooms[0].coalesce: invalid duration 5"; err == nil || err.Error() != want {
+		t.Errorf("got %v instead of %s", err, want)
+	}
+
+	err = ioutil.WriteFile(path, []byte("port: 8080\nrooms:\n  - name: team\n    coalesce: 5s\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Rooms[0].Coalesce.Duration != 5*time.Second {
+		t.Errorf("got coalescing window %s", config.Rooms[0].Coalesce)
+	}
+}
+
+func setenv(t *testing.T, name, value string) {
+	t.Helper()
+
+	err := os.Setenv(name, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func fakeSettings(t *testing.T, config *Config) fakeConfig {
+	t.Helper()
+
+	if len(config.Instances) != 1 {
+		t.Fatalf("got messengers %+v", config.Instances)
+	}
+
+	var result fakeConfig
+	err := json.Unmarshal(config.Instances[0].Settings, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
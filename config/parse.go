@@ -0,0 +1,373 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	scalarNode nodeKind = iota
+	mapNode
+	listNode
+)
+
+var (
+	tomlTableRegexp = regexp.MustCompile(`^\s*(\[\[?)\s*([^\[\]]+?)\s*\]\]?\s*(#.*)?$`)
+	tomlKeyRegexp   = regexp.MustCompile(`^\s*([A-Za-z0-9_\-."' ]+?)\s*=`)
+)
+
+type (
+	nodeKind int
+
+	// node is a format-independent configuration value that remembers its line in the file.
+	node struct {
+		kind    nodeKind
+		line    int
+		value   interface{}
+		entries []entry
+		items   []*node
+	}
+
+	entry struct {
+		key   string
+		line  int
+		value *node
+	}
+
+	// lineIndex maps byte offsets to line numbers.
+	lineIndex []int
+
+	jsonParser struct {
+		decoder *json.Decoder
+		lines   lineIndex
+	}
+)
+
+func parse(content []byte, format string) (*node, error) {
+	switch format {
+	case FormatYAML:
+		return parseYAML(content)
+
+	case FormatTOML:
+		return parseTOML(content)
+
+	case FormatJSON:
+		return parseJSON(content)
+	}
+
+	return nil, errors.Errorf("unknown configuration format '%s'", format)
+}
+
+func parseJSON(content []byte) (*node, error) {
+	p := &jsonParser{decoder: json.NewDecoder(bytes.NewReader(content)), lines: newLineIndex(content)}
+	p.decoder.UseNumber()
+
+	root, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.decoder.Token(); err != io.EOF {
+		return nil, &Error{Line: p.lines.line(p.decoder.InputOffset()), Message: "unexpected data after the top-level value"}
+	}
+
+	return root, nil
+}
+
+func (p *jsonParser) value() (*node, error) {
+	token, err := p.decoder.Token()
+	if err != nil {
+		return nil, p.wrap(err)
+	}
+
+	line := p.lines.line(p.decoder.InputOffset())
+
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '[' {
+			n := &node{kind: listNode, line: line}
+			for p.decoder.More() {
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+
+				n.items = append(n.items, item)
+			}
+
+			_, err = p.decoder.Token()
+
+			return n, p.wrap(err)
+		}
+
+		n := &node{kind: mapNode, line: line}
+		for p.decoder.More() {
+			key, err := p.decoder.Token()
+			if err != nil {
+				return nil, p.wrap(err)
+			}
+
+			keyLine := p.lines.line(p.decoder.InputOffset())
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+
+			n.entries = append(n.entries, entry{key: key.(string), line: keyLine, value: value})
+		}
+
+		_, err = p.decoder.Token()
+
+		return n, p.wrap(err)
+
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return &node{kind: scalarNode, line: line, value: i}, nil
+		}
+
+		f, err := t.Float64()
+
+		return &node{kind: scalarNode, line: line, value: f}, p.wrap(err)
+	}
+
+	return &node{kind: scalarNode, line: line, value: token}, nil
+}
+
+func (p *jsonParser) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		return &Error{Line: p.lines.line(syntaxErr.Offset), Message: syntaxErr.Error()}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return &Error{Line: p.lines.line(p.decoder.InputOffset()), Message: err.Error()}
+}
+
+func parseYAML(content []byte) (*node, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(doc.Content) == 0 {
+		return &node{kind: mapNode, line: 1}, nil
+	}
+
+	return convertYAML(doc.Content[0])
+}
+
+func convertYAML(y *yaml.Node) (*node, error) {
+	switch y.Kind {
+	case yaml.AliasNode:
+		return convertYAML(y.Alias)
+
+	case yaml.MappingNode:
+		n := &node{kind: mapNode, line: y.Line}
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			value, err := convertYAML(y.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+
+			n.entries = append(n.entries, entry{key: y.Content[i].Value, line: y.Content[i].Line, value: value})
+		}
+
+		return n, nil
+
+	case yaml.SequenceNode:
+		n := &node{kind: listNode, line: y.Line}
+		for _, item := range y.Content {
+			value, err := convertYAML(item)
+			if err != nil {
+				return nil, err
+			}
+
+			n.items = append(n.items, value)
+		}
+
+		return n, nil
+	}
+
+	var value interface{}
+	err := y.Decode(&value)
+	if err != nil {
+		return nil, &Error{Line: y.Line, Message: err.Error()}
+	}
+
+	if i, ok := value.(int); ok {
+		value = int64(i)
+	}
+
+	return &node{kind: scalarNode, line: y.Line, value: value}, nil
+}
+
+// parseTOML decodes the document and then finds the lines of its keys and tables by scanning the
+// source, as the TOML decoder doesn't report positions.
+func parseTOML(content []byte) (*node, error) {
+	var value map[string]interface{}
+	_, err := toml.Decode(string(content), &value)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	lines := make(map[string]int)
+	tables := make(map[string]int)
+	var current []string
+
+	for i, l := range strings.Split(string(content), "\n") {
+		if m := tomlTableRegexp.FindStringSubmatch(l); m != nil {
+			current = nil
+
+			// Tables nested in arrays of tables belong to the last array element.
+			parts := splitTOMLKey(m[2])
+			for j, part := range parts {
+				current = append(current, part)
+				path := strings.Join(current, ".")
+				count, isArray := tables[path]
+
+				if j == len(parts)-1 && m[1] == "[[" {
+					current = append(current, strconv.Itoa(count))
+					tables[path]++
+				} else if isArray {
+					current = append(current, strconv.Itoa(count-1))
+				}
+			}
+
+			lines[strings.Join(current, ".")] = i + 1
+
+			continue
+		}
+
+		if m := tomlKeyRegexp.FindStringSubmatch(l); m != nil {
+			lines[strings.Join(append(append([]string(nil), current...), splitTOMLKey(m[1])...), ".")] = i + 1
+		}
+	}
+
+	return convertTOML(value, nil, lines, 1), nil
+}
+
+func convertTOML(value interface{}, path []string, lines map[string]int, parentLine int) *node {
+	line, ok := lines[strings.Join(path, ".")]
+	if !ok {
+		line = parentLine
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		n := &node{kind: mapNode, line: line}
+		for key, item := range v {
+			child := convertTOML(item, append(append([]string(nil), path...), key), lines, line)
+			n.entries = append(n.entries, entry{key: key, line: child.line, value: child})
+		}
+
+		sort.Slice(n.entries, func(i, j int) bool {
+			if n.entries[i].line != n.entries[j].line {
+				return n.entries[i].line < n.entries[j].line
+			}
+
+			return n.entries[i].key < n.entries[j].key
+		})
+
+		return n
+
+	case []map[string]interface{}:
+		n := &node{kind: listNode, line: line}
+		for i, item := range v {
+			n.items = append(n.items, convertTOML(item, append(append([]string(nil), path...), strconv.Itoa(i)), lines,
+				line))
+		}
+
+		return n
+
+	case []interface{}:
+		n := &node{kind: listNode, line: line}
+		for i, item := range v {
+			n.items = append(n.items, convertTOML(item, append(append([]string(nil), path...), strconv.Itoa(i)), lines,
+				line))
+		}
+
+		return n
+
+	case time.Time:
+		return &node{kind: scalarNode, line: line, value: v.Format(time.RFC3339)}
+	}
+
+	return &node{kind: scalarNode, line: line, value: value}
+}
+
+func splitTOMLKey(key string) []string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+
+	return parts
+}
+
+func newLineIndex(content []byte) lineIndex {
+	index := lineIndex{0}
+	for i, c := range content {
+		if c == '\n' {
+			index = append(index, i+1)
+		}
+	}
+
+	return index
+}
+
+// line returns the 1-based line number of the byte offset.
+func (l lineIndex) line(offset int64) int {
+	return sort.Search(len(l), func(i int) bool {
+		return int64(l[i]) > offset
+	})
+}
+
+// toValue converts the node to a value encoding/json marshals.
+func (n *node) toValue() interface{} {
+	switch n.kind {
+	case mapNode:
+		result := make(map[string]interface{}, len(n.entries))
+		for _, e := range n.entries {
+			result[e.key] = e.value.toValue()
+		}
+
+		return result
+
+	case listNode:
+		result := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			result = append(result, item.toValue())
+		}
+
+		return result
+	}
+
+	return n.value
+}
+
+func (n *node) find(key string) (entry, bool) {
+	for _, e := range n.entries {
+		if e.key == key {
+			return e, true
+		}
+	}
+
+	return entry{}, false
+}
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+var (
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	messengerConfigType = reflect.TypeOf(metachat.MessengerConfig{})
+)
+
+type (
+	// field is a struct field as seen by encoding/json.
+	field struct {
+		name     string
+		typ      reflect.Type
+		required bool
+	}
+
+	validator struct {
+		errs Errors
+	}
+)
+
+// validate checks the configuration against the Config structure and converts scalars to the types
+// of the fields, e.g. numbers from environment variables to integers.
+func validate(root *node) Errors {
+	v := &validator{}
+	v.check(root, reflect.TypeOf(Config{}), "")
+
+	return v.errs
+}
+
+func (v *validator) check(n *node, t reflect.Type, path string) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == messengerConfigType:
+		v.checkMessenger(n, path)
+		return
+
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		v.decode(n, t, path)
+		return
+
+	case t.Kind() == reflect.Interface:
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if !v.expect(n, mapNode, "an object", path) {
+			return
+		}
+
+		v.checkFields(n, fields(t), path)
+
+	case reflect.Map:
+		if !v.expect(n, mapNode, "an object", path) {
+			return
+		}
+
+		for _, e := range n.entries {
+			v.check(e.value, t.Elem(), join(path, e.key))
+		}
+
+	case reflect.Slice, reflect.Array:
+		if !v.expect(n, listNode, "a list", path) {
+			return
+		}
+
+		for i, item := range n.items {
+			v.check(item, t.Elem(), path+"["+strconv.Itoa(i)+"]")
+		}
+
+	default:
+		if v.expect(n, scalarNode, "a value", path) {
+			v.convert(n, t.Kind(), path)
+		}
+	}
+}
+
+// checkMessenger validates the messenger instance against the configuration structure of its type.
+func (v *validator) checkMessenger(n *node, path string) {
+	if !v.expect(n, mapNode, "an object", path) {
+		return
+	}
+
+	typeEntry, ok := n.find("type")
+	if !ok {
+		v.add(n.line, join(path, "type"), "missing required value")
+		return
+	}
+
+	typeName, _ := typeEntry.value.value.(string)
+	configType, ok := metachat.ConfigType(typeName)
+	if !ok {
+		v.add(typeEntry.line, join(path, "type"), fmt.Sprintf("unknown messenger type '%s', known types are %s",
+			typeName, strings.Join(metachat.Types(), ", ")))
+
+		return
+	}
+
+	all := fields(messengerConfigType)
+	for name, f := range fields(configType) {
+		if _, ok := all[name]; !ok {
+			all[name] = f
+		}
+	}
+
+	v.checkFields(n, all, path)
+}
+
+// checkFields reports unknown fields and missing required values.
+func (v *validator) checkFields(n *node, fields map[string]field, path string) {
+	for _, e := range n.entries {
+		f, ok := fields[e.key]
+		if !ok {
+			v.add(e.line, join(path, e.key), "unknown field")
+			continue
+		}
+
+		v.check(e.value, f.typ, join(path, e.key))
+	}
+
+	for _, name := range sortedNames(fields) {
+		if !fields[name].required {
+			continue
+		}
+
+		e, ok := n.find(name)
+		if !ok {
+			v.add(n.line, join(path, name), "missing required value")
+			continue
+		}
+
+		s, isString := e.value.value.(string)
+		if e.value.kind == scalarNode && (e.value.value == nil || isString && s == "") {
+			v.add(e.line, join(path, name), "missing required value")
+		}
+	}
+}
+
+// convert checks the scalar against the kind of the field converting it if possible.
+func (v *validator) convert(n *node, kind reflect.Kind, path string) {
+	if n.value == nil {
+		return
+	}
+
+	text, isString := n.value.(string)
+
+	switch kind {
+	case reflect.String:
+		if !isString {
+			n.value = fmt.Sprint(n.value)
+		}
+
+	case reflect.Bool:
+		if isString {
+			value, err := strconv.ParseBool(text)
+			if err == nil {
+				n.value = value
+				return
+			}
+		}
+
+		if _, ok := n.value.(bool); !ok {
+			v.add(n.line, path, "expected a boolean")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if isString {
+			value, err := strconv.ParseInt(text, 10, 64)
+			if err == nil {
+				n.value = value
+				return
+			}
+		}
+
+		if _, ok := n.value.(int64); !ok {
+			v.add(n.line, path, "expected an integer")
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if isString {
+			value, err := strconv.ParseFloat(text, 64)
+			if err == nil {
+				n.value = value
+				return
+			}
+		}
+
+		switch n.value.(type) {
+		case int64, float64:
+		default:
+			v.add(n.line, path, "expected a number")
+		}
+	}
+}
+
+// decode checks that the type decodes the value, as types with custom decoding can't be checked
+// against their fields.
+func (v *validator) decode(n *node, t reflect.Type, path string) {
+	data, err := json.Marshal(n.toValue())
+	if err == nil {
+		err = json.Unmarshal(data, reflect.New(t).Interface())
+	}
+
+	if err != nil {
+		v.add(n.line, path, errors.Cause(err).Error())
+	}
+}
+
+func (v *validator) expect(n *node, kind nodeKind, description, path string) bool {
+	if n.kind == kind || n.kind == scalarNode && n.value == nil {
+		return n.kind == kind
+	}
+
+	v.add(n.line, path, "expected "+description)
+
+	return false
+}
+
+func (v *validator) add(line int, path, message string) {
+	if path != "" {
+		message = path + ": " + message
+	}
+
+	v.errs = append(v.errs, &Error{Line: line, Message: message})
+}
+
+// fields returns the fields of the struct that encoding/json decodes, including the fields of
+// embedded structs.
+func fields(t reflect.Type) map[string]field {
+	result := make(map[string]field)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			for name, embedded := range fields(f.Type) {
+				result[name] = embedded
+			}
+
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		result[name] = field{name: name, typ: f.Type, required: f.Tag.Get("required") == "true"}
+	}
+
+	return result
+}
+
+func sortedNames(fields map[string]field) []string {
+	result := make([]string, 0, len(fields))
+	for name := range fields {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
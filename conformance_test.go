@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/conformance"
+)
+
+var update = flag.Bool("update", false, "write the conversion results to the golden files")
+
+// TestConformance checks the message conversions of all messenger types against the golden files.
+//
+//	go test -run TestConformance -update
+func TestConformance(t *testing.T) {
+	for _, typeName := range metachat.Types() {
+		typeName := typeName
+		t.Run(typeName, func(t *testing.T) {
+			err := conformance.Check(typeName, filepath.Join("testdata", "conformance", typeName), *update)
+			if mismatches, ok := err.(conformance.Mismatches); ok {
+				for _, mismatch := range mismatches {
+					t.Error(mismatch)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const defaultAPIURL = "https://discord.com/api/v10"
+
+const (
+	// maxLength is the Discord message length limit.
+	maxLength = 2000
+
+	// maxAllowedMentions is the number of user IDs Discord accepts in allowed_mentions.
+	maxAllowedMentions = 100
+)
+
+var webhookRegexp = regexp.MustCompile(`/webhooks/([0-9]+)/[^/?]+`)
+
+type (
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// Config structure. Webhooks map channel IDs to webhook URLs used to send messages
+	// on behalf of the original authors. Channels without a webhook get messages from the bot user.
+	Config struct {
+		ID         string            `json:"-"`
+		Token      string            `json:"token" required:"true"`
+		Webhooks   map[string]string `json:"webhooks"`
+		APIURL     string            `json:"apiURL"`
+		HTTPClient httpClient        `json:"-"`
+	}
+
+	// Client is a Discord client.
+	Client struct {
+		id          string
+		httpClient  httpClient
+		token       string
+		apiURL      string
+		webhooks    map[string]webhook
+		messageChan chan metachat.Message
+		session     *session
+	}
+
+	webhook struct {
+		id  string
+		url *url.URL
+	}
+
+	user struct {
+		ID         string `json:"id"`
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Avatar     string `json:"avatar"`
+		Bot        bool   `json:"bot"`
+	}
+
+	message struct {
+		ID                string   `json:"id"`
+		ChannelID         string   `json:"channel_id"`
+		Content           string   `json:"content"`
+		WebhookID         string   `json:"webhook_id"`
+		Author            user     `json:"author"`
+		Mentions          []user   `json:"mentions"`
+		ReferencedMessage *message `json:"referenced_message"`
+		EditedTimestamp   string   `json:"edited_timestamp"`
+	}
+
+	outgoingMessage struct {
+		Content         string          `json:"content"`
+		Username        string          `json:"username,omitempty"`
+		AvatarURL       string          `json:"avatar_url,omitempty"`
+		AllowedMentions allowedMentions `json:"allowed_mentions"`
+	}
+
+	// allowedMentions makes Discord notify only the users mentioned by ID, so that text like @everyone
+	// relayed from another messenger doesn't ping anybody.
+	allowedMentions struct {
+		Parse []string `json:"parse"`
+		Users []string `json:"users,omitempty"`
+	}
+
+	rateLimitResponse struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+)
+
+func init() {
+	metachat.Register("discord", newMessenger, Config{})
+	metachat.RegisterConverter("discord", converter{})
+}
+
+// NewClient is a Discord client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.Token == "" {
+		return nil, errors.New("token can't be nil")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	apiURL := config.APIURL
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+
+	webhooks := make(map[string]webhook)
+	for channel, raw := range config.Webhooks {
+		groups := webhookRegexp.FindStringSubmatch(raw)
+		hookURL, err := url.Parse(raw)
+		if groups == nil || err != nil {
+			return nil, errors.Errorf("unknown webhook URL format for channel '%s'", channel)
+		}
+
+		webhooks[channel] = webhook{id: groups[1], url: hookURL}
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Discord"
+	}
+
+	return &Client{
+		id:          id,
+		httpClient:  httpClient,
+		token:       config.Token,
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		webhooks:    webhooks,
+		messageChan: make(chan metachat.Message, 100),
+		session:     &session{},
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Send sends a message to chat with the provided ID.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to chat with the provided ID and returns the message ID.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
+	var result message
+	hook, ok := c.webhooks[chat]
+	if ok {
+		err := c.do(http.MethodPost, hook.endpoint("", "wait", "true"), false, c.webhookMessage(msg), &result)
+		if err != nil {
+			return "", err
+		}
+
+		return result.ID, nil
+	}
+
+	err := c.do(http.MethodPost, fmt.Sprintf("%s/channels/%s/messages", c.apiURL, chat), true, c.botMessage(msg),
+		&result)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.ID, nil
+}
+
+// Edit replaces the content of the message with the provided ID.
+func (c *Client) Edit(msg metachat.Message, chat, id string) error {
+	hook, ok := c.webhooks[chat]
+	if ok {
+		return c.do(http.MethodPatch, hook.endpoint("/messages/"+id, "", ""), false, c.webhookMessage(msg), nil)
+	}
+
+	return c.do(http.MethodPatch, fmt.Sprintf("%s/channels/%s/messages/%s", c.apiURL, chat, id), true,
+		c.botMessage(msg), nil)
+}
+
+// RateLimits returns Discord limits: 5 messages per 5 seconds in any channel.
+func (c *Client) RateLimits(chat string) []metachat.RateLimit {
+	return []metachat.RateLimit{{Interval: time.Second, Burst: 5}}
+}
+
+// MaxLength returns the Discord message length limit.
+func (c *Client) MaxLength() int {
+	return maxLength
+}
+
+// CheckCredentials verifies the bot token and reports the channels the bot or the channel webhook
+// has access to.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	err := c.do(http.MethodGet, c.apiURL+"/users/@me", true, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		if hook, ok := c.webhooks[chat]; ok {
+			visible[chat] = c.do(http.MethodGet, hook.url.String(), false, nil, nil) == nil
+			continue
+		}
+
+		visible[chat] = c.do(http.MethodGet, c.apiURL+"/channels/"+chat, true, nil, nil) == nil
+	}
+
+	return visible, nil
+}
+
+func (c *Client) webhookMessage(msg metachat.Message) outgoingMessage {
+	return outgoingMessage{
+		Content:         convertToDiscord(msg),
+		Username:        msg.Author,
+		AvatarURL:       msg.Avatar,
+		AllowedMentions: allowedMentions{Parse: []string{}, Users: mentionedUsers(msg.Text)},
+	}
+}
+
+func (c *Client) botMessage(msg metachat.Message) outgoingMessage {
+	content := convertToDiscord(msg)
+	if msg.Author != "" {
+		content = fmt.Sprintf("**[%s]** %s", msg.Author, content)
+	}
+
+	return outgoingMessage{Content: content,
+		AllowedMentions: allowedMentions{Parse: []string{}, Users: mentionedUsers(msg.Text)}}
+}
+
+// endpoint returns the webhook URL with the path appended and the query parameter set, if any.
+// Parameters of the configured URL, like thread_id, are kept.
+func (h webhook) endpoint(path, key, value string) string {
+	result := *h.url
+	result.Path += path
+	result.RawPath = ""
+
+	if key != "" {
+		query := result.Query()
+		query.Set(key, value)
+		result.RawQuery = query.Encode()
+	}
+
+	return result.String()
+}
+
+// isOwn reports whether the message was sent by the bot user or through one of the configured webhooks.
+func (c *Client) isOwn(msg message) bool {
+	if msg.WebhookID != "" {
+		for _, hook := range c.webhooks {
+			if hook.id == msg.WebhookID {
+				return true
+			}
+		}
+	}
+
+	return msg.Author.ID != "" && msg.Author.ID == c.session.getUserID()
+}
+
+// do performs a Discord API request, authenticating with the bot token if auth is set.
+func (c *Client) do(method, url string, auth bool, payload, result interface{}) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if auth {
+		req.Header.Set("Authorization", "Bot "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var rateLimit rateLimitResponse
+		err = json.NewDecoder(resp.Body).Decode(&rateLimit)
+		if err != nil || rateLimit.RetryAfter <= 0 {
+			rateLimit.RetryAfter = 1
+		}
+
+		return &metachat.RetryAfterError{Duration: time.Duration(rateLimit.RetryAfter * float64(time.Second))}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("got %s from %s %s", resp.Status, method, req.URL.Path)
+	}
+
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
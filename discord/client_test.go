@@ -0,0 +1,129 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+type apiRequest struct {
+	method string
+	path   string
+	query  url.Values
+	auth   string
+	body   outgoingMessage
+}
+
+func TestSend(t *testing.T) {
+	requests := make(chan apiRequest, 10)
+	limited := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		requests <- req
+
+		if r.URL.Path == "/api/channels/200/messages" && limited {
+			limited = false
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(rateLimitResponse{RetryAfter: 0.5})
+			return
+		}
+
+		json.NewEncoder(w).Encode(message{ID: "42"})
+	}))
+
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, map[string]string{"100": server.URL + "/api/webhooks/9/secret"})
+	msg := metachat.Message{Author: "Alice", Avatar: "https://example.com/a.png", Text: metachat.Bold("hi") + " *"}
+
+	id, err := c.SendEditable(msg, "100")
+	if err != nil || id != "42" {
+		t.Fatalf("got ID %q: %v", id, err)
+	}
+
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/api/webhooks/9/secret" || req.auth != "" ||
+		req.body.Username != "Alice" || req.body.AvatarURL != msg.Avatar || req.body.Content != `**hi** \*` {
+		t.Errorf("unexpected webhook request %+v", req)
+	}
+
+	if err := c.Edit(msg, "100", "42"); err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-requests; req.method != http.MethodPatch || req.path != "/api/webhooks/9/secret/messages/42" {
+		t.Errorf("unexpected webhook edit request %+v", req)
+	}
+
+	err = c.Send(msg, "200")
+	retry, ok := errors.Cause(err).(*metachat.RetryAfterError)
+	if !ok || retry.Duration != 500*time.Millisecond {
+		t.Fatalf("got %v instead of a retry after 500ms", err)
+	}
+
+	<-requests
+
+	if err := c.Send(msg, "200"); err != nil {
+		t.Fatal(err)
+	}
+
+	req = <-requests
+	if req.path != "/api/channels/200/messages" || req.auth != "Bot token" ||
+		req.body.Content != `**[Alice]** **hi** \*` || len(req.body.AllowedMentions.Parse) != 0 {
+		t.Errorf("unexpected bot request %+v", req)
+	}
+}
+
+func TestSendToWebhookThread(t *testing.T) {
+	requests := make(chan apiRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query()}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		requests <- req
+
+		json.NewEncoder(w).Encode(message{ID: "42"})
+	}))
+
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, map[string]string{"100": server.URL + "/api/webhooks/9/secret?thread_id=7"})
+	msg := metachat.Message{Author: "Alice", Text: "Hi " + metachat.MentionOf("Bob", "42") + " " +
+		metachat.MentionOf("Carol", "@carol:example.org") + " " + metachat.MentionOf("Bob", "42") + " @everyone"}
+
+	if _, err := c.SendEditable(msg, "100"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.query.Get("wait") != "true" || req.query.Get("thread_id") != "7" {
+		t.Errorf("webhook request has query %v", req.query)
+	}
+
+	if req.body.Content != "Hi <@42> @Carol <@42> @everyone" {
+		t.Errorf("got content %q", req.body.Content)
+	}
+
+	expected := allowedMentions{Parse: []string{}, Users: []string{"42"}}
+	if !reflect.DeepEqual(req.body.AllowedMentions, expected) {
+		t.Errorf("got allowed mentions %+v instead of %+v", req.body.AllowedMentions, expected)
+	}
+
+	if err := c.Edit(msg, "100", "42"); err != nil {
+		t.Fatal(err)
+	}
+
+	req = <-requests
+	if req.path != "/api/webhooks/9/secret/messages/42" || req.query.Get("thread_id") != "7" ||
+		req.query.Get("wait") != "" {
+		t.Errorf("unexpected webhook edit request %+v", req)
+	}
+}
@@ -0,0 +1,184 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+var (
+	codeRegexp          = regexp.MustCompile("(?s)```(?:[a-zA-Z0-9+-]*\n)?(.*?)```|`([^`]+?)`")
+	boldRegexp          = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	underlineRegexp     = regexp.MustCompile(`__(.+?)__`)
+	italicRegexp        = regexp.MustCompile(`\*(.+?)\*|\b_(.+?)_\b`)
+	strikethroughRegexp = regexp.MustCompile(`~~(.+?)~~`)
+	spoilerRegexp       = regexp.MustCompile(`\|\|(.+?)\|\|`)
+	mentionRegexp       = regexp.MustCompile(`<@!?([0-9]+)>`)
+	channelRegexp       = regexp.MustCompile(`<#([0-9]+)>`)
+	emojiRegexp         = regexp.MustCompile(`<a?:(\w+):[0-9]+>`)
+	escapeRegexp        = regexp.MustCompile("([\\\\*_~`|>])")
+	userIDRegexp        = regexp.MustCompile(`^[0-9]+$`)
+)
+
+func (c *Client) convertToMetachat(msg message, edit bool) metachat.Message {
+	content := formatText(msg)
+	if msg.ReferencedMessage != nil {
+		content = metachat.Quote(formatText(*msg.ReferencedMessage), author(msg.ReferencedMessage.Author)) + " " +
+			content
+	}
+
+	if edit {
+		content = metachat.Edit(content)
+	}
+
+	return metachat.Message{
+		Messenger: c.id,
+		Chat:      msg.ChannelID,
+		Author:    author(msg.Author),
+		AuthorID:  msg.Author.ID,
+		Avatar:    avatar(msg.Author),
+		Text:      content,
+	}
+}
+
+func convertToDiscord(msg metachat.Message) string {
+	content := escape(msg.Text)
+	content = metachat.BoldRegexp.ReplaceAllString(content, "**${1}**")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "*${1}*")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~~${1}~~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "__${1}__")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "||${1}||")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "```${1}```")
+	content = metachat.MentionIDRegexp.ReplaceAllStringFunc(content, mentionDiscord)
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> **${1}**: ${2}\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	return content
+}
+
+// formatText converts the message content to metachat formatting. Code blocks and spans are kept as they are.
+func formatText(msg message) string {
+	names := make(map[string]string)
+	for _, u := range msg.Mentions {
+		names[u.ID] = author(u)
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, loc := range codeRegexp.FindAllStringSubmatchIndex(msg.Content, -1) {
+		result.WriteString(formatInline(msg.Content[last:loc[0]], names))
+
+		if loc[2] >= 0 {
+			result.WriteString(metachat.Preformatted(msg.Content[loc[2]:loc[3]]))
+		} else {
+			result.WriteString(metachat.Preformatted(msg.Content[loc[4]:loc[5]]))
+		}
+
+		last = loc[1]
+	}
+
+	result.WriteString(formatInline(msg.Content[last:], names))
+
+	return result.String()
+}
+
+// formatInline converts the Discord markdown and mentions of text outside of code to metachat formatting.
+func formatInline(text string, names map[string]string) string {
+	content := boldRegexp.ReplaceAllString(text, metachat.Bold("${1}"))
+	content = underlineRegexp.ReplaceAllString(content, metachat.Underline("${1}"))
+	content = italicRegexp.ReplaceAllString(content, metachat.Italic("${1}${2}"))
+	content = strikethroughRegexp.ReplaceAllString(content, metachat.Strikethrough("${1}"))
+	content = spoilerRegexp.ReplaceAllString(content, metachat.Spoiler("${1}"))
+	content = emojiRegexp.ReplaceAllString(content, ":${1}:")
+	content = channelRegexp.ReplaceAllString(content, "#${1}")
+	content = mentionRegexp.ReplaceAllStringFunc(content, func(match string) string {
+		id := mentionRegexp.FindStringSubmatch(match)[1]
+		if name, ok := names[id]; ok {
+			return metachat.Mention(name)
+		}
+
+		return match
+	})
+
+	return content
+}
+
+// mentionDiscord renders a mention of a Discord user ID as a user mention and other mentions as text.
+func mentionDiscord(mention string) string {
+	groups := metachat.MentionIDRegexp.FindStringSubmatch(mention)
+	if !userIDRegexp.MatchString(groups[1]) {
+		return "@" + groups[2]
+	}
+
+	return "<@" + groups[1] + ">"
+}
+
+// mentionedUsers returns the Discord user IDs mentioned in the text, so that only they are notified.
+func mentionedUsers(text string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, groups := range metachat.MentionIDRegexp.FindAllStringSubmatch(text, -1) {
+		id := groups[1]
+		if userIDRegexp.MatchString(id) && !seen[id] && len(result) < maxAllowedMentions {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+// escape prevents Discord from treating markup characters outside of preformatted blocks as formatting.
+func escape(text string) string {
+	var result strings.Builder
+	last := 0
+	for _, loc := range metachat.PreformattedRegexp.FindAllStringIndex(text, -1) {
+		result.WriteString(escapeRegexp.ReplaceAllString(text[last:loc[0]], `\${1}`))
+		result.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+
+	result.WriteString(escapeRegexp.ReplaceAllString(text[last:], `\${1}`))
+
+	return result.String()
+}
+
+func author(u user) string {
+	if u.GlobalName != "" {
+		return u.GlobalName
+	}
+
+	return u.Username
+}
+
+func avatar(u user) string {
+	if u.Avatar == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", u.ID, u.Avatar)
+}
+
+// converter exposes the Discord conversions. Outbound payloads are webhook messages.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	payload, err := json.MarshalIndent((&Client{}).webhookMessage(msg), "", "  ")
+
+	return payload, errors.WithStack(err)
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var msg message
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	return (&Client{id: "Discord"}).convertToMetachat(msg, msg.EditedTimestamp != ""), nil
+}
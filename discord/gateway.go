@@ -0,0 +1,284 @@
+package discord
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	gatewayVersion = "10"
+
+	// GUILD_MESSAGES, DIRECT_MESSAGES and MESSAGE_CONTENT.
+	gatewayIntents = 1<<9 | 1<<12 | 1<<15
+)
+
+// reconnectDelay is the pause before connecting to the gateway again.
+var reconnectDelay = 5 * time.Second
+
+// Gateway opcodes.
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+	opHeartbeatACK   = 11
+)
+
+type (
+	payload struct {
+		Op int             `json:"op"`
+		D  json.RawMessage `json:"d,omitempty"`
+		S  *int64          `json:"s,omitempty"`
+		T  string          `json:"t,omitempty"`
+	}
+
+	hello struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+
+	ready struct {
+		User user `json:"user"`
+	}
+
+	identify struct {
+		Token      string             `json:"token"`
+		Intents    int                `json:"intents"`
+		Properties identifyProperties `json:"properties"`
+	}
+
+	identifyProperties struct {
+		OS      string `json:"os"`
+		Browser string `json:"browser"`
+		Device  string `json:"device"`
+	}
+
+	gatewayResponse struct {
+		URL string `json:"url"`
+	}
+
+	// session is the state of the current gateway connection.
+	session struct {
+		sync.Mutex
+		conn     *websocket.Conn
+		sequence *int64
+		userID   string
+	}
+)
+
+// Start connects to the Discord gateway and reconnects whenever the connection is lost.
+// It returns only if the gateway rejects the bot token or intents.
+func (c *Client) Start() error {
+	for {
+		err := c.runSession()
+		if isFatal(err) {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		time.Sleep(reconnectDelay)
+	}
+}
+
+func (c *Client) runSession() error {
+	var gateway gatewayResponse
+	err := c.do(http.MethodGet, c.apiURL+"/gateway/bot", true, nil, &gateway)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(gateway.URL+"?v="+gatewayVersion+"&encoding=json", nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer conn.Close()
+
+	c.session.reset(conn)
+
+	var first payload
+	err = conn.ReadJSON(&first)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if first.Op != opHello {
+		return errors.Errorf("got opcode %d instead of Hello", first.Op)
+	}
+
+	var h hello
+	err = json.Unmarshal(first.D, &h)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go c.heartbeat(time.Duration(h.HeartbeatInterval)*time.Millisecond, done)
+
+	err = c.session.send(opIdentify, identify{
+		Token:      c.token,
+		Intents:    gatewayIntents,
+		Properties: identifyProperties{OS: "linux", Browser: "metachat", Device: "metachat"},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		var p payload
+		err = conn.ReadJSON(&p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch p.Op {
+		case opDispatch:
+			c.session.setSequence(p.S)
+			err = c.handleDispatch(p)
+			if err != nil {
+				return err
+			}
+
+		case opHeartbeat:
+			err = c.session.send(opHeartbeat, c.session.getSequence())
+			if err != nil {
+				return err
+			}
+
+		case opReconnect, opInvalidSession:
+			return nil
+		}
+	}
+}
+
+func (c *Client) handleDispatch(p payload) error {
+	switch p.T {
+	case "READY":
+		var r ready
+		err := json.Unmarshal(p.D, &r)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		c.session.setUserID(r.User.ID)
+
+	case "MESSAGE_CREATE", "MESSAGE_UPDATE":
+		var msg message
+		err := json.Unmarshal(p.D, &msg)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Discord also sends updates when it resolves embeds and link previews, only the ones
+		// with the edit time are edits.
+		edit := p.T == "MESSAGE_UPDATE"
+		if msg.Content == "" || msg.Author.ID == "" || edit && msg.EditedTimestamp == "" || c.isOwn(msg) {
+			return nil
+		}
+
+		c.messageChan <- c.convertToMetachat(msg, edit)
+	}
+
+	return nil
+}
+
+func (c *Client) heartbeat(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.session.send(opHeartbeat, c.session.getSequence()); err != nil {
+				log.Printf("%+v", err)
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *session) reset(conn *websocket.Conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.conn = conn
+	s.sequence = nil
+}
+
+// send writes a payload to the gateway. Writes are serialized as the connection supports
+// only one concurrent writer.
+func (s *session) send(op int, data interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return errors.WithStack(s.conn.WriteJSON(payload{Op: op, D: content}))
+}
+
+func (s *session) setSequence(sequence *int64) {
+	if sequence == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.sequence = sequence
+}
+
+func (s *session) getSequence() *int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.sequence
+}
+
+func (s *session) setUserID(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.userID = id
+}
+
+func (s *session) getUserID() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.userID
+}
+
+// isFatal reports whether the gateway closed the connection for a reason reconnecting can't fix,
+// like an invalid token or disallowed intents.
+func isFatal(err error) bool {
+	closeErr, ok := errors.Cause(err).(*websocket.CloseError)
+	if !ok {
+		return false
+	}
+
+	switch closeErr.Code {
+	case 4004, 4010, 4011, 4012, 4013, 4014:
+		return true
+	}
+
+	return false
+}
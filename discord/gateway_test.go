@@ -0,0 +1,237 @@
+package discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakeGateway is a Discord API serving the gateway URL and a gateway greeting every connection
+// with Hello and answering Identify with Ready. Connections are handed over to the test.
+type fakeGateway struct {
+	server     *httptest.Server
+	identifies chan identify
+	conns      chan *websocket.Conn
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	g := &fakeGateway{identifies: make(chan identify, 10), conns: make(chan *websocket.Conn, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/gateway/bot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bot token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		url := "ws" + strings.TrimPrefix(g.server.URL, "http") + "/gateway"
+		json.NewEncoder(w).Encode(gatewayResponse{URL: url})
+	})
+
+	mux.HandleFunc("/gateway", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("v") != gatewayVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		writePayload(t, conn, opHello, "", hello{HeartbeatInterval: 60000})
+
+		var p payload
+		if err := conn.ReadJSON(&p); err != nil || p.Op != opIdentify {
+			t.Errorf("got %+v instead of Identify: %v", p, err)
+			return
+		}
+
+		var id identify
+		if err := json.Unmarshal(p.D, &id); err != nil {
+			t.Error(err)
+		}
+
+		g.identifies <- id
+		writePayload(t, conn, opDispatch, "READY", ready{User: user{ID: "1", Username: "metachat", Bot: true}})
+		g.conns <- conn
+	})
+
+	g.server = httptest.NewServer(mux)
+	t.Cleanup(g.server.Close)
+
+	return g
+}
+
+// accept waits for the client to connect and identify.
+func (g *fakeGateway) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	select {
+	case id := <-g.identifies:
+		if id.Token != "token" || id.Intents != gatewayIntents {
+			t.Errorf("unexpected identify %+v", id)
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't identify")
+	}
+
+	conn := <-g.conns
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGatewayRelaysMessages(t *testing.T) {
+	g := newFakeGateway(t)
+	c := newTestClient(t, g.server.URL, map[string]string{"100": "https://discord.test/api/webhooks/9/secret"})
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Start() }()
+
+	conn := g.accept(t)
+
+	tests := []struct {
+		name  string
+		event string
+		msg   message
+		want  string
+	}{
+		{name: "message", event: "MESSAGE_CREATE", msg: userMessage("hello **world**"),
+			want: "hello " + metachat.Bold("world")},
+		{name: "embed update", event: "MESSAGE_UPDATE", msg: userMessage("see https://example.com")},
+		{name: "edit", event: "MESSAGE_UPDATE", msg: edited(userMessage("fixed")), want: metachat.Edit("fixed")},
+		{name: "bot message", event: "MESSAGE_CREATE", msg: message{ChannelID: "100", Content: "echo",
+			Author: user{ID: "1", Username: "metachat", Bot: true}}},
+		{name: "webhook message", event: "MESSAGE_CREATE", msg: message{ChannelID: "100", Content: "echo",
+			WebhookID: "9", Author: user{ID: "9", Username: "Alice"}}},
+		{name: "other webhook message", event: "MESSAGE_CREATE", msg: message{ChannelID: "100", Content: "ci",
+			WebhookID: "8", Author: user{ID: "8", Username: "CI"}}, want: "ci"},
+		{name: "code", event: "MESSAGE_CREATE", msg: userMessage("run `a*b*c` and ```\n**x** _y_\n``` *ok*"),
+			want: "run " + metachat.Preformatted("a*b*c") + " and " + metachat.Preformatted("**x** _y_\n") + " " +
+				metachat.Italic("ok")},
+	}
+
+	for _, test := range tests {
+		writePayload(t, conn, opDispatch, test.event, test.msg)
+
+		select {
+		case msg := <-c.MessageChan():
+			if test.want == "" {
+				t.Errorf("%s: message %+v is relayed", test.name, msg)
+			} else if msg.Text != test.want || msg.Chat != "100" {
+				t.Errorf("%s: got %+v instead of %q", test.name, msg, test.want)
+			}
+
+		case <-time.After(100 * time.Millisecond):
+			if test.want != "" {
+				t.Errorf("%s: message isn't relayed", test.name)
+			}
+		}
+	}
+
+	closeConn(t, conn, 4004)
+
+	select {
+	case err := <-errs:
+		if !isFatal(err) {
+			t.Errorf("Start returned %v after an authentication failure", err)
+		}
+
+	case <-time.After(testTimeout):
+		t.Error("Start didn't return after an authentication failure")
+	}
+}
+
+func TestGatewayReconnects(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	g := newFakeGateway(t)
+	c := newTestClient(t, g.server.URL, nil)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Start() }()
+
+	writePayload(t, g.accept(t), opReconnect, "", nil)
+	closeConn(t, g.accept(t), websocket.CloseGoingAway)
+
+	conn := g.accept(t)
+	writePayload(t, conn, opHeartbeat, "", nil)
+
+	var p payload
+	if err := conn.ReadJSON(&p); err != nil || p.Op != opHeartbeat {
+		t.Errorf("got %+v instead of Heartbeat: %v", p, err)
+	}
+
+	closeConn(t, conn, 4014)
+
+	select {
+	case err := <-errs:
+		if !isFatal(err) {
+			t.Errorf("Start returned %v after a fatal close", err)
+		}
+
+	case <-time.After(testTimeout):
+		t.Error("Start didn't return after a fatal close")
+	}
+}
+
+func newTestClient(t *testing.T, url string, webhooks map[string]string) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{Token: "token", APIURL: url + "/api", Webhooks: webhooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func userMessage(content string) message {
+	return message{ID: "5", ChannelID: "100", Content: content, Author: user{ID: "2", Username: "alice"}}
+}
+
+func edited(msg message) message {
+	msg.EditedTimestamp = "2024-01-01T00:00:00+00:00"
+
+	return msg
+}
+
+func writePayload(t *testing.T, conn *websocket.Conn, op int, event string, data interface{}) {
+	t.Helper()
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequence := int64(1)
+	p := payload{Op: op, D: content, T: event}
+	if op == opDispatch {
+		p.S = &sequence
+	}
+
+	if err := conn.WriteJSON(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeConn(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+
+	err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,568 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	readTimeout = 5 * time.Minute
+	queueSize   = 1000
+
+	// Flood protection: up to floodBurst lines at once and one more line every floodInterval.
+	floodBurst    = 4
+	floodInterval = 2 * time.Second
+
+	saslChunkSize = 400
+
+	// maxReconnectDelay caps the pause between failed connections, which doubles from reconnectDelay.
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// reconnectDelay is the pause before connecting to the server again after a connection is lost.
+var reconnectDelay = 10 * time.Second
+
+type (
+	// Config structure. Password is used for SASL PLAIN authentication, NickServPassword
+	// for identifying with NickServ on networks without SASL.
+	Config struct {
+		ID               string      `json:"-"`
+		Server           string      `json:"server" required:"true"`
+		PlainText        bool        `json:"plainText"`
+		Nick             string      `json:"nick" required:"true"`
+		Username         string      `json:"username"`
+		RealName         string      `json:"realName"`
+		Password         string      `json:"password"`
+		NickServPassword string      `json:"nickServPassword"`
+		Channels         []string    `json:"channels"`
+		TLSConfig        *tls.Config `json:"-"`
+	}
+
+	// Client is an IRC client.
+	Client struct {
+		id               string
+		server           string
+		plainText        bool
+		tlsConfig        *tls.Config
+		nick             string
+		username         string
+		realName         string
+		password         string
+		nickServPassword string
+		messageChan      chan metachat.Message
+		channels         *channelSet
+		connLock         sync.RWMutex
+		conn             *connection
+		quit             chan struct{}
+	}
+
+	// connection is a single IRC server connection. Registered is set once the server welcomes the client.
+	connection struct {
+		sync.Mutex
+		conn       net.Conn
+		nick       string
+		capSASL    bool
+		registered bool
+		queue      chan string
+		done       chan struct{}
+	}
+
+	// line is a parsed IRC protocol line.
+	line struct {
+		prefix  string
+		command string
+		params  []string
+	}
+
+	channelSet struct {
+		sync.Mutex
+		channels map[string]bool
+	}
+)
+
+func init() {
+	metachat.Register("irc", newMessenger, Config{})
+	metachat.RegisterConverter("irc", converter{})
+}
+
+// NewClient is an IRC client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.Server == "" || config.Nick == "" {
+		return nil, errors.New("server and nick can't be nil")
+	}
+
+	username := config.Username
+	if username == "" {
+		username = config.Nick
+	}
+
+	realName := config.RealName
+	if realName == "" {
+		realName = config.Nick
+	}
+
+	channels := &channelSet{channels: make(map[string]bool)}
+	for _, channel := range config.Channels {
+		channels.add(channel)
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "IRC"
+	}
+
+	return &Client{
+		id:               id,
+		server:           config.Server,
+		plainText:        config.PlainText,
+		tlsConfig:        config.TLSConfig,
+		nick:             config.Nick,
+		username:         username,
+		realName:         realName,
+		password:         config.Password,
+		nickServPassword: config.NickServPassword,
+		messageChan:      make(chan metachat.Message, 100),
+		channels:         channels,
+		quit:             make(chan struct{}),
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Start connects to the server and reconnects whenever the connection is lost. Rejected SASL credentials
+// are handled the same way, since networks also reject them while their services are down. The pause
+// doubles after every connection that isn't registered, up to maxReconnectDelay.
+func (c *Client) Start() error {
+	delay := reconnectDelay
+	for {
+		registered, err := c.run()
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		if registered {
+			delay = reconnectDelay
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.quit:
+			return nil
+		}
+
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// Join joins the channels at once if connected and on every connection.
+func (c *Client) Join(chats []string) {
+	c.connLock.RLock()
+	conn := c.conn
+	c.connLock.RUnlock()
+
+	for _, chat := range chats {
+		if c.channels.add(chat) && conn != nil {
+			conn.enqueue("JOIN " + chat)
+		}
+	}
+}
+
+// Send sends a message to the channel with the provided name.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	c.connLock.RLock()
+	conn := c.conn
+	c.connLock.RUnlock()
+
+	if conn == nil {
+		return errors.New("not connected to the IRC server")
+	}
+
+	if c.channels.add(chat) {
+		conn.enqueue("JOIN " + chat)
+	}
+
+	for _, text := range convertToIRC(msg) {
+		if !conn.enqueue(fmt.Sprintf("PRIVMSG %s :%s", chat, text)) {
+			return errors.Errorf("outgoing queue of channel '%s' is full", chat)
+		}
+	}
+
+	return nil
+}
+
+// run serves a single connection and reports whether it was registered.
+func (c *Client) run() (bool, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
+	}
+
+	defer c.disconnect(conn)
+
+	go conn.write()
+
+	reader := bufio.NewReader(conn.conn)
+
+	if c.password != "" {
+		conn.writeNow("CAP LS 302")
+	}
+
+	conn.writeNow("NICK " + c.nick)
+	conn.writeNow(fmt.Sprintf("USER %s 0 * :%s", c.username, c.realName))
+
+	for {
+		err = conn.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if err != nil {
+			return conn.registered, errors.WithStack(err)
+		}
+
+		raw, err := reader.ReadString('\n')
+		if err != nil {
+			return conn.registered, errors.WithStack(err)
+		}
+
+		err = c.handle(conn, parseLine(raw))
+		if err != nil {
+			return conn.registered, err
+		}
+	}
+}
+
+func (c *Client) dial() (*connection, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if c.plainText {
+		conn, err = dialer.Dial("tcp", c.server)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.server, c.tlsConfig)
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &connection{
+		conn:  conn,
+		nick:  c.nick,
+		queue: make(chan string, queueSize),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+func (c *Client) handle(conn *connection, l line) error {
+	switch l.command {
+	case "PING":
+		conn.writeNow("PONG :" + l.param(0))
+
+	case "CAP":
+		return c.handleCap(conn, l)
+
+	case "AUTHENTICATE":
+		if l.param(0) == "+" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(c.username + "\x00" + c.username + "\x00" +
+				c.password))
+
+			for _, chunk := range splitSASL(credentials) {
+				conn.writeNow("AUTHENTICATE " + chunk)
+			}
+		}
+
+	case "903":
+		conn.writeNow("CAP END")
+
+	case "904", "905":
+		return errors.Errorf("SASL authentication failed: %s", l.param(len(l.params)-1))
+
+	case "001":
+		conn.registered = true
+		c.setConnection(conn)
+		if c.nickServPassword != "" {
+			conn.writeNow("PRIVMSG NickServ :IDENTIFY " + c.nickServPassword)
+		}
+
+		for _, channel := range c.channels.list() {
+			conn.enqueue("JOIN " + channel)
+		}
+
+	case "433":
+		conn.nick += "_"
+		conn.writeNow("NICK " + conn.nick)
+
+	case "PRIVMSG":
+		nick := l.nick()
+		channel := l.param(0)
+		if nick == conn.nick || !strings.HasPrefix(channel, "#") {
+			return nil
+		}
+
+		text, ok := convertToMetachat(l.param(1))
+		if ok {
+			c.messageChan <- metachat.Message{
+				Messenger: c.id,
+				Chat:      channel,
+				Author:    nick,
+				AuthorID:  nick,
+				Text:      text,
+			}
+		}
+
+	case "ERROR":
+		return errors.Errorf("server closed the connection: %s", l.param(0))
+	}
+
+	return nil
+}
+
+func (c *Client) handleCap(conn *connection, l line) error {
+	switch l.param(1) {
+	case "LS":
+		if strings.Contains(" "+l.param(len(l.params)-1), " sasl") {
+			conn.capSASL = true
+		}
+
+		// Capabilities may be listed in several lines, all but the last one have an asterisk.
+		if l.param(2) == "*" {
+			return nil
+		}
+
+		if conn.capSASL {
+			conn.writeNow("CAP REQ :sasl")
+		} else {
+			conn.writeNow("CAP END")
+		}
+
+	case "ACK":
+		conn.writeNow("AUTHENTICATE PLAIN")
+
+	case "NAK":
+		conn.writeNow("CAP END")
+	}
+
+	return nil
+}
+
+func (c *Client) setConnection(conn *connection) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	c.conn = conn
+}
+
+func (c *Client) disconnect(conn *connection) {
+	c.connLock.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+
+	c.connLock.Unlock()
+
+	conn.close()
+}
+
+func (conn *connection) close() {
+	close(conn.done)
+	conn.conn.Close()
+}
+
+// enqueue adds the line to the flood protected queue.
+func (conn *connection) enqueue(text string) bool {
+	select {
+	case conn.queue <- text:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// writeNow writes the line bypassing the queue. It's used for registration and PONG replies
+// that must not wait behind the queued messages.
+func (conn *connection) writeNow(text string) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	_, err := conn.conn.Write([]byte(text + "\r\n"))
+	if err != nil {
+		log.Printf("%+v", errors.WithStack(err))
+	}
+}
+
+// write drains the queue respecting the flood protection limits.
+func (conn *connection) write() {
+	tokens := floodBurst
+	ticker := time.NewTicker(floodInterval)
+	defer ticker.Stop()
+
+	for {
+		if tokens == 0 {
+			select {
+			case <-ticker.C:
+				tokens++
+				continue
+
+			case <-conn.done:
+				return
+			}
+		}
+
+		select {
+		case text := <-conn.queue:
+			conn.writeNow(text)
+			tokens--
+
+		case <-ticker.C:
+			if tokens < floodBurst {
+				tokens++
+			}
+
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+func (s *channelSet) add(channel string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.channels[channel] {
+		return false
+	}
+
+	s.channels[channel] = true
+
+	return true
+}
+
+func (s *channelSet) list() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make([]string, 0, len(s.channels))
+	for channel := range s.channels {
+		result = append(result, channel)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+func parseLine(raw string) line {
+	raw = strings.TrimRight(raw, "\r\n")
+	if strings.HasPrefix(raw, "@") {
+		if i := strings.Index(raw, " "); i >= 0 {
+			raw = raw[i+1:]
+		}
+	}
+
+	var result line
+	if strings.HasPrefix(raw, ":") {
+		i := strings.Index(raw, " ")
+		if i < 0 {
+			return result
+		}
+
+		result.prefix = raw[1:i]
+		raw = raw[i+1:]
+	}
+
+	for raw != "" {
+		if strings.HasPrefix(raw, ":") {
+			result.params = append(result.params, raw[1:])
+			break
+		}
+
+		i := strings.Index(raw, " ")
+		if i < 0 {
+			i = len(raw)
+		}
+
+		if result.command == "" {
+			result.command = strings.ToUpper(raw[:i])
+		} else {
+			result.params = append(result.params, raw[:i])
+		}
+
+		raw = strings.TrimLeft(raw[i:], " ")
+	}
+
+	return result
+}
+
+func (l line) param(i int) string {
+	if i < 0 || i >= len(l.params) {
+		return ""
+	}
+
+	return l.params[i]
+}
+
+func (l line) nick() string {
+	if i := strings.Index(l.prefix, "!"); i >= 0 {
+		return l.prefix[:i]
+	}
+
+	return l.prefix
+}
+
+func splitSASL(credentials string) []string {
+	var result []string
+	for len(credentials) >= saslChunkSize {
+		result = append(result, credentials[:saslChunkSize])
+		credentials = credentials[saslChunkSize:]
+	}
+
+	if credentials == "" {
+		credentials = "+"
+	}
+
+	return append(result, credentials)
+}
@@ -0,0 +1,332 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakeServer is an in-process IRC server handing accepted connections over to the test.
+type fakeServer struct {
+	listener net.Listener
+	conns    chan *serverConn
+}
+
+// serverConn is the server side of a client connection.
+type serverConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{listener: listener, conns: make(chan *serverConn, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.conns <- &serverConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+		}
+	}()
+
+	return s
+}
+
+// accept waits for the client to connect.
+func (s *fakeServer) accept(t *testing.T) *serverConn {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.conn.Close() })
+		return conn
+
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't connect")
+		return nil
+	}
+}
+
+// expect reads the next line from the client and compares it with the expected one.
+func (c *serverConn) expect(want string) {
+	c.t.Helper()
+
+	err := c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	raw, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("got %v instead of %q", err, want)
+	}
+
+	if got := strings.TrimSuffix(raw, "\r\n"); got != want {
+		c.t.Fatalf("got %q instead of %q", got, want)
+	}
+}
+
+func (c *serverConn) send(format string, args ...interface{}) {
+	c.t.Helper()
+
+	_, err := fmt.Fprintf(c.conn, format+"\r\n", args...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// stop quits the client and drops the connection, which makes the client return from Start.
+func (c *serverConn) stop(client *Client, errs <-chan error) {
+	c.t.Helper()
+
+	close(client.quit)
+	c.conn.Close()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			c.t.Errorf("Start returned %v", err)
+		}
+
+	case <-time.After(testTimeout):
+		c.t.Error("Start didn't return")
+	}
+}
+
+// register completes the registration without SASL and waits for the client to join the channels.
+func (c *serverConn) register(nick string, channels ...string) {
+	c.t.Helper()
+
+	c.expect("NICK " + nick)
+	c.expect(fmt.Sprintf("USER %s 0 * :%s", nick, nick))
+	c.send(":irc.test 001 %s :Welcome", nick)
+
+	for _, channel := range channels {
+		c.expect("JOIN " + channel)
+	}
+}
+
+func TestClientAuthenticatesWithSASL(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	c := newTestClient(t, Config{Server: s.listener.Addr().String(), Nick: "bridge", Password: "secret",
+		NickServPassword: "hunter2", Channels: []string{"#team"}})
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.expect("CAP LS 302")
+	conn.expect("NICK bridge")
+	conn.expect("USER bridge 0 * :bridge")
+
+	conn.send(":irc.test CAP * LS * :multi-prefix")
+	conn.send(":irc.test CAP * LS :away-notify sasl")
+	conn.expect("CAP REQ :sasl")
+	conn.send(":irc.test CAP * ACK :sasl")
+	conn.expect("AUTHENTICATE PLAIN")
+	conn.send("AUTHENTICATE +")
+	conn.expect("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("bridge\x00bridge\x00secret")))
+	conn.send(":irc.test 903 bridge :SASL authentication successful")
+	conn.expect("CAP END")
+
+	conn.send(":irc.test 001 bridge :Welcome")
+	conn.expect("PRIVMSG NickServ :IDENTIFY hunter2")
+	conn.expect("JOIN #team")
+
+	conn.send("PING :irc.test")
+	conn.expect("PONG :irc.test")
+
+	conn.send("ERROR :Closing link")
+	conn = s.accept(t)
+	conn.expect("CAP LS 302")
+	conn.expect("NICK bridge")
+	conn.expect("USER bridge 0 * :bridge")
+	conn.send(":irc.test CAP * LS :sasl")
+	conn.expect("CAP REQ :sasl")
+	conn.send(":irc.test CAP * ACK :sasl")
+	conn.expect("AUTHENTICATE PLAIN")
+	conn.send(":irc.test 904 bridge :SASL authentication failed")
+
+	conn = s.accept(t)
+	conn.expect("CAP LS 302")
+	conn.stop(c, errs)
+}
+
+func TestClientRelaysMessages(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, Config{Server: s.listener.Addr().String(), Nick: "bridge", Channels: []string{"#team"}})
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.register("bridge", "#team")
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "message", line: ":alice!a@host PRIVMSG #team :hello \x1fworld\x1f",
+			want: "hello " + metachat.Underline("world")},
+		{name: "action", line: ":alice!a@host PRIVMSG #team :\x01ACTION waves\x01", want: metachat.Italic("waves")},
+		{name: "CTCP", line: ":alice!a@host PRIVMSG #team :\x01VERSION\x01"},
+		{name: "private message", line: ":alice!a@host PRIVMSG bridge :hi"},
+		{name: "own message", line: ":bridge!b@host PRIVMSG #team :echo"},
+		{name: "message tags", line: "@time=2020-01-01T00:00:00Z :bob!b@host PRIVMSG #team :tagged", want: "tagged"},
+	}
+
+	for _, test := range tests {
+		conn.send(test.line)
+
+		select {
+		case msg := <-c.MessageChan():
+			if test.want == "" {
+				t.Errorf("%s: message %+v is relayed", test.name, msg)
+			} else if msg.Text != test.want || msg.Chat != "#team" || msg.Messenger != "IRC" {
+				t.Errorf("%s: got %+v instead of %q", test.name, msg, test.want)
+			}
+
+		case <-time.After(100 * time.Millisecond):
+			if test.want != "" {
+				t.Errorf("%s: message isn't relayed", test.name)
+			}
+		}
+	}
+
+	err := c.Send(metachat.Message{Author: "carol", Text: "one\ntwo" + metachat.OriginMarker}, "#other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.expect("JOIN #other")
+	conn.expect("PRIVMSG #other :\x02[carol]\x02 one" + metachat.OriginMarker)
+	conn.expect("PRIVMSG #other :\x02[carol]\x02 two" + metachat.OriginMarker)
+	conn.stop(c, errs)
+}
+
+func TestClientRenamesWhenNickIsInUse(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, Config{Server: s.listener.Addr().String(), Nick: "bridge", Channels: []string{"#team"}})
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.expect("NICK bridge")
+	conn.expect("USER bridge 0 * :bridge")
+	conn.send(":irc.test 433 * bridge :Nickname is already in use")
+	conn.expect("NICK bridge_")
+	conn.send(":irc.test 001 bridge_ :Welcome")
+	conn.expect("JOIN #team")
+
+	conn.send(":bridge_!b@host PRIVMSG #team :echo")
+	conn.send(":bridge!b@host PRIVMSG #team :other client")
+
+	select {
+	case msg := <-c.MessageChan():
+		if msg.Text != "other client" {
+			t.Errorf("own message %+v is relayed", msg)
+		}
+
+	case <-time.After(testTimeout):
+		t.Error("message isn't relayed")
+	}
+
+	conn.stop(c, errs)
+}
+
+func TestClientReconnects(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	c := newTestClient(t, Config{Server: s.listener.Addr().String(), Nick: "bridge", Channels: []string{"#team"}})
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.register("bridge", "#team")
+
+	err := c.Send(metachat.Message{Text: "hi"}, "#other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.expect("JOIN #other")
+	conn.expect("PRIVMSG #other :hi")
+	conn.conn.Close()
+
+	conn = s.accept(t)
+	conn.expect("NICK bridge")
+	conn.expect("USER bridge 0 * :bridge")
+	conn.send(":irc.test 001 bridge :Welcome")
+	conn.expect("JOIN #other")
+	conn.expect("JOIN #team")
+	conn.stop(c, errs)
+}
+
+func TestClientJoinsRoomChannels(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, Config{Server: s.listener.Addr().String(), Nick: "bridge", Channels: []string{"#team"}})
+	c.Join([]string{"#room", "#team"})
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.register("bridge", "#room", "#team")
+
+	c.Join([]string{"#linked", "#room"})
+	conn.expect("JOIN #linked")
+
+	conn.send("PING :irc.test")
+	conn.expect("PONG :irc.test")
+	conn.stop(c, errs)
+}
+
+func TestSendWithoutConnection(t *testing.T) {
+	c := newTestClient(t, Config{Server: "127.0.0.1:1", Nick: "bridge"})
+
+	err := c.Send(metachat.Message{Text: "hi"}, "#team")
+	if err == nil {
+		t.Error("message is sent without a connection")
+	}
+}
+
+func newTestClient(t *testing.T, config Config) *Client {
+	t.Helper()
+
+	config.PlainText = true
+
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func startClient(c *Client) <-chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- c.Start() }()
+
+	return errs
+}
@@ -0,0 +1,314 @@
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// mIRC formatting codes.
+const (
+	codeBold          = '\x02'
+	codeColor         = '\x03'
+	codeHexColor      = '\x04'
+	codeReset         = '\x0f'
+	codeMonospace     = '\x11'
+	codeReverse       = '\x16'
+	codeItalic        = '\x1d'
+	codeStrikethrough = '\x1e'
+	codeUnderline     = '\x1f'
+)
+
+const (
+	// maxLineLength leaves room for the PRIVMSG command, the channel and the sender prefix
+	// added by the server within the 512 bytes IRC line limit.
+	maxLineLength = 400
+	actionPrefix  = "\x01ACTION "
+
+	// maxAuthorLength is the byte length author names are cut to, so that a line always has room for text.
+	maxAuthorLength = 64
+
+	// formattingCodes is the number of formatting codes that may be reopened and closed in every line.
+	formattingCodes = 5
+)
+
+var (
+	colorRegexp    = regexp.MustCompile(`^\x03(?:[0-9]{1,2}(?:,[0-9]{1,2})?)?`)
+	hexColorRegexp = regexp.MustCompile(`^\x04(?:[0-9a-fA-F]{6}(?:,[0-9a-fA-F]{6})?)?`)
+)
+
+type (
+	style struct {
+		bold          bool
+		italic        bool
+		strikethrough bool
+		underline     bool
+		monospace     bool
+	}
+
+	segment struct {
+		style style
+		text  string
+	}
+)
+
+func convertToMetachat(text string) (string, bool) {
+	action := false
+	if strings.HasPrefix(text, "\x01") {
+		if !strings.HasPrefix(text, actionPrefix) {
+			return "", false
+		}
+
+		text = strings.TrimSuffix(strings.TrimPrefix(text, actionPrefix), "\x01")
+		action = true
+	}
+
+	var result strings.Builder
+	for _, s := range parseFormatting(text) {
+		result.WriteString(s.format())
+	}
+
+	content := result.String()
+	if content == "" {
+		return "", false
+	}
+
+	if action {
+		content = metachat.Italic(content)
+	}
+
+	return content, true
+}
+
+// convertToIRC converts the message to IRC lines. The origin marker of a relayed message is added
+// to every line, so that none of them is relayed again by another bridge.
+func convertToIRC(msg metachat.Message) []string {
+	text := msg.Text
+	marker := ""
+	if strings.HasSuffix(text, metachat.OriginMarker) {
+		text = strings.TrimSuffix(text, metachat.OriginMarker)
+		marker = metachat.OriginMarker
+	}
+
+	content := metachat.BoldRegexp.ReplaceAllString(text, "\x02${1}\x02")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "\x1d${1}\x1d")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "\x1e${1}\x1e")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "\x1f${1}\x1f")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "\x11${1}\x11")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "Quote from ${1}: ${2}\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	prefix := ""
+	if msg.Author != "" {
+		prefix = fmt.Sprintf("\x02[%s]\x02 ", cut(msg.Author, maxAuthorLength))
+	}
+
+	lines := splitLines(content, maxLineLength-len(prefix)-len(marker))
+	for i, l := range lines {
+		lines[i] = prefix + l + marker
+	}
+
+	return lines
+}
+
+// parseFormatting splits the text into segments of the same style dropping colors and
+// the formatting Metachat doesn't support.
+func parseFormatting(text string) []segment {
+	var result []segment
+	var current style
+	var buf strings.Builder
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+
+		if n := len(result); n > 0 && result[n-1].style == current {
+			result[n-1].text += buf.String()
+		} else {
+			result = append(result, segment{style: current, text: buf.String()})
+		}
+
+		buf.Reset()
+	}
+
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case codeBold, codeItalic, codeStrikethrough, codeUnderline, codeMonospace, codeReset:
+			flush()
+			current = current.toggle(text[i])
+			i++
+
+		case codeColor:
+			i += len(colorRegexp.FindString(text[i:]))
+
+		case codeHexColor:
+			i += len(hexColorRegexp.FindString(text[i:]))
+
+		case codeReverse:
+			i++
+
+		default:
+			buf.WriteByte(text[i])
+			i++
+		}
+	}
+
+	flush()
+
+	return result
+}
+
+func (s style) toggle(code byte) style {
+	switch code {
+	case codeBold:
+		s.bold = !s.bold
+	case codeItalic:
+		s.italic = !s.italic
+	case codeStrikethrough:
+		s.strikethrough = !s.strikethrough
+	case codeUnderline:
+		s.underline = !s.underline
+	case codeMonospace:
+		s.monospace = !s.monospace
+	case codeReset:
+		s = style{}
+	}
+
+	return s
+}
+
+func (s segment) format() string {
+	if s.style.monospace {
+		return metachat.Preformatted(s.text)
+	}
+
+	text := s.text
+	if s.style.strikethrough {
+		text = metachat.Strikethrough(text)
+	}
+
+	if s.style.underline {
+		text = metachat.Underline(text)
+	}
+
+	if s.style.italic {
+		text = metachat.Italic(text)
+	}
+
+	if s.style.bold {
+		text = metachat.Bold(text)
+	}
+
+	return text
+}
+
+// splitLines splits the text into IRC lines no longer than limit bytes, preferring to break at spaces.
+// Formatting active at the end of a line is closed and reopened at the beginning of the next one.
+// Every line gets at least one character, even if it makes the line longer than the limit.
+func splitLines(text string, limit int) []string {
+	budget := limit - 2*formattingCodes
+	if budget < 1 {
+		budget = 1
+	}
+
+	var result []string
+	var open []byte
+	for _, l := range strings.Split(text, "\n") {
+		for l != "" {
+			chunk := cut(l, budget)
+			l = l[len(chunk):]
+			if l != "" {
+				if i := strings.LastIndexByte(chunk, ' '); i > 0 {
+					l = chunk[i+1:] + l
+					chunk = chunk[:i]
+				}
+			}
+
+			reopen := string(open)
+			open = updateOpenCodes(open, chunk)
+
+			if strings.TrimSpace(chunk) != "" {
+				result = append(result, reopen+chunk+closeCodes(open))
+			}
+		}
+	}
+
+	return result
+}
+
+// cut returns the longest prefix of the text not longer than limit bytes that doesn't break a UTF-8 sequence.
+// The prefix is the first rune of the text if the rune alone is longer than limit.
+func cut(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+
+	end := limit
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+
+	if end == 0 {
+		_, end = utf8.DecodeRuneInString(text)
+	}
+
+	return text[:end]
+}
+
+func updateOpenCodes(open []byte, text string) []byte {
+	result := append([]byte{}, open...)
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case codeReset:
+			result = result[:0]
+
+		case codeBold, codeItalic, codeStrikethrough, codeUnderline, codeMonospace:
+			found := -1
+			for j, code := range result {
+				if code == text[i] {
+					found = j
+				}
+			}
+
+			if found >= 0 {
+				result = append(result[:found], result[found+1:]...)
+			} else {
+				result = append(result, text[i])
+			}
+		}
+	}
+
+	return result
+}
+
+func closeCodes(open []byte) string {
+	result := make([]byte, len(open))
+	for i, code := range open {
+		result[len(open)-1-i] = code
+	}
+
+	return string(result)
+}
+
+// converter exposes the IRC conversions. Payloads are PRIVMSG texts, one line each.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(strings.Join(convertToIRC(msg), "\n")), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	text, ok := convertToMetachat(string(payload))
+	if !ok {
+		return metachat.Message{}, errors.New("unsupported message")
+	}
+
+	return metachat.Message{Messenger: "IRC", Text: text}, nil
+}
@@ -0,0 +1,96 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+func TestConvertToIRCMarksEveryLine(t *testing.T) {
+	text := "first line\n" + strings.Repeat("word ", 200) + metachat.OriginMarker
+	lines := convertToIRC(metachat.Message{Author: "alice", Text: text})
+	if len(lines) < 3 {
+		t.Fatalf("message is split into %d lines", len(lines))
+	}
+
+	for _, l := range lines {
+		if !strings.HasSuffix(l, metachat.OriginMarker) || strings.Count(l, metachat.OriginMarker) != 1 {
+			t.Errorf("line %q doesn't end with one origin marker", l)
+		}
+
+		if len(l) > maxLineLength {
+			t.Errorf("line %q is %d bytes long", l, len(l))
+		}
+	}
+}
+
+func TestConvertToIRCSplitsLongLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		author string
+		text   string
+	}{
+		{name: "long author", author: strings.Repeat("a", 500), text: "hello world"},
+		{name: "multibyte text", author: "alice", text: strings.Repeat("ж", 1000)},
+		{name: "emoji without spaces", author: strings.Repeat("é", 300), text: strings.Repeat("😀", 300)},
+		{name: "formatting", author: "alice", text: metachat.Bold(metachat.Italic(strings.Repeat("word ", 200)))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := convertToIRC(metachat.Message{Author: test.author, Text: test.text})
+
+			var text strings.Builder
+			for _, l := range lines {
+				if len(l) > maxLineLength {
+					t.Errorf("line %q is %d bytes long", l, len(l))
+				}
+
+				if !utf8.ValidString(l) {
+					t.Errorf("line %q isn't valid UTF-8", l)
+				}
+
+				content, _ := convertToMetachat(l[strings.Index(l, "]\x02 ")+len("]\x02 "):])
+				text.WriteString(metachat.PlainText(content))
+			}
+
+			plain := strings.ReplaceAll(metachat.PlainText(test.text), " ", "")
+			if strings.ReplaceAll(text.String(), " ", "") != plain {
+				t.Errorf("lines %q don't add up to the text", lines)
+			}
+		})
+	}
+}
+
+func TestSplitLinesConsumesText(t *testing.T) {
+	for _, limit := range []int{-10, 0, 1, 3} {
+		lines := splitLines("ab 😀\x02c", limit)
+		if strings.ReplaceAll(strings.Join(lines, ""), "\x02", "") != "ab😀c" {
+			t.Errorf("limit %d: got lines %q", limit, lines)
+		}
+	}
+}
+
+func TestConvertToMetachat(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "plain", want: "plain"},
+		{text: "\x02bold\x02 \x1ditalic\x1d", want: metachat.Bold("bold") + " " + metachat.Italic("italic")},
+		{text: "\x1funderlined\x1f text", want: metachat.Underline("underlined") + " text"},
+		{text: "\x1f\x02both\x0f reset", want: metachat.Bold(metachat.Underline("both")) + " reset"},
+		{text: "\x0304,12red\x03 \x16reversed", want: "red reversed"},
+		{text: "\x01ACTION waves\x01", want: metachat.Italic("waves")},
+		{text: "\x01VERSION\x01"},
+	}
+
+	for _, test := range tests {
+		got, ok := convertToMetachat(test.text)
+		if ok != (test.want != "") || got != test.want {
+			t.Errorf("%q is converted to %q, %v instead of %q", test.text, got, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const (
+	relayHeader    = "X-Metachat-Relay"
+	dialTimeout    = 30 * time.Second
+	idleTimeout    = 25 * time.Minute
+	pollInterval   = time.Minute
+	reconnectDelay = 30 * time.Second
+
+	// maxMessages is the number of recent Message-IDs kept to find the list replies belong to.
+	maxMessages = 1000
+)
+
+type (
+	// Config structure. Chats are mailing list addresses. SMTP uses STARTTLS and IMAP uses implicit TLS
+	// unless PlainText is set. If Digest is set, messages are collected and sent once per the interval.
+	Config struct {
+		ID         string            `json:"-"`
+		SMTPServer string            `json:"smtpServer" required:"true"`
+		IMAPServer string            `json:"imapServer" required:"true"`
+		Username   string            `json:"username"`
+		Password   string            `json:"password"`
+		From       string            `json:"from" required:"true"`
+		Subject    string            `json:"subject"`
+		Mailbox    string            `json:"mailbox"`
+		Lists      []string          `json:"lists"`
+		Digest     metachat.Duration `json:"digest"`
+		PlainText  bool              `json:"plainText"`
+		TLSConfig  *tls.Config       `json:"-"`
+	}
+
+	// Client is a mail client.
+	Client struct {
+		id          string
+		smtpServer  string
+		imapServer  string
+		username    string
+		password    string
+		from        *netmail.Address
+		subject     string
+		mailbox     string
+		digest      time.Duration
+		plainText   bool
+		tlsConfig   *tls.Config
+		messageChan chan metachat.Message
+		lock        sync.Mutex
+		lists       map[string]bool
+		threads     map[string]*thread
+		messages    map[string]string
+		order       []string
+		digests     map[string][]metachat.Message
+		digestLock  sync.Mutex
+		uidValidity uint64
+		uidNext     uint64
+		idCounter   int64
+		quit        chan struct{}
+		stopOnce    sync.Once
+	}
+
+	// thread is the chain of mails sent to a list, so that mail clients display them as one conversation.
+	thread struct {
+		root string
+		last string
+	}
+)
+
+func init() {
+	metachat.Register("mail", newMessenger, Config{})
+	metachat.RegisterConverter("mail", converter{})
+}
+
+// NewClient is a mail client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.SMTPServer == "" || config.IMAPServer == "" || config.From == "" {
+		return nil, errors.New("SMTP server, IMAP server and from address can't be nil")
+	}
+
+	from, err := netmail.ParseAddress(config.From)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	subject := config.Subject
+	if subject == "" {
+		subject = "Metachat"
+	}
+
+	mailbox := config.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+
+	lists := make(map[string]bool)
+	for _, list := range config.Lists {
+		lists[strings.ToLower(list)] = true
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Mail"
+	}
+
+	return &Client{
+		id:          id,
+		smtpServer:  config.SMTPServer,
+		imapServer:  config.IMAPServer,
+		username:    config.Username,
+		password:    config.Password,
+		from:        from,
+		subject:     subject,
+		mailbox:     mailbox,
+		digest:      config.Digest.Duration,
+		plainText:   config.PlainText,
+		tlsConfig:   config.TLSConfig,
+		messageChan: make(chan metachat.Message, 100),
+		lists:       lists,
+		threads:     make(map[string]*thread),
+		messages:    make(map[string]string),
+		digests:     make(map[string][]metachat.Message),
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Start waits for replies in the mailbox and reconnects whenever the connection is lost.
+// It returns if the IMAP server rejects the credentials or once the client is stopped.
+func (c *Client) Start() error {
+	if c.digest > 0 {
+		go c.sendDigests()
+	}
+
+	for {
+		err := c.listen()
+		if _, ok := errors.Cause(err).(*authError); ok {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		select {
+		case <-time.After(reconnectDelay):
+		case <-c.quit:
+			return nil
+		}
+	}
+}
+
+// Stop sends the pending digests. Messages sent afterwards are mailed at once.
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.quit)
+		c.flushDigests()
+	})
+}
+
+// Send sends a message to the mailing list with the provided address or adds it to the next digest.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	c.lock.Lock()
+	c.lists[strings.ToLower(chat)] = true
+	if c.digest > 0 && !c.stopped() {
+		c.digests[chat] = append(c.digests[chat], msg)
+		c.lock.Unlock()
+
+		return nil
+	}
+
+	c.lock.Unlock()
+
+	return c.sendMail(chat, msg.Author, convertToMail(msg))
+}
+
+// CheckCredentials logs in to the SMTP and IMAP servers and selects the mailbox. As the lists are
+// plain addresses, the visibility of the chats is unknown.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	client, err := c.connectSMTP()
+	if err != nil {
+		return nil, err
+	}
+
+	client.Close()
+
+	imap, err := c.connectIMAP()
+	if err != nil {
+		return nil, err
+	}
+
+	defer imap.conn.Close()
+
+	_, err = imap.selectMailbox(c.mailbox)
+
+	return nil, err
+}
+
+// sendDigests sends the digests every digest period until the client is stopped.
+func (c *Client) sendDigests() {
+	ticker := time.NewTicker(c.digest)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flushDigests()
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// flushDigests sends the collected messages to every list as a single mail.
+func (c *Client) flushDigests() {
+	c.digestLock.Lock()
+	defer c.digestLock.Unlock()
+
+	c.lock.Lock()
+	digests := c.digests
+	c.digests = make(map[string][]metachat.Message)
+	c.lock.Unlock()
+
+	for chat, messages := range digests {
+		parts := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			parts = append(parts, fmt.Sprintf("[%s] %s", msg.Author, convertToMail(msg)))
+		}
+
+		err := c.sendMail(chat, "", strings.Join(parts, "\n\n"))
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+}
+
+func (c *Client) stopped() bool {
+	select {
+	case <-c.quit:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// sendMail sends the text to the list as a reply to the previous mail sent there.
+func (c *Client) sendMail(to, author, text string) error {
+	from := *c.from
+	if author != "" {
+		from.Name = author
+	}
+
+	id := c.newMessageID()
+
+	c.lock.Lock()
+	t := c.threads[to]
+	if t == nil {
+		t = &thread{root: id}
+		c.threads[to] = t
+	}
+
+	inReplyTo, references := t.last, t.root
+	if t.last != "" && t.last != t.root {
+		references += " " + t.last
+	}
+
+	t.last = id
+	c.rememberMessage(id, to)
+	c.lock.Unlock()
+
+	var body bytes.Buffer
+	writer := quotedprintable.NewWriter(&body)
+	_, _ = writer.Write([]byte(text))
+	_ = writer.Close()
+
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "From: %s\r\n", from.String())
+	fmt.Fprintf(&data, "To: %s\r\n", to)
+	fmt.Fprintf(&data, "Reply-To: %s\r\n", to)
+	if inReplyTo == "" {
+		fmt.Fprintf(&data, "Subject: %s\r\n", c.subject)
+	} else {
+		fmt.Fprintf(&data, "Subject: Re: %s\r\n", c.subject)
+		fmt.Fprintf(&data, "In-Reply-To: %s\r\n", inReplyTo)
+		fmt.Fprintf(&data, "References: %s\r\n", references)
+	}
+
+	fmt.Fprintf(&data, "Message-ID: %s\r\n", id)
+	fmt.Fprintf(&data, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&data, "%s: yes\r\n", relayHeader)
+	data.WriteString("MIME-Version: 1.0\r\n")
+	data.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	data.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	data.Write(body.Bytes())
+
+	return c.submit(to, data.Bytes())
+}
+
+func (c *Client) submit(to string, data []byte) error {
+	client, err := c.connectSMTP()
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	err = client.Mail(c.from.Address)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = client.Rcpt(to)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = writer.Write(data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(client.Quit())
+}
+
+// connectSMTP returns an SMTP client authenticated on the server.
+func (c *Client) connectSMTP() (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(c.smtpServer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", c.smtpServer, dialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	err = c.startSMTP(client, host)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (c *Client) startSMTP(client *smtp.Client, host string) error {
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err := client.StartTLS(c.newTLSConfig(host))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if !c.plainText {
+		return errors.New("SMTP server doesn't support STARTTLS")
+	}
+
+	if ok, _ := client.Extension("AUTH"); ok && c.username != "" {
+		return errors.WithStack(client.Auth(smtp.PlainAuth("", c.username, c.password, host)))
+	}
+
+	return nil
+}
+
+// connectIMAP returns an IMAP connection logged in on the server.
+func (c *Client) connectIMAP() (*imapConn, error) {
+	var conn net.Conn
+	var err error
+	if c.plainText {
+		conn, err = net.DialTimeout("tcp", c.imapServer, dialTimeout)
+	} else {
+		host, _, _ := net.SplitHostPort(c.imapServer)
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", c.imapServer, c.newTLSConfig(host))
+	}
+
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	imap, err := newIMAPConn(conn)
+	if err == nil {
+		err = imap.login(c.username, c.password)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return imap, nil
+}
+
+func (c *Client) listen() error {
+	imap, err := c.connectIMAP()
+	if err != nil {
+		return err
+	}
+
+	defer imap.conn.Close()
+
+	selected, err := imap.selectMailbox(c.mailbox)
+	if err != nil {
+		return err
+	}
+
+	// Mails that arrived while disconnected are fetched, older ones are ignored. The stored UID means
+	// nothing once the UID validity changes, so only new mails are fetched then.
+	if c.uidNext == 0 || c.uidNext > selected.uidNext || c.uidValidity != selected.uidValidity {
+		c.uidNext = selected.uidNext
+		c.uidValidity = selected.uidValidity
+	}
+
+	for {
+		c.uidNext, err = imap.fetch(c.uidNext, c.handleMail)
+		if err != nil {
+			return err
+		}
+
+		supported, err := imap.idle(idleTimeout)
+		if err != nil {
+			return err
+		}
+
+		if !supported {
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+// handleMail turns a reply to one of the lists into a Metachat message.
+func (c *Client) handleMail(raw []byte) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("%+v", errors.WithStack(err))
+		return
+	}
+
+	if msg.Header.Get(relayHeader) != "" {
+		return
+	}
+
+	from, err := netmail.ParseAddress(msg.Header.Get("From"))
+	if err != nil || strings.EqualFold(from.Address, c.from.Address) {
+		return
+	}
+
+	chat := c.findChat(msg.Header)
+	if chat == "" {
+		return
+	}
+
+	if id := strings.TrimSpace(msg.Header.Get("Message-ID")); id != "" {
+		c.lock.Lock()
+		c.rememberMessage(id, chat)
+		c.lock.Unlock()
+	}
+
+	message, err := readMail(msg, from)
+	if err != nil {
+		log.Printf("%+v", err)
+		return
+	}
+
+	if message.Text == "" {
+		return
+	}
+
+	message.Messenger = c.id
+	message.Chat = chat
+	c.messageChan <- message
+}
+
+// findChat returns the list the mail belongs to, looking up the thread it replies to first
+// and the recipients then.
+func (c *Client) findChat(header netmail.Header) string {
+	references := strings.Fields(header.Get("References"))
+	references = append(references, strings.Fields(header.Get("In-Reply-To"))...)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := len(references) - 1; i >= 0; i-- {
+		if chat, ok := c.messages[references[i]]; ok {
+			return chat
+		}
+	}
+
+	for _, field := range []string{"To", "Cc"} {
+		addresses, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+
+		for _, address := range addresses {
+			if c.lists[strings.ToLower(address.Address)] {
+				return address.Address
+			}
+		}
+	}
+
+	return ""
+}
+
+// rememberMessage records the list of the mail with the provided Message-ID forgetting the oldest
+// mails beyond maxMessages. Replies still find the list by the newer mails of the thread they reference.
+// The lock must be held.
+func (c *Client) rememberMessage(id, chat string) {
+	if _, ok := c.messages[id]; !ok {
+		c.order = append(c.order, id)
+		if len(c.order) > maxMessages {
+			delete(c.messages, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+
+	c.messages[id] = chat
+}
+
+func (c *Client) newMessageID() string {
+	domain := c.from.Address[strings.LastIndex(c.from.Address, "@")+1:]
+
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." +
+		strconv.FormatInt(atomic.AddInt64(&c.idCounter, 1), 10) + ".metachat@" + domain + ">"
+}
+
+func (c *Client) newTLSConfig(host string) *tls.Config {
+	if c.tlsConfig != nil {
+		return c.tlsConfig
+	}
+
+	return &tls.Config{ServerName: host}
+}
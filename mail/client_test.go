@@ -0,0 +1,497 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const testTimeout = 5 * time.Second
+
+// smtpServer is an SMTP stand-in accepting mails with PLAIN authentication and handing them over to the test.
+type smtpServer struct {
+	listener net.Listener
+	mails    chan smtpMail
+}
+
+type smtpMail struct {
+	auth string
+	from string
+	to   string
+	data []byte
+}
+
+// imapServer is an IMAP stand-in serving one mailbox. Mails delivered while a client idles
+// are announced with EXISTS.
+type imapServer struct {
+	sync.Mutex
+	listener    net.Listener
+	mails       [][]byte
+	firstUID    int
+	uidValidity int
+	notify      chan struct{}
+	idling      chan struct{}
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	s := &smtpServer{listener: listen(t), mails: make(chan smtpMail, 10)}
+	go serve(s.listener, s.handle)
+
+	return s
+}
+
+func (s *smtpServer) handle(conn net.Conn, reader *bufio.Reader) {
+	var mail smtpMail
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		command := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, "AUTH PLAIN "))
+			mail.auth = string(credentials)
+			reply("235 2.7.0 Authentication successful")
+
+		case "MAIL":
+			mail.from = strings.TrimSuffix(strings.TrimPrefix(command, "MAIL FROM:<"), ">")
+			reply("250 OK")
+
+		case "RCPT":
+			mail.to = strings.TrimSuffix(strings.TrimPrefix(command, "RCPT TO:<"), ">")
+			reply("250 OK")
+
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var data bytes.Buffer
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+
+			mail.data = data.Bytes()
+			s.mails <- mail
+			reply("250 OK queued")
+
+		case "QUIT":
+			reply("221 Bye")
+			return
+
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// expect waits for the next mail and returns it parsed.
+func (s *smtpServer) expect(t *testing.T) (smtpMail, *netmail.Message) {
+	t.Helper()
+
+	select {
+	case mail := <-s.mails:
+		msg, err := netmail.ReadMessage(bytes.NewReader(mail.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return mail, msg
+
+	case <-time.After(testTimeout):
+		t.Fatal("mail isn't sent")
+		return smtpMail{}, nil
+	}
+}
+
+func newIMAPServer(t *testing.T, firstUID int, mails ...string) *imapServer {
+	s := &imapServer{listener: listen(t), firstUID: firstUID, uidValidity: 1, notify: make(chan struct{}, 1),
+		idling: make(chan struct{}, 1)}
+	for _, mail := range mails {
+		s.mails = append(s.mails, []byte(mail))
+	}
+
+	go serve(s.listener, s.handle)
+
+	return s
+}
+
+// waitIdle waits for a client to start idling.
+func (s *imapServer) waitIdle(t *testing.T) {
+	t.Helper()
+
+	select {
+	case <-s.idling:
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't start idling")
+	}
+}
+
+// deliver adds the mail to the mailbox.
+func (s *imapServer) deliver(mail string) {
+	s.Lock()
+	s.mails = append(s.mails, []byte(strings.Replace(mail, "\n", "\r\n", -1)))
+	s.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *imapServer) handle(conn net.Conn, reader *bufio.Reader) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+
+	fmt.Fprint(conn, "* OK IMAP4rev1 ready\r\n")
+	for line := range lines {
+		parts := strings.SplitN(line, " ", 3)
+		tag, command := parts[0], strings.ToUpper(parts[1])
+
+		switch command {
+		case "LOGIN":
+			if parts[2] != `"bot" "secret"` {
+				fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", tag)
+				continue
+			}
+
+		case "SELECT":
+			s.Lock()
+			fmt.Fprintf(conn, "* %d EXISTS\r\n* OK [UIDVALIDITY %d] UIDs valid\r\n* OK [UIDNEXT %d] Predicted next UID\r\n",
+				len(s.mails), s.uidValidity, s.firstUID+len(s.mails))
+			s.Unlock()
+
+		case "UID":
+			s.fetch(conn, parts[2])
+
+		case "IDLE":
+			fmt.Fprint(conn, "+ idling\r\n")
+
+			select {
+			case s.idling <- struct{}{}:
+			default:
+			}
+
+			select {
+			case <-s.notify:
+				s.Lock()
+				fmt.Fprintf(conn, "* %d EXISTS\r\n", len(s.mails))
+				s.Unlock()
+
+				<-lines
+
+			case <-lines:
+			}
+		}
+
+		fmt.Fprintf(conn, "%s OK %s completed\r\n", tag, command)
+	}
+}
+
+// fetch answers UID FETCH n:* with the mails starting from the UID or the last mail as real servers do.
+func (s *imapServer) fetch(conn net.Conn, arguments string) {
+	from, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(arguments, "FETCH "), ":", 2)[0])
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	first := from - s.firstUID
+	if first >= len(s.mails) {
+		first = len(s.mails) - 1
+	}
+
+	if first < 0 {
+		first = 0
+	}
+
+	for i := first; i < len(s.mails); i++ {
+		fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, s.firstUID+i, len(s.mails[i]), s.mails[i])
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
+
+func serve(listener net.Listener, handle func(net.Conn, *bufio.Reader)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			handle(conn, bufio.NewReader(conn))
+		}()
+	}
+}
+
+func TestSendThreadsMails(t *testing.T) {
+	smtp := newSMTPServer(t)
+	c := newTestClient(t, smtp, newIMAPServer(t, 1))
+
+	err := c.Send(metachat.Message{Author: "Alice", Text: "Hello " + metachat.Bold("world")}, "team@lists.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mail, first := smtp.expect(t)
+	if mail.auth != "\x00bot\x00secret" || mail.from != "bot@example.com" || mail.to != "team@lists.example.com" {
+		t.Errorf("unexpected envelope %+v", mail)
+	}
+
+	expectHeaders(t, first.Header, map[string]string{
+		"From":             `"Alice" <bot@example.com>`,
+		"To":               "team@lists.example.com",
+		"Subject":          "Metachat",
+		"In-Reply-To":      "",
+		"X-Metachat-Relay": "yes",
+	})
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(first.Body))
+	if err != nil || strings.TrimSuffix(string(body), "\r\n") != "Hello *world*" {
+		t.Errorf("body is %q: %v", body, err)
+	}
+
+	for _, text := range []string{"second", "third"} {
+		err = c.Send(metachat.Message{Author: "Bob", Text: text}, "team@lists.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, second := smtp.expect(t)
+	_, third := smtp.expect(t)
+
+	root, last := first.Header.Get("Message-ID"), second.Header.Get("Message-ID")
+	expectHeaders(t, second.Header, map[string]string{"Subject": "Re: Metachat", "In-Reply-To": root,
+		"References": root})
+	expectHeaders(t, third.Header, map[string]string{"In-Reply-To": last, "References": root + " " + last})
+}
+
+func TestListenRelaysReplies(t *testing.T) {
+	smtp := newSMTPServer(t)
+	imap := newIMAPServer(t, 7, "From: old@example.com\r\nTo: team@lists.example.com\r\n\r\nold mail\r\n")
+	c := newTestClient(t, smtp, imap)
+
+	err := c.Send(metachat.Message{Author: "Alice", Text: "question"}, "other@lists.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, sent := smtp.expect(t)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.listen() }()
+
+	imap.waitIdle(t)
+	imap.deliver("From: Bob <bob@example.com>\nTo: bot@example.com\nIn-Reply-To: " + sent.Header.Get("Message-ID") +
+		"\nContent-Type: text/plain\n\n*answer*\n\nOn Mon, Alice wrote:\n> question\n")
+	expectMessage(t, c, metachat.Message{Messenger: "Mail", Chat: "other@lists.example.com", Author: "Bob",
+		AuthorID: "bob@example.com", Text: metachat.Bold("answer")})
+
+	imap.deliver("From: bot@example.com\nTo: team@lists.example.com\n\nown mail\n")
+	imap.deliver("From: Alice <bot@example.com>\nTo: team@lists.example.com\nX-Metachat-Relay: yes\n\nrelayed\n")
+	imap.deliver("From: spam@example.com\nTo: bot@example.com\n\nunrelated\n")
+	imap.deliver("From: carol@example.com\nTo: Team <TEAM@lists.example.com>\nMessage-ID: <c1@example.com>\n\n" +
+		"new thread\n")
+
+	expectMessage(t, c, metachat.Message{Messenger: "Mail", Chat: "TEAM@lists.example.com", Author: "carol",
+		AuthorID: "carol@example.com", Text: "new thread"})
+
+	imap.deliver("From: dave@example.com\nTo: dave@example.com\nReferences: <unknown@example.com> <c1@example.com>\n\n" +
+		"reply\n")
+
+	expectMessage(t, c, metachat.Message{Messenger: "Mail", Chat: "TEAM@lists.example.com", Author: "dave",
+		AuthorID: "dave@example.com", Text: "reply"})
+
+	select {
+	case msg := <-c.MessageChan():
+		t.Errorf("message %+v is relayed", msg)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestListenSkipsMailsOfRecreatedMailbox(t *testing.T) {
+	imap := newIMAPServer(t, 1, "From: old@example.com\r\nTo: team@lists.example.com\r\n\r\nfirst\r\n",
+		"From: old@example.com\r\nTo: team@lists.example.com\r\n\r\nsecond\r\n")
+
+	imap.uidValidity = 2
+	c := newTestClient(t, newSMTPServer(t), imap)
+	c.uidValidity, c.uidNext = 1, 2
+
+	go c.listen()
+
+	imap.waitIdle(t)
+	imap.deliver("From: carol@example.com\nTo: team@lists.example.com\n\nnew\n")
+	expectMessage(t, c, metachat.Message{Messenger: "Mail", Chat: "team@lists.example.com", Author: "carol",
+		AuthorID: "carol@example.com", Text: "new"})
+
+	if c.uidValidity != 2 {
+		t.Errorf("UID validity is %d", c.uidValidity)
+	}
+}
+
+func TestStopSendsDigests(t *testing.T) {
+	smtp := newSMTPServer(t)
+	c := newTestClient(t, smtp, newIMAPServer(t, 1))
+	c.digest = time.Hour
+
+	for _, msg := range []metachat.Message{{Author: "Alice", Text: "one"}, {Author: "Bob", Text: "two"}} {
+		err := c.Send(msg, "team@lists.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Stop()
+
+	_, digest := smtp.expect(t)
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(digest.Body))
+	if want := "[Alice] one\r\n\r\n[Bob] two"; err != nil || strings.TrimSuffix(string(body), "\r\n") != want {
+		t.Errorf("digest is %q: %v", body, err)
+	}
+
+	err = c.Send(metachat.Message{Author: "Carol", Text: "late"}, "team@lists.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, late := smtp.expect(t)
+	expectHeaders(t, late.Header, map[string]string{"From": `"Carol" <bot@example.com>`})
+}
+
+func TestStartRejectsCredentials(t *testing.T) {
+	smtp := newSMTPServer(t)
+	imap := newIMAPServer(t, 1)
+
+	c, err := NewClient(Config{SMTPServer: smtp.listener.Addr().String(), IMAPServer: imap.listener.Addr().String(),
+		Username: "bot", Password: "wrong", From: "bot@example.com", PlainText: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Start() }()
+
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") {
+			t.Errorf("Start returned %v after an authentication failure", err)
+		}
+
+	case <-time.After(testTimeout):
+		t.Error("Start didn't return after an authentication failure")
+	}
+}
+
+func TestRememberMessageForgetsOldMails(t *testing.T) {
+	c, err := NewClient(Config{SMTPServer: "localhost:25", IMAPServer: "localhost:143", From: "bot@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxMessages+10; i++ {
+		c.rememberMessage(fmt.Sprintf("<%d@example.com>", i), "team@lists.example.com")
+	}
+
+	c.rememberMessage("<20@example.com>", "other@lists.example.com")
+
+	if len(c.messages) != maxMessages || len(c.order) != maxMessages {
+		t.Errorf("%d mails are remembered in the order of %d", len(c.messages), len(c.order))
+	}
+
+	if _, ok := c.messages["<9@example.com>"]; ok {
+		t.Error("oldest mail is remembered")
+	}
+
+	if c.messages["<20@example.com>"] != "other@lists.example.com" {
+		t.Error("mail list isn't updated")
+	}
+}
+
+func newTestClient(t *testing.T, smtp *smtpServer, imap *imapServer) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{SMTPServer: smtp.listener.Addr().String(), IMAPServer: imap.listener.Addr().String(),
+		Username: "bot", Password: "secret", From: "bot@example.com", Lists: []string{"team@lists.example.com"},
+		PlainText: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func expectHeaders(t *testing.T, header netmail.Header, want map[string]string) {
+	t.Helper()
+
+	for key, value := range want {
+		if header.Get(key) != value {
+			t.Errorf("%s is %q instead of %q", key, header.Get(key), value)
+		}
+	}
+}
+
+func expectMessage(t *testing.T, c *Client, want metachat.Message) {
+	t.Helper()
+
+	select {
+	case msg := <-c.MessageChan():
+		if msg != want {
+			t.Errorf("got %+v instead of %+v", msg, want)
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatalf("message %+v isn't relayed", want)
+	}
+}
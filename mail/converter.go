@@ -0,0 +1,183 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+var (
+	boldRegexp        = regexp.MustCompile(`\B\*([^*\s](?:[^*\n]*?[^*\s])?)\*\B`)
+	italicRegexp      = regexp.MustCompile(`\b_([^_\s](?:[^_\n]*?[^_\s])?)_\b`)
+	attributionRegexp = regexp.MustCompile(`^(On\b.*\bwrote:|-+\s*Original Message\s*-+|_{20,})$`)
+)
+
+type header interface {
+	Get(key string) string
+}
+
+func convertToMail(msg metachat.Message) string {
+	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, "*${1}*")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~${1}~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "\n\n${1}\n\n")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> ${1}: ${2}\n\n")
+
+	return metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+}
+
+func convertToMetachat(text string) string {
+	content := boldRegexp.ReplaceAllString(text, metachat.Bold("${1}"))
+
+	return italicRegexp.ReplaceAllString(content, metachat.Italic("${1}"))
+}
+
+// readText returns the plain text of the mail body, preferring text/plain parts of multipart
+// mails and falling back to the text of the HTML part.
+func readText(h header, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		html := ""
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return html, nil
+			}
+
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			text, err := readText(part.Header, part)
+			if err != nil {
+				return "", err
+			}
+
+			if partType == "" || partType == "text/plain" || strings.HasPrefix(partType, "multipart/") && text != "" {
+				return text, nil
+			}
+
+			if partType == "text/html" {
+				html = text
+			}
+		}
+	}
+
+	switch mediaType {
+	case "text/plain":
+		content, err := ioutil.ReadAll(body)
+
+		return string(content), errors.WithStack(err)
+
+	case "text/html":
+		doc, err := goquery.NewDocumentFromReader(body)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		doc.Find("blockquote").Remove()
+
+		return doc.Text(), nil
+	}
+
+	return "", nil
+}
+
+// stripReply removes the quoted text, the attribution line and the signature from the reply.
+func stripReply(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	result := make([]string, 0, len(lines))
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || attributionRegexp.MatchString(trimmed) {
+			break
+		}
+
+		// Attribution lines are often wrapped.
+		if i+1 < len(lines) && attributionRegexp.MatchString(trimmed+" "+strings.TrimSpace(lines[i+1])) {
+			break
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+
+		result = append(result, strings.TrimRight(line, " "))
+	}
+
+	return strings.TrimSpace(strings.Join(result, "\n"))
+}
+
+// readMail converts the mail without the quoted text of the previous mails.
+func readMail(msg *netmail.Message, from *netmail.Address) (metachat.Message, error) {
+	text, err := readText(msg.Header, msg.Body)
+	if err != nil {
+		return metachat.Message{}, err
+	}
+
+	author := from.Name
+	if author == "" {
+		author = strings.Split(from.Address, "@")[0]
+	}
+
+	text = stripReply(text)
+	if text != "" {
+		text = convertToMetachat(text)
+	}
+
+	return metachat.Message{Author: author, AuthorID: from.Address, Text: text}, nil
+}
+
+// converter exposes the mail conversions. Outbound payloads are plain text bodies, inbound ones
+// are whole mails.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(convertToMail(msg)), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(payload))
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	from, err := netmail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	message, err := readMail(msg, from)
+	message.Messenger = "Mail"
+
+	return message, err
+}
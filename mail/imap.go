@@ -0,0 +1,273 @@
+package mail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	literalRegexp     = regexp.MustCompile(`\{(\d+)\}$`)
+	uidNextRegexp     = regexp.MustCompile(`\[UIDNEXT (\d+)\]`)
+	uidValidityRegexp = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+	fetchRegexp       = regexp.MustCompile(`^\* \d+ FETCH \(.*\bUID (\d+)`)
+	existsRegexp      = regexp.MustCompile(`^\* \d+ EXISTS`)
+)
+
+type (
+	// imapConn is a minimal IMAP4rev1 client connection supporting the commands needed to
+	// wait for new mail with IDLE and fetch it.
+	imapConn struct {
+		sync.Mutex
+		conn   net.Conn
+		reader *bufio.Reader
+		tag    int
+	}
+
+	// mailboxStatus is the state of a selected mailbox. UIDs are only comparable while UIDValidity stays
+	// the same, a new value means that the mailbox was recreated and its UIDs were assigned anew.
+	mailboxStatus struct {
+		uidValidity uint64
+		uidNext     uint64
+	}
+
+	// imapResponse is a response line with the contents of its literals extracted.
+	imapResponse struct {
+		line     string
+		literals [][]byte
+	}
+
+	// imapError is a NO or BAD status of a tagged response.
+	imapError struct {
+		status string
+	}
+
+	authError struct {
+		reason string
+	}
+)
+
+func newIMAPConn(conn net.Conn) (*imapConn, error) {
+	c := &imapConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	greeting, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		return nil, errors.Errorf("unexpected IMAP greeting '%s'", greeting.line)
+	}
+
+	return c, nil
+}
+
+func (c *imapConn) login(username, password string) error {
+	_, err := c.command("LOGIN %s %s", quote(username), quote(password))
+	if e, ok := err.(*imapError); ok {
+		return &authError{reason: e.status}
+	}
+
+	return err
+}
+
+// selectMailbox selects the mailbox and returns its UID validity and the UID the next message will get.
+func (c *imapConn) selectMailbox(mailbox string) (mailboxStatus, error) {
+	responses, err := c.command("SELECT %s", quote(mailbox))
+	if err != nil {
+		return mailboxStatus{}, errors.WithStack(err)
+	}
+
+	var result mailboxStatus
+	for _, resp := range responses {
+		if m := uidValidityRegexp.FindStringSubmatch(resp.line); m != nil {
+			result.uidValidity, err = strconv.ParseUint(m[1], 10, 64)
+		}
+
+		if m := uidNextRegexp.FindStringSubmatch(resp.line); m != nil {
+			result.uidNext, err = strconv.ParseUint(m[1], 10, 64)
+		}
+
+		if err != nil {
+			return mailboxStatus{}, errors.WithStack(err)
+		}
+	}
+
+	if result.uidNext == 0 {
+		return mailboxStatus{}, errors.New("server didn't report UIDNEXT")
+	}
+
+	return result, nil
+}
+
+// fetch calls handler with the raw content of every message with UID greater or equal to
+// the provided one and returns the UID following the last fetched message.
+func (c *imapConn) fetch(uid uint64, handler func([]byte)) (uint64, error) {
+	responses, err := c.command("UID FETCH %d:* (UID BODY[])", uid)
+	if err != nil {
+		return uid, errors.WithStack(err)
+	}
+
+	next := uid
+	for _, resp := range responses {
+		m := fetchRegexp.FindStringSubmatch(resp.line)
+		if m == nil || len(resp.literals) == 0 {
+			continue
+		}
+
+		current, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil || current < uid {
+			continue
+		}
+
+		handler(resp.literals[0])
+		if current >= next {
+			next = current + 1
+		}
+	}
+
+	return next, nil
+}
+
+// idle waits until the server reports new messages or the timeout expires. It returns false
+// if the server doesn't support IDLE.
+func (c *imapConn) idle(timeout time.Duration) (bool, error) {
+	tag, err := c.send("IDLE")
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.read()
+	if err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(resp.line, tag+" ") {
+		return false, nil
+	}
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			_ = c.write("DONE\r\n")
+		})
+	}
+
+	timer := time.AfterFunc(timeout, done)
+	defer timer.Stop()
+
+	for {
+		resp, err = c.read()
+		if err != nil {
+			return true, err
+		}
+
+		if existsRegexp.MatchString(resp.line) {
+			done()
+		}
+
+		if strings.HasPrefix(resp.line, tag+" ") {
+			return true, status(resp.line[len(tag)+1:])
+		}
+	}
+}
+
+// command sends the command and returns its untagged responses.
+func (c *imapConn) command(format string, args ...interface{}) ([]imapResponse, error) {
+	tag, err := c.send(format, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var untagged []imapResponse
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(resp.line, tag+" ") {
+			return untagged, status(resp.line[len(tag)+1:])
+		}
+
+		untagged = append(untagged, resp)
+	}
+}
+
+func (c *imapConn) send(format string, args ...interface{}) (string, error) {
+	c.Lock()
+	c.tag++
+	tag := "m" + strconv.Itoa(c.tag)
+	c.Unlock()
+
+	return tag, c.write(tag + " " + fmt.Sprintf(format, args...) + "\r\n")
+}
+
+func (c *imapConn) write(data string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	_, err := c.conn.Write([]byte(data))
+
+	return errors.WithStack(err)
+}
+
+// read reads a response line together with the literals it contains.
+func (c *imapConn) read() (imapResponse, error) {
+	var resp imapResponse
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return resp, errors.WithStack(err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		resp.line += line
+
+		m := literalRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return resp, nil
+		}
+
+		size, err := strconv.Atoi(m[1])
+		if err != nil {
+			return resp, errors.WithStack(err)
+		}
+
+		literal := make([]byte, size)
+		_, err = io.ReadFull(c.reader, literal)
+		if err != nil {
+			return resp, errors.WithStack(err)
+		}
+
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+func (e *imapError) Error() string {
+	return "IMAP command failed: " + e.status
+}
+
+func (e *authError) Error() string {
+	return "IMAP authentication failed: " + e.reason
+}
+
+func status(text string) error {
+	if strings.HasPrefix(text, "OK") {
+		return nil
+	}
+
+	return &imapError{status: text}
+}
+
+func quote(text string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+}
@@ -1,73 +1,160 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/config"
 	"github.com/thehadalone/metachat/metachat"
-	"github.com/thehadalone/metachat/skype"
-	"github.com/thehadalone/metachat/slack"
-	"github.com/thehadalone/metachat/telegram"
+
+	// Messenger packages register their types in metachat.
+	_ "github.com/thehadalone/metachat/discord"
+	_ "github.com/thehadalone/metachat/irc"
+	_ "github.com/thehadalone/metachat/mail"
+	_ "github.com/thehadalone/metachat/matrix"
+	_ "github.com/thehadalone/metachat/mattermost"
+	_ "github.com/thehadalone/metachat/rocketchat"
+	_ "github.com/thehadalone/metachat/skype"
+	_ "github.com/thehadalone/metachat/slack"
+	_ "github.com/thehadalone/metachat/telegram"
+	_ "github.com/thehadalone/metachat/webhook"
+	_ "github.com/thehadalone/metachat/xmpp"
 )
 
-type config struct {
-	metachat.Config
-	Skype    skype.Config    `json:"skype"`
-	Slack    slack.Config    `json:"slack"`
-	Telegram telegram.Config `json:"telegram"`
-}
+const usage = `Usage: metachat [command] <config>
+
+Commands:
+  run                 start the bridge (default)
+  validate            check the configuration offline
+  check-credentials   log in to the messengers and check the chats the bots can see
+`
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Config file must be provided")
-		os.Exit(1)
+	os.Exit(execute(os.Args[1:]))
+}
+
+// execute runs the command line and returns the exit code.
+func execute(args []string) int {
+	command := "run"
+	if len(args) == 2 {
+		command, args = args[0], args[1:]
 	}
 
-	configPath := os.Args[1]
-	content, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+	if len(args) != 1 {
+		fmt.Print(usage)
+		return 1
 	}
 
-	var config config
-	err = json.Unmarshal(content, &config)
+	conf, err := config.Load(args[0])
 	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+		fmt.Printf("%+v\n", err)
+		return 1
 	}
 
-	skypeClient, err := skype.NewClient(config.Skype)
-	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+	if conf.RoomsFile != "" {
+		conf.Config.RoomStore = metachat.NewFileRoomStore(conf.RoomsFile)
 	}
 
-	slackClient, err := slack.NewClient(config.Slack)
-	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+	if conf.IdentitiesFile != "" {
+		conf.Config.IdentityStore = metachat.NewFileIdentityStore(conf.IdentitiesFile)
+	}
+
+	switch command {
+	case "run":
+		err = run(conf.Config)
+
+	case "validate":
+		err = metachat.Validate(conf.Config)
+		if err == nil {
+			fmt.Println("Configuration is valid")
+		}
+
+	case "check-credentials":
+		err = checkCredentials(conf.Config)
+
+	default:
+		fmt.Print(usage)
+		return 1
 	}
 
-	telegramClient, err := telegram.NewClient(config.Telegram)
 	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+		fmt.Printf("%+v\n", err)
+		return 1
 	}
 
-	config.Config.Messengers = []metachat.Messenger{skypeClient, slackClient, telegramClient}
+	return 0
+}
 
-	meta, err := metachat.New(config.Config)
+func run(conf metachat.Config) error {
+	meta, err := metachat.New(conf)
 	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+		return err
 	}
 
-	err = meta.Start()
+	// Stopping sends the messages held back, like the open coalescing bursts and mail digests.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+
+		err := meta.Stop()
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+		}
+	}()
+
+	return meta.Start()
+}
+
+func checkCredentials(conf metachat.Config) error {
+	reports, err := metachat.CheckCredentials(conf)
 	if err != nil {
-		fmt.Printf("%+v", err)
-		os.Exit(1)
+		return err
+	}
+
+	failed := 0
+	for _, report := range reports {
+		switch {
+		case !report.Supported:
+			fmt.Printf("%s: credentials check is not supported\n", report.Messenger)
+			continue
+
+		case report.Err != nil:
+			failed++
+			fmt.Printf("%s: FAILED: %v\n", report.Messenger, report.Err)
+			continue
+
+		case report.Chats == nil:
+			fmt.Printf("%s: OK, chat visibility is unknown\n", report.Messenger)
+			continue
+		}
+
+		fmt.Printf("%s: OK\n", report.Messenger)
+
+		chats := make([]string, 0, len(report.Chats))
+		for chat := range report.Chats {
+			chats = append(chats, chat)
+		}
+
+		sort.Strings(chats)
+
+		for _, chat := range chats {
+			if report.Chats[chat] {
+				fmt.Printf("  %s: visible\n", chat)
+			} else {
+				failed++
+				fmt.Printf("  %s: NOT visible\n", chat)
+			}
+		}
 	}
+
+	if failed > 0 {
+		return errors.Errorf("%d credentials check(s) failed", failed)
+	}
+
+	return nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metachat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		args    []string
+		content string
+		code    int
+	}{
+		{name: "valid", args: []string{"validate"}, content: "port: 8080\n", code: 0},
+		{name: "unknown messenger", args: []string{"validate"},
+			content: "port: 8080\nrooms:\n  - name: team\n    chats:\n      - {messenger: ghost, id: '1'}\n", code: 1},
+		{name: "schema error", args: []string{"validate"}, content: "port: 8080\ncolour: red\n", code: 1},
+		{name: "unknown command", args: []string{"launch"}, content: "port: 8080\n", code: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "metachat.yaml")
+			err := ioutil.WriteFile(path, []byte(test.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if code := execute(append(test.args, path)); code != test.code {
+				t.Errorf("got exit code %d instead of %d", code, test.code)
+			}
+		})
+	}
+
+	if code := execute(nil); code != 1 {
+		t.Errorf("got exit code %d without arguments", code)
+	}
+}
@@ -0,0 +1,604 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const maxTransactions = 100
+
+type (
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// Config structure. The tokens, sender localpart and user prefix must match the application service
+	// registration file installed on the homeserver, whose namespace has to cover all users starting
+	// with the prefix.
+	Config struct {
+		ID              string     `json:"-"`
+		HomeserverURL   string     `json:"homeserverURL" required:"true"`
+		Domain          string     `json:"domain" required:"true"`
+		ASToken         string     `json:"asToken" required:"true"`
+		HSToken         string     `json:"hsToken" required:"true"`
+		SenderLocalpart string     `json:"senderLocalpart" required:"true"`
+		UserPrefix      string     `json:"userPrefix" required:"true"`
+		HTTPClient      httpClient `json:"-"`
+	}
+
+	// Client is a Matrix application service client.
+	Client struct {
+		id            string
+		httpClient    httpClient
+		homeserverURL string
+		domain        string
+		asToken       string
+		hsToken       string
+		botID         string
+		userPrefix    string
+		messageChan   chan metachat.Message
+		txnCounter    int64
+		transactions  *transactionLog
+		puppets       *puppetCache
+		names         *nameCache
+	}
+
+	transaction struct {
+		Events []event `json:"events"`
+	}
+
+	event struct {
+		Type    string       `json:"type"`
+		EventID string       `json:"event_id"`
+		RoomID  string       `json:"room_id"`
+		Sender  string       `json:"sender"`
+		Content eventContent `json:"content"`
+	}
+
+	eventContent struct {
+		MsgType       string        `json:"msgtype,omitempty"`
+		Body          string        `json:"body"`
+		Format        string        `json:"format,omitempty"`
+		FormattedBody string        `json:"formatted_body,omitempty"`
+		NewContent    *eventContent `json:"m.new_content,omitempty"`
+		RelatesTo     *relatesTo    `json:"m.relates_to,omitempty"`
+	}
+
+	relatesTo struct {
+		RelType   string     `json:"rel_type,omitempty"`
+		EventID   string     `json:"event_id,omitempty"`
+		InReplyTo *inReplyTo `json:"m.in_reply_to,omitempty"`
+	}
+
+	inReplyTo struct {
+		EventID string `json:"event_id"`
+	}
+
+	errorResponse struct {
+		ErrCode      string `json:"errcode"`
+		Error        string `json:"error"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+
+	joinedRooms struct {
+		JoinedRooms []string `json:"joined_rooms"`
+	}
+
+	// transactionLog remembers the latest transaction IDs as the homeserver retries
+	// transactions it didn't get a response for.
+	transactionLog struct {
+		sync.Mutex
+		ids   map[string]bool
+		order []string
+	}
+
+	// puppetCache remembers the display names of registered virtual users and the rooms they joined.
+	puppetCache struct {
+		sync.Mutex
+		registered map[string]string
+		joined     map[string]bool
+	}
+
+	nameCache struct {
+		sync.RWMutex
+		names map[string]string
+	}
+
+	apiError struct {
+		status  string
+		errResp errorResponse
+	}
+)
+
+func init() {
+	metachat.Register("matrix", newMessenger, Config{})
+	metachat.RegisterConverter("matrix", converter{})
+}
+
+// NewClient is a Matrix client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.HomeserverURL == "" || config.Domain == "" || config.ASToken == "" || config.HSToken == "" ||
+		config.SenderLocalpart == "" || config.UserPrefix == "" {
+
+		return nil, errors.New("homeserver URL, domain, tokens, sender localpart and user prefix can't be nil")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Matrix"
+	}
+
+	return &Client{
+		id:            id,
+		httpClient:    httpClient,
+		homeserverURL: strings.TrimSuffix(config.HomeserverURL, "/"),
+		domain:        config.Domain,
+		asToken:       config.ASToken,
+		hsToken:       config.HSToken,
+		botID:         userID(config.SenderLocalpart, config.Domain),
+		userPrefix:    config.UserPrefix,
+		messageChan:   make(chan metachat.Message, 100),
+		transactions:  &transactionLog{ids: make(map[string]bool)},
+		puppets:       &puppetCache{registered: make(map[string]string), joined: make(map[string]bool)},
+		names:         &nameCache{names: make(map[string]string)},
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Start starts the client main loop.
+func (c *Client) Start() error {
+	return nil
+}
+
+// Webhook returns HTTP handler for application service API requests from the homeserver.
+func (c *Client) Webhook() http.Handler {
+	r := chi.NewRouter()
+	r.Use(c.authenticate)
+	r.Put("/_matrix/app/v1/transactions/{txnID}", c.handleTransaction)
+	r.Put("/transactions/{txnID}", c.handleTransaction)
+	r.Get("/_matrix/app/v1/users/{userID}", c.handleUserQuery)
+	r.Get("/users/{userID}", c.handleUserQuery)
+	r.Get("/_matrix/app/v1/rooms/{alias}", c.handleRoomQuery)
+	r.Get("/rooms/{alias}", c.handleRoomQuery)
+
+	return r
+}
+
+// Send sends a message to the room with the provided ID.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to the room with the provided ID on behalf of a virtual user
+// representing the message author and returns the event ID.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
+	sender, err := c.prepareSender(msg, chat)
+	if err != nil {
+		return "", err
+	}
+
+	return c.sendEvent(chat, sender, convertToMatrix(msg))
+}
+
+// Edit replaces the content of the event with the provided ID.
+func (c *Client) Edit(msg metachat.Message, chat, id string) error {
+	sender, err := c.prepareSender(msg, chat)
+	if err != nil {
+		return err
+	}
+
+	content := convertToMatrix(msg)
+	edit := content
+	edit.Body = "* " + content.Body
+	if edit.FormattedBody != "" {
+		edit.FormattedBody = "* " + content.FormattedBody
+	}
+
+	edit.NewContent = &content
+	edit.RelatesTo = &relatesTo{RelType: "m.replace", EventID: id}
+
+	_, err = c.sendEvent(chat, sender, edit)
+
+	return err
+}
+
+// CheckCredentials verifies the application service token and reports the rooms the bot has joined.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	err := c.do(http.MethodGet, "/_matrix/client/v3/account/whoami", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var joined joinedRooms
+	err = c.do(http.MethodGet, "/_matrix/client/v3/joined_rooms", "", nil, &joined)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		visible[chat] = false
+	}
+
+	for _, room := range joined.JoinedRooms {
+		if _, ok := visible[room]; ok {
+			visible[room] = true
+		}
+	}
+
+	return visible, nil
+}
+
+func (c *Client) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("access_token")
+		}
+
+		if token != c.hsToken {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, render.M{"errcode": "M_FORBIDDEN"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Client) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	txnID := chi.URLParam(r, "txnID")
+	if c.transactions.seen(txnID) {
+		render.JSON(w, r, render.M{})
+		return
+	}
+
+	var txn transaction
+	err := json.NewDecoder(r.Body).Decode(&txn)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"errcode": "M_NOT_JSON", "error": err.Error()})
+		return
+	}
+
+	for _, e := range txn.Events {
+		if e.Type != "m.room.message" || c.isOwn(e.Sender) {
+			continue
+		}
+
+		message, ok := c.convertToMetachat(e)
+		if ok {
+			c.messageChan <- message
+		}
+	}
+
+	c.transactions.add(txnID)
+	render.JSON(w, r, render.M{})
+}
+
+func (c *Client) handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !c.isOwn(chi.URLParam(r, "userID")) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{"errcode": "M_NOT_FOUND"})
+		return
+	}
+
+	render.JSON(w, r, render.M{})
+}
+
+func (c *Client) handleRoomQuery(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusNotFound)
+	render.JSON(w, r, render.M{"errcode": "M_NOT_FOUND"})
+}
+
+// isOwn reports whether the user is the bot or one of the virtual users of the application service.
+func (c *Client) isOwn(user string) bool {
+	return user == c.botID || strings.HasPrefix(user, "@"+c.userPrefix) && strings.HasSuffix(user, ":"+c.domain)
+}
+
+// prepareSender returns the virtual user for the message author, registering it, setting its
+// display name and joining it to the room if it wasn't done before. The display name is updated
+// when the author is renamed.
+func (c *Client) prepareSender(msg metachat.Message, room string) (string, error) {
+	if msg.Author == "" {
+		return c.botID, nil
+	}
+
+	localpart := c.puppetLocalpart(msg)
+	puppet := userID(localpart, c.domain)
+
+	name, registered := c.puppets.name(puppet)
+	if !registered {
+		err := c.do(http.MethodPost, "/_matrix/client/v3/register", "",
+			map[string]string{"type": "m.login.application_service", "username": localpart}, nil)
+
+		if err != nil && !isErrCode(err, "M_USER_IN_USE") {
+			return "", err
+		}
+	}
+
+	if !registered || name != msg.Author {
+		err := c.do(http.MethodPut, "/_matrix/client/v3/profile/"+url.PathEscape(puppet)+"/displayname", puppet,
+			map[string]string{"displayname": msg.Author}, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		c.puppets.setRegistered(puppet, msg.Author)
+	}
+
+	if !c.puppets.isJoined(puppet, room) {
+		err := c.do(http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/invite", c.botID,
+			map[string]string{"user_id": puppet}, nil)
+
+		if err != nil && !isErrCode(err, "M_FORBIDDEN") {
+			return "", err
+		}
+
+		err = c.do(http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/join", puppet,
+			map[string]string{}, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		c.puppets.setJoined(puppet, room)
+	}
+
+	return puppet, nil
+}
+
+// puppetLocalpart returns the localpart of the virtual user for the message author. Authors are told
+// apart by their account IDs, so that namesakes get different virtual users and renamed authors keep theirs.
+// Authors without IDs get a virtual user per name.
+func (c *Client) puppetLocalpart(msg metachat.Message) string {
+	if msg.AuthorID != "" {
+		return c.userPrefix + escapeLocalpart(strings.ToLower(msg.Messenger)+"/"+msg.AuthorID)
+	}
+
+	return c.userPrefix + escapeLocalpart(strings.ToLower(msg.Messenger)+"_"+msg.Author)
+}
+
+func (c *Client) sendEvent(room, sender string, content eventContent) (string, error) {
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.FormatInt(atomic.AddInt64(&c.txnCounter, 1), 10)
+
+	var result struct {
+		EventID string `json:"event_id"`
+	}
+
+	err := c.do(http.MethodPut, fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		url.PathEscape(room), txnID), sender, content, &result)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.EventID, nil
+}
+
+// displayName returns the display name of the user, falling back to the user ID.
+func (c *Client) displayName(user string) string {
+	if name, ok := c.names.get(user); ok {
+		return name
+	}
+
+	var profile struct {
+		DisplayName string `json:"displayname"`
+	}
+
+	err := c.do(http.MethodGet, "/_matrix/client/v3/profile/"+url.PathEscape(user)+"/displayname", "", nil,
+		&profile)
+
+	if err != nil || profile.DisplayName == "" {
+		return user
+	}
+
+	c.names.put(user, profile.DisplayName)
+
+	return profile.DisplayName
+}
+
+// do performs a homeserver request authenticated with the application service token,
+// acting as the provided user if it's set.
+func (c *Client) do(method, path, user string, payload, result interface{}) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	target := c.homeserverURL + path
+	if user != "" {
+		target += "?user_id=" + url.QueryEscape(user)
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return &metachat.RetryAfterError{Duration: time.Duration(errResp.RetryAfterMs) * time.Millisecond}
+		}
+
+		return &apiError{status: resp.Status, errResp: errResp}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
+
+func (t *transactionLog) seen(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.ids[id]
+}
+
+func (t *transactionLog) add(id string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.ids[id] = true
+	t.order = append(t.order, id)
+	if len(t.order) > maxTransactions {
+		delete(t.ids, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// name returns the display name of the virtual user and whether it's registered.
+func (p *puppetCache) name(user string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	name, ok := p.registered[user]
+
+	return name, ok
+}
+
+func (p *puppetCache) setRegistered(user, name string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.registered[user] = name
+}
+
+func (p *puppetCache) isJoined(user, room string) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.joined[user+" "+room]
+}
+
+func (p *puppetCache) setJoined(user, room string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.joined[user+" "+room] = true
+}
+
+func (m *nameCache) get(key string) (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	val, ok := m.names[key]
+
+	return val, ok
+}
+
+func (m *nameCache) put(key, value string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.names[key] = value
+}
+
+func userID(localpart, domain string) string {
+	return "@" + localpart + ":" + domain
+}
+
+// escapeLocalpart maps the name to the characters allowed in Matrix user IDs
+// using the encoding recommended by the specification.
+func escapeLocalpart(name string) string {
+	var result strings.Builder
+	for _, b := range []byte(name) {
+		switch {
+		case b >= 'A' && b <= 'Z':
+			result.WriteByte('_')
+			result.WriteByte(b - 'A' + 'a')
+
+		case b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '.', b == '-', b == '/':
+			result.WriteByte(b)
+
+		case b == '_':
+			result.WriteString("__")
+
+		default:
+			fmt.Fprintf(&result, "=%02x", b)
+		}
+	}
+
+	return result.String()
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("got %s: %s %s", e.status, e.errResp.ErrCode, e.errResp.Error)
+}
+
+func isErrCode(err error, code string) bool {
+	apiErr, ok := err.(*apiError)
+
+	return ok && apiErr.errResp.ErrCode == code
+}
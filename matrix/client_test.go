@@ -0,0 +1,259 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+type (
+	// stubHomeserver records the client-server API requests of the application service.
+	stubHomeserver struct {
+		sync.Mutex
+		server    *httptest.Server
+		requests  []stubRequest
+		rateLimit bool
+	}
+
+	stubRequest struct {
+		Method string
+		Path   string
+		User   string
+		Body   map[string]interface{}
+	}
+)
+
+func newStubHomeserver(t *testing.T) *stubHomeserver {
+	s := &stubHomeserver{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer as-token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errorResponse{ErrCode: "M_FORBIDDEN"})
+			return
+		}
+
+		req := stubRequest{Method: r.Method, Path: r.URL.EscapedPath(), User: r.URL.Query().Get("user_id")}
+		json.NewDecoder(r.Body).Decode(&req.Body)
+
+		s.Lock()
+		s.requests = append(s.requests, req)
+		rateLimit := s.rateLimit
+		s.rateLimit = false
+		s.Unlock()
+
+		switch {
+		case rateLimit:
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(errorResponse{ErrCode: "M_LIMIT_EXCEEDED", RetryAfterMs: 300})
+
+		case strings.Contains(req.Path, "/send/"):
+			json.NewEncoder(w).Encode(map[string]string{"event_id": "$sent"})
+
+		case req.Method == http.MethodGet && strings.HasSuffix(req.Path, "/displayname"):
+			json.NewEncoder(w).Encode(map[string]string{"displayname": "Bob"})
+
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// take returns the requests recorded so far and forgets them.
+func (s *stubHomeserver) take() []stubRequest {
+	s.Lock()
+	defer s.Unlock()
+
+	requests := s.requests
+	s.requests = nil
+
+	return requests
+}
+
+func TestSendPuppets(t *testing.T) {
+	hs := newStubHomeserver(t)
+	c := newTestClient(t, hs.server.URL)
+
+	send := func(msg metachat.Message) string {
+		t.Helper()
+
+		if err := c.Send(msg, "!room:example.org"); err != nil {
+			t.Fatal(err)
+		}
+
+		requests := hs.take()
+		last := requests[len(requests)-1]
+		if !strings.Contains(last.Path, "/send/m.room.message/") {
+			t.Fatalf("last request %+v isn't a message", last)
+		}
+
+		return last.User
+	}
+
+	alice := send(metachat.Message{Messenger: "Slack", Author: "Alice", AuthorID: "U1", Text: "hi"})
+	namesake := send(metachat.Message{Messenger: "Slack", Author: "Alice", AuthorID: "U2", Text: "hi"})
+	if alice == namesake {
+		t.Errorf("namesakes share the virtual user %s", alice)
+	}
+
+	if alice != "@bridge_slack/_u1:example.org" {
+		t.Errorf("unexpected virtual user %s", alice)
+	}
+
+	err := c.Send(metachat.Message{Messenger: "Slack", Author: "Alice Smith", AuthorID: "U1", Text: "hi"},
+		"!room:example.org")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := hs.take()
+	if len(requests) != 2 || requests[0].Method != http.MethodPut || requests[0].User != alice ||
+		requests[0].Body["displayname"] != "Alice Smith" || requests[1].User != alice {
+
+		t.Errorf("renamed author isn't sent as the same virtual user: %+v", requests)
+	}
+
+	bob := send(metachat.Message{Messenger: "IRC", Author: "bob", Text: "hi"})
+	if bob != "@bridge_irc__bob:example.org" {
+		t.Errorf("author without ID is sent as %s", bob)
+	}
+
+	if system := send(metachat.Message{Messenger: "IRC", Text: "topic changed"}); system != "@bot:example.org" {
+		t.Errorf("system message is sent as %s", system)
+	}
+}
+
+func TestSendRegistersAndJoinsOnce(t *testing.T) {
+	hs := newStubHomeserver(t)
+	c := newTestClient(t, hs.server.URL)
+	msg := metachat.Message{Messenger: "Slack", Author: "Alice", AuthorID: "U1", Text: metachat.Bold("hi")}
+
+	if err := c.Send(msg, "!room:example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, req := range hs.take() {
+		paths = append(paths, req.Method+" "+req.Path)
+	}
+
+	expected := []string{
+		"POST /_matrix/client/v3/register",
+		"PUT /_matrix/client/v3/profile/@bridge_slack%2F_u1:example.org/displayname",
+		"POST /_matrix/client/v3/rooms/%21room:example.org/invite",
+		"POST /_matrix/client/v3/rooms/%21room:example.org/join",
+	}
+
+	if len(paths) != len(expected)+1 || strings.Join(paths[:len(expected)], "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected requests:\n%s", strings.Join(paths, "\n"))
+	}
+
+	id, err := c.SendEditable(msg, "!room:example.org")
+	if err != nil || id != "$sent" {
+		t.Fatalf("got event ID %q: %v", id, err)
+	}
+
+	requests := hs.take()
+	if len(requests) != 1 || requests[0].Body["formatted_body"] != "<strong>hi</strong>" {
+		t.Errorf("known virtual user is set up again: %+v", requests)
+	}
+
+	if err := c.Edit(msg, "!room:example.org", id); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := hs.take()[0].Body
+	relation, _ := edit["m.relates_to"].(map[string]interface{})
+	if relation["rel_type"] != "m.replace" || relation["event_id"] != "$sent" || edit["m.new_content"] == nil {
+		t.Errorf("unexpected edit %+v", edit)
+	}
+
+	hs.Lock()
+	hs.rateLimit = true
+	hs.Unlock()
+
+	err = c.Send(msg, "!room:example.org")
+	if retry, ok := errors.Cause(err).(*metachat.RetryAfterError); !ok || retry.Duration != 300*time.Millisecond {
+		t.Errorf("got %v instead of a retry after 300ms", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	hs := newStubHomeserver(t)
+	c := newTestClient(t, hs.server.URL)
+	handler := c.Webhook()
+
+	put := func(path, token, body string) int {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	body := `{"events":[
+		{"type":"m.room.message","room_id":"!room:example.org","sender":"@bob:example.org",
+			"content":{"msgtype":"m.text","body":"hi","format":"org.matrix.custom.html",
+				"formatted_body":"<b>hi</b>"}},
+		{"type":"m.room.message","room_id":"!room:example.org","sender":"@bridge_slack_alice:example.org",
+			"content":{"msgtype":"m.text","body":"echo"}},
+		{"type":"m.room.message","room_id":"!room:example.org","sender":"@bot:example.org",
+			"content":{"msgtype":"m.notice","body":"echo"}},
+		{"type":"m.room.member","room_id":"!room:example.org","sender":"@bob:example.org",
+			"content":{"membership":"join"}}
+	]}`
+
+	if code := put("/_matrix/app/v1/transactions/1", "wrong", body); code != http.StatusForbidden {
+		t.Errorf("got status %d for a wrong token", code)
+	}
+
+	if code := put("/_matrix/app/v1/transactions/1", "hs-token", body); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+
+	if code := put("/_matrix/app/v1/transactions/1", "hs-token", body); code != http.StatusOK {
+		t.Fatalf("got status %d for a retried transaction", code)
+	}
+
+	msg := <-c.MessageChan()
+	expected := metachat.Message{Messenger: "matrix", Chat: "!room:example.org", Author: "Bob",
+		AuthorID: "@bob:example.org",
+		Text:     metachat.Bold("hi")}
+
+	if msg != expected {
+		t.Errorf("got %+v instead of %+v", msg, expected)
+	}
+
+	select {
+	case msg := <-c.MessageChan():
+		t.Errorf("unexpected message %+v", msg)
+
+	default:
+	}
+}
+
+func newTestClient(t *testing.T, url string) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{ID: "matrix", HomeserverURL: url, Domain: "example.org", ASToken: "as-token",
+		HSToken: "hs-token", SenderLocalpart: "bot", UserPrefix: "bridge_"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
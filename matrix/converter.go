@@ -0,0 +1,214 @@
+package matrix
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const htmlFormat = "org.matrix.custom.html"
+
+var (
+	replyRegexp         = regexp.MustCompile(`(?s)<mx-reply>.*?</mx-reply>`)
+	replyAuthorRegexp   = regexp.MustCompile(`(?s)<mx-reply>.*?<a\b[^>]*href="https://matrix.to/#/(@[^"]+)"`)
+	replyTextRegexp     = regexp.MustCompile(`(?s)<mx-reply>.*?<br\s*/?>(.*?)</blockquote>`)
+	plainReplyRegexp    = regexp.MustCompile(`(?m)\A(?:^> .*\n)+\n?`)
+	boldRegexp          = regexp.MustCompile(`(?s)<(?:b|strong)\b[^>]*>(.*?)</(?:b|strong)>`)
+	italicRegexp        = regexp.MustCompile(`(?s)<(?:i|em)\b[^>]*>(.*?)</(?:i|em)>`)
+	strikethroughRegexp = regexp.MustCompile(`(?s)<(?:del|s|strike)\b[^>]*>(.*?)</(?:del|s|strike)>`)
+	preformattedRegexp  = regexp.MustCompile(`(?s)<pre\b[^>]*>(?:<code\b[^>]*>)?(.*?)(?:</code>)?</pre>`)
+	codeRegexp          = regexp.MustCompile(`(?s)<code\b[^>]*>(.*?)</code>`)
+	mentionRegexp       = regexp.MustCompile(`<a\b[^>]*href="https://matrix.to/#/@[^"]*"[^>]*>(.*?)</a>`)
+	linkRegexp          = regexp.MustCompile(`<a\b[^>]*href="(.*?)"[^>]*>.*?</a>`)
+	lineBreakRegexp     = regexp.MustCompile(`(?:<br\s*/?>|</p>)\n?`)
+	tagRegexp           = regexp.MustCompile(`<[^>]+>`)
+)
+
+func (c *Client) convertToMetachat(e event) (metachat.Message, bool) {
+	content := e.Content
+	edit := content.RelatesTo != nil && content.RelatesTo.RelType == "m.replace" && content.NewContent != nil
+	if edit {
+		content = *content.NewContent
+	}
+
+	switch content.MsgType {
+	case "m.text", "m.notice", "m.emote":
+	default:
+		return metachat.Message{}, false
+	}
+
+	text := formatText(content)
+	if content.MsgType == "m.emote" {
+		text = metachat.Italic(text)
+	}
+
+	if quote, ok := c.quote(e); ok {
+		text = quote + " " + text
+	}
+
+	if edit {
+		text = metachat.Edit(text)
+	}
+
+	return metachat.Message{
+		Messenger: c.id,
+		Chat:      e.RoomID,
+		Author:    c.displayName(e.Sender),
+		AuthorID:  e.Sender,
+		Text:      text,
+	}, true
+}
+
+// quote returns the message the event replies to as a quote, taking it from the reply fallback
+// or fetching the original event if there is no fallback.
+func (c *Client) quote(e event) (string, bool) {
+	if e.Content.RelatesTo == nil || e.Content.RelatesTo.InReplyTo == nil {
+		return "", false
+	}
+
+	authorGroups := replyAuthorRegexp.FindStringSubmatch(e.Content.FormattedBody)
+	textGroups := replyTextRegexp.FindStringSubmatch(e.Content.FormattedBody)
+	if authorGroups != nil && textGroups != nil {
+		text := formatText(eventContent{Format: htmlFormat, FormattedBody: textGroups[1]})
+		return metachat.Quote(text, c.displayName(authorGroups[1])), true
+	}
+
+	var original event
+	err := c.do(http.MethodGet, "/_matrix/client/v3/rooms/"+url.PathEscape(e.RoomID)+"/event/"+
+		url.PathEscape(e.Content.RelatesTo.InReplyTo.EventID), "", nil, &original)
+
+	if err != nil {
+		return "", false
+	}
+
+	return metachat.Quote(formatText(original.Content), c.displayName(original.Sender)), true
+}
+
+func convertToMatrix(msg metachat.Message) eventContent {
+	msgType := "m.text"
+	if msg.Author == "" {
+		msgType = "m.notice"
+	}
+
+	return eventContent{
+		MsgType:       msgType,
+		Body:          plainText(msg.Text),
+		Format:        htmlFormat,
+		FormattedBody: htmlText(msg.Text),
+	}
+}
+
+func formatText(content eventContent) string {
+	if content.Format != htmlFormat || content.FormattedBody == "" {
+		return plainReplyRegexp.ReplaceAllString(content.Body, "")
+	}
+
+	text := replyRegexp.ReplaceAllString(content.FormattedBody, "")
+	text = preformattedRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		code := preformattedRegexp.FindStringSubmatch(match)[1]
+		return metachat.Preformatted(lineBreakRegexp.ReplaceAllString(code, "\n"))
+	})
+
+	text = codeRegexp.ReplaceAllString(text, metachat.Preformatted("${1}"))
+	text = boldRegexp.ReplaceAllString(text, metachat.Bold("${1}"))
+	text = italicRegexp.ReplaceAllString(text, metachat.Italic("${1}"))
+	text = strikethroughRegexp.ReplaceAllString(text, metachat.Strikethrough("${1}"))
+	text = mentionRegexp.ReplaceAllString(text, metachat.Mention("${1}"))
+	text = linkRegexp.ReplaceAllString(text, "${1}")
+	text = lineBreakRegexp.ReplaceAllString(text, "\n")
+	text = tagRegexp.ReplaceAllString(text, "")
+
+	return strings.TrimSpace(html.UnescapeString(text))
+}
+
+func plainText(text string) string {
+	content := metachat.BoldRegexp.ReplaceAllString(text, "${1}")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> ${1}: ${2}\n\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	return content
+}
+
+func htmlText(text string) string {
+	text = metachat.EditRegexp.ReplaceAllString(text, "Edit: ${1}")
+
+	var result strings.Builder
+	last := 0
+	for _, loc := range metachat.PreformattedRegexp.FindAllStringSubmatchIndex(text, -1) {
+		result.WriteString(htmlInline(text[last:loc[0]]))
+		result.WriteString("<pre><code>" + html.EscapeString(text[loc[2]:loc[3]]) + "</code></pre>")
+		last = loc[1]
+	}
+
+	result.WriteString(htmlInline(text[last:]))
+
+	return result.String()
+}
+
+func htmlInline(text string) string {
+	content := html.EscapeString(text)
+	content = metachat.BoldRegexp.ReplaceAllString(content, "<strong>${1}</strong>")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "<em>${1}</em>")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "<del>${1}</del>")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "<u>${1}</u>")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "<span data-mx-spoiler>${1}</span>")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "<blockquote><strong>${1}</strong>: ${2}</blockquote>")
+	content = strings.Replace(content, "\n", "<br>", -1)
+
+	return content
+}
+
+// converter exposes the Matrix conversions. Inbound payloads are room events along with the display
+// names of the users they refer to.
+type converter struct{}
+
+type converterEvent struct {
+	Event event             `json:"event"`
+	Users map[string]string `json:"users,omitempty"`
+}
+
+// offlineClient fails every request, so that the conversions don't reach the homeserver.
+type offlineClient struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	payload, err := json.MarshalIndent(convertToMatrix(msg), "", "  ")
+
+	return payload, errors.WithStack(err)
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var e converterEvent
+	err := json.Unmarshal(payload, &e)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	c := &Client{id: "Matrix", httpClient: offlineClient{}, names: &nameCache{names: make(map[string]string)}}
+	for id, name := range e.Users {
+		c.names.put(id, name)
+	}
+
+	msg, ok := c.convertToMetachat(e.Event)
+	if !ok {
+		return metachat.Message{}, errors.Errorf("unsupported message type '%s'", e.Event.Content.MsgType)
+	}
+
+	return msg, nil
+}
+
+func (offlineClient) Do(req *http.Request) (*http.Response, error) {
+	return nil, errors.Errorf("%s %s isn't available offline", req.Method, req.URL.Path)
+}
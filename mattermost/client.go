@@ -0,0 +1,339 @@
+package mattermost
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const reconnectDelay = 5 * time.Second
+
+// maxLength is the Mattermost message length limit.
+const maxLength = 16383
+
+type (
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// Config structure. Token is a bot or personal access token.
+	Config struct {
+		ID         string     `json:"-"`
+		URL        string     `json:"url" required:"true"`
+		Token      string     `json:"token" required:"true"`
+		HTTPClient httpClient `json:"-"`
+	}
+
+	// Client is a Mattermost client.
+	Client struct {
+		id          string
+		httpClient  httpClient
+		url         string
+		token       string
+		botID       string
+		usersByID   *userMap
+		messageChan chan metachat.Message
+	}
+
+	user struct {
+		ID        string `json:"id"`
+		Username  string `json:"username"`
+		Nickname  string `json:"nickname"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+
+	post struct {
+		ID        string `json:"id,omitempty"`
+		ChannelID string `json:"channel_id,omitempty"`
+		UserID    string `json:"user_id,omitempty"`
+		RootID    string `json:"root_id,omitempty"`
+		Message   string `json:"message"`
+		Type      string `json:"type,omitempty"`
+		EditAt    int64  `json:"edit_at,omitempty"`
+	}
+
+	event struct {
+		Event string `json:"event"`
+		Data  struct {
+			Post string `json:"post"`
+		} `json:"data"`
+	}
+
+	userMap struct {
+		sync.RWMutex
+		users map[string]string
+	}
+)
+
+func init() {
+	metachat.Register("mattermost", newMessenger, Config{})
+	metachat.RegisterConverter("mattermost", converter{})
+}
+
+// NewClient is a Mattermost client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" || config.Token == "" {
+		return nil, errors.New("URL and token can't be nil")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Mattermost"
+	}
+
+	client := &Client{
+		id:          id,
+		httpClient:  httpClient,
+		url:         strings.TrimSuffix(config.URL, "/"),
+		token:       config.Token,
+		usersByID:   &userMap{users: make(map[string]string)},
+		messageChan: make(chan metachat.Message, 100),
+	}
+
+	var me user
+	err := client.do(http.MethodGet, "/api/v4/users/me", nil, &me)
+	if err != nil {
+		return nil, err
+	}
+
+	client.botID = me.ID
+
+	return client, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Start listens to the WebSocket event stream and reconnects whenever the connection is lost.
+func (c *Client) Start() error {
+	for {
+		err := c.listen()
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// Send sends a message to channel with the provided ID.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to channel with the provided ID and returns the post ID.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
+	var result post
+	err := c.do(http.MethodPost, "/api/v4/posts", post{ChannelID: chat, Message: convertToMattermost(msg)}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.ID, nil
+}
+
+// Edit replaces the text of the post with the provided ID.
+func (c *Client) Edit(msg metachat.Message, chat, id string) error {
+	return c.do(http.MethodPut, "/api/v4/posts/"+id+"/patch", post{Message: convertToMattermost(msg)}, nil)
+}
+
+// MaxLength returns the Mattermost message length limit.
+func (c *Client) MaxLength() int {
+	return maxLength
+}
+
+// CheckCredentials verifies the token and reports the channels the bot is a member of.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	err := c.do(http.MethodGet, "/api/v4/users/me", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		visible[chat] = c.do(http.MethodGet, "/api/v4/channels/"+url.PathEscape(chat)+"/members/me", nil, nil) == nil
+	}
+
+	return visible, nil
+}
+
+func (c *Client) listen() error {
+	wsURL := "ws" + strings.TrimPrefix(c.url, "http") + "/api/v4/websocket"
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.token)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer conn.Close()
+
+	for {
+		var e event
+		err = conn.ReadJSON(&e)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if e.Event != "posted" && e.Event != "post_edited" {
+			continue
+		}
+
+		var p post
+		err = json.Unmarshal([]byte(e.Data.Post), &p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if p.Message == "" || p.Type != "" || p.UserID == c.botID {
+			continue
+		}
+
+		c.messageChan <- c.convertToMetachat(p, e.Event == "post_edited")
+	}
+}
+
+// userName returns the display name of the user with the provided ID, fetching it on the first use.
+func (c *Client) userName(id string) string {
+	if name, ok := c.usersByID.get(id); ok {
+		return name
+	}
+
+	var u user
+	err := c.do(http.MethodGet, "/api/v4/users/"+id, nil, &u)
+	if err != nil {
+		log.Printf("%+v", err)
+		return ""
+	}
+
+	name := displayName(u)
+	c.usersByID.put(id, name)
+
+	return name
+}
+
+func (c *Client) do(method, path string, payload, result interface{}) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
+		if err != nil || seconds <= 0 {
+			seconds = 1
+		}
+
+		return &metachat.RetryAfterError{Duration: time.Duration(seconds) * time.Second}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("got %s from %s %s", resp.Status, method, path)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
+
+func (m *userMap) get(key string) (string, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	val, ok := m.users[key]
+
+	return val, ok
+}
+
+func (m *userMap) put(key, value string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.users[key] = value
+}
+
+func displayName(u user) string {
+	if u.Nickname != "" {
+		return u.Nickname
+	}
+
+	if name := strings.TrimSpace(fmt.Sprintf("%s %s", u.FirstName, u.LastName)); name != "" {
+		return name
+	}
+
+	return u.Username
+}
@@ -0,0 +1,286 @@
+package mattermost
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakeServer is a Mattermost server answering the REST API and replaying the recorded WebSocket events
+// from testdata/events.jsonl to every connection. Created and patched posts are handed over to the test.
+type fakeServer struct {
+	sync.Mutex
+	server      *httptest.Server
+	posts       chan request
+	conns       chan *websocket.Conn
+	userLookups map[string]int
+}
+
+type request struct {
+	method string
+	path   string
+	post   post
+}
+
+var users = map[string]user{
+	"bot": {ID: "bot", Username: "metachat"},
+	"u1":  {ID: "u1", Username: "alice", FirstName: "Alice", LastName: "Smith"},
+	"u2":  {ID: "u2", Username: "bob", Nickname: "Bobby"},
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	events := readFixture(t, "testdata/events.jsonl")
+	s := &fakeServer{
+		posts:       make(chan request, 10),
+		conns:       make(chan *websocket.Conn, 10),
+		userLookups: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+		switch {
+		case path == "/users/me":
+			json.NewEncoder(w).Encode(users["bot"])
+
+		case strings.HasPrefix(path, "/users/"):
+			id := strings.TrimPrefix(path, "/users/")
+			s.Lock()
+			s.userLookups[id]++
+			s.Unlock()
+
+			u, ok := users[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			json.NewEncoder(w).Encode(u)
+
+		case path == "/channels/c1/members/me":
+			w.Write([]byte(`{"channel_id":"c1","user_id":"bot"}`))
+
+		case path == "/posts" || strings.HasSuffix(path, "/patch"):
+			var p post
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				t.Error(err)
+			}
+
+			s.posts <- request{method: r.Method, path: path, post: p}
+
+			if p.Message == "slow down" {
+				w.Header().Set("X-Ratelimit-Reset", "3")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			p.ID = "p9"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(p)
+
+		case path == "/websocket":
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for _, e := range events {
+				if err := conn.WriteMessage(websocket.TextMessage, e); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			s.conns <- conn
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// accept waits for the client to connect and get the recorded events.
+func (s *fakeServer) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't connect")
+		return nil
+	}
+}
+
+func TestListenRelaysPosts(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, s.server.URL)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.listen() }()
+
+	conn := s.accept(t)
+
+	want := []metachat.Message{
+		{Messenger: "Mattermost", Chat: "c1", Author: "Alice Smith", AuthorID: "u1",
+			Text: "Hello, " + metachat.Bold("world")},
+		{Messenger: "Mattermost", Chat: "c1", Author: "Alice Smith", AuthorID: "u1",
+			Text: metachat.Edit("Hello, " + metachat.Italic("everyone"))},
+		{Messenger: "Mattermost", Chat: "c1", Author: "Bobby", AuthorID: "u2", Text: "bye"},
+	}
+
+	for _, msg := range want {
+		select {
+		case got := <-c.MessageChan():
+			if got != msg {
+				t.Errorf("got %+v instead of %+v", got, msg)
+			}
+
+		case <-time.After(testTimeout):
+			t.Fatalf("message %+v isn't relayed", msg)
+		}
+	}
+
+	select {
+	case got := <-c.MessageChan():
+		t.Errorf("message %+v is relayed", got)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.Lock()
+	if s.userLookups["u1"] != 1 || s.userLookups["bot"] != 0 || s.userLookups["u3"] != 0 {
+		t.Errorf("unexpected user lookups %v", s.userLookups)
+	}
+	s.Unlock()
+
+	conn.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("listen returned no error after the connection is closed")
+		}
+
+	case <-time.After(testTimeout):
+		t.Error("listen didn't return after the connection is closed")
+	}
+}
+
+func TestSendAndEdit(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, s.server.URL)
+
+	id, err := c.SendEditable(metachat.Message{Author: "Alice", Text: metachat.Italic("hi")}, "c1")
+	if err != nil || id != "p9" {
+		t.Fatalf("got post ID %q: %v", id, err)
+	}
+
+	expectPost(t, s, request{method: http.MethodPost, path: "/posts",
+		post: post{ChannelID: "c1", Message: "**[Alice]** _hi_"}})
+
+	err = c.Edit(metachat.Message{Text: "fixed"}, "c1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectPost(t, s, request{method: http.MethodPut, path: "/posts/p9/patch", post: post{Message: "fixed"}})
+
+	err = c.Send(metachat.Message{Text: "slow down"}, "c1")
+	if retry, ok := err.(*metachat.RetryAfterError); !ok || retry.Duration != 3*time.Second {
+		t.Errorf("got %v instead of a rate limit error", err)
+	}
+
+	visible, err := c.CheckCredentials([]string{"c1", "c2"})
+	if err != nil || !visible["c1"] || visible["c2"] {
+		t.Errorf("got visible channels %v: %v", visible, err)
+	}
+}
+
+func TestNewClientChecksToken(t *testing.T) {
+	s := newFakeServer(t)
+
+	_, err := NewClient(Config{URL: s.server.URL, Token: "wrong"})
+	if err == nil {
+		t.Error("client is created with a wrong token")
+	}
+}
+
+func newTestClient(t *testing.T, url string) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{URL: url, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.botID != "bot" {
+		t.Errorf("bot ID is %q", c.botID)
+	}
+
+	return c
+}
+
+func expectPost(t *testing.T, s *fakeServer, want request) {
+	t.Helper()
+
+	select {
+	case got := <-s.posts:
+		if got != want {
+			t.Errorf("got %+v instead of %+v", got, want)
+		}
+
+	case <-time.After(testTimeout):
+		t.Errorf("%s %s isn't requested", want.method, want.path)
+	}
+}
+
+// readFixture returns the lines of the recorded fixture.
+func readFixture(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	var result [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result = append(result, []byte(line))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
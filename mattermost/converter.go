@@ -0,0 +1,92 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+var (
+	preformattedRegexp  = regexp.MustCompile("(?s)```(?:[a-zA-Z0-9+-]*\n)?(.*?)```")
+	codeRegexp          = regexp.MustCompile("`([^`]+?)`")
+	boldRegexp          = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	italicRegexp        = regexp.MustCompile(`\*(.+?)\*|\b_(.+?)_\b`)
+	strikethroughRegexp = regexp.MustCompile(`~~(.+?)~~`)
+	mentionRegexp       = regexp.MustCompile(`\B@([a-z0-9.\-_]+)`)
+	linkRegexp          = regexp.MustCompile(`\[(.*?)\]\((https?://.*?)\)`)
+)
+
+func convertToMattermost(msg metachat.Message) string {
+	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, "**${1}**")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~~${1}~~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "```\n${1}\n```")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> **${1}**: ${2}\n\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	if msg.Author != "" {
+		content = fmt.Sprintf("**[%s]** %s", msg.Author, content)
+	}
+
+	return content
+}
+
+func (c *Client) convertToMetachat(p post, edit bool) metachat.Message {
+	content := preformattedRegexp.ReplaceAllString(p.Message, metachat.Preformatted("${1}"))
+	content = codeRegexp.ReplaceAllString(content, metachat.Preformatted("${1}"))
+	content = boldRegexp.ReplaceAllString(content, metachat.Bold("${1}"))
+	content = italicRegexp.ReplaceAllString(content, metachat.Italic("${1}${2}"))
+	content = strikethroughRegexp.ReplaceAllString(content, metachat.Strikethrough("${1}"))
+	content = linkRegexp.ReplaceAllString(content, "${2}")
+	content = mentionRegexp.ReplaceAllString(content, metachat.Mention("${1}"))
+
+	if edit {
+		content = metachat.Edit(content)
+	}
+
+	return metachat.Message{
+		Messenger: c.id,
+		Chat:      p.ChannelID,
+		Author:    c.userName(p.UserID),
+		AuthorID:  p.UserID,
+		Text:      content,
+	}
+}
+
+// converter exposes the Mattermost conversions. Inbound payloads are posts along with the names
+// of the users they refer to.
+type converter struct{}
+
+type converterPost struct {
+	Post  post              `json:"post"`
+	Users map[string]string `json:"users,omitempty"`
+}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(convertToMattermost(msg)), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var p converterPost
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	c := &Client{id: "Mattermost", usersByID: &userMap{users: make(map[string]string)}}
+	for id, name := range p.Users {
+		c.usersByID.put(id, name)
+	}
+
+	if _, ok := c.usersByID.get(p.Post.UserID); !ok {
+		return metachat.Message{}, errors.Errorf("unknown user '%s'", p.Post.UserID)
+	}
+
+	return c.convertToMetachat(p.Post, p.Post.EditAt != 0), nil
+}
@@ -0,0 +1,170 @@
+package metachat
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxBurstWindows limits how many coalescing windows a burst may last, so that an author posting
+	// faster than the window doesn't delay the delivery indefinitely.
+	maxBurstWindows = 5
+
+	// maxBurstLength is the length in runes after which a burst is delivered and a new one is started.
+	maxBurstLength = 2000
+)
+
+type (
+	// Duration is a time.Duration represented in JSON as a string like "5s".
+	Duration struct {
+		time.Duration
+	}
+
+	// burst is a sequence of consecutive messages from the same author and source chat
+	// that are delivered as a single message. Author is the author ID or, if there's none, the name.
+	burst struct {
+		msg      Message
+		author   string
+		targets  []Chat
+		sent     map[chatKey]*sentMessage
+		timer    *time.Timer
+		deadline time.Time
+	}
+
+	// coalescer holds the open burst of every source chat.
+	coalescer struct {
+		sync.Mutex
+		bursts map[chatKey]*burst
+	}
+)
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return errors.Errorf("invalid duration %s", data)
+	}
+
+	d.Duration, err = time.ParseDuration(value)
+
+	return errors.WithStack(err)
+}
+
+// deliver sends the message to the target chats, merging it with the previous messages of the same
+// author if the source chat has a coalescing window. Targets supporting edits get the first message
+// at once and then have it edited, the rest get the merged message when the window is over or
+// another author posts in the source chat.
+func (m *Metachat) deliver(msg Message, targets []Chat, window time.Duration) {
+	if window == 0 || EditRegexp.MatchString(msg.Text) {
+		m.sendAll(msg, targets)
+		return
+	}
+
+	m.coalescer.Lock()
+	defer m.coalescer.Unlock()
+
+	key := newChatKey(msg.Messenger, msg.Chat)
+	author := msg.AuthorID
+	if author == "" {
+		author = msg.Author
+	}
+
+	if b, ok := m.coalescer.bursts[key]; ok {
+		text := b.msg.Text + "\n" + msg.Text
+		if b.author == author && utf8.RuneCountInString(text) <= maxBurstLength {
+			b.msg.Text = text
+			b.timer.Reset(minDuration(window, time.Until(b.deadline)))
+
+			for _, chat := range b.targets {
+				if sent, ok := b.sent[chat.key()]; ok {
+					m.logError(m.push(b.msg, chat, sent))
+				}
+			}
+
+			return
+		}
+
+		m.flushBurst(key, b)
+	}
+
+	b := &burst{msg: msg, author: author, targets: targets, sent: make(map[chatKey]*sentMessage),
+		deadline: time.Now().Add(maxBurstWindows * window)}
+
+	for _, chat := range targets {
+		if _, ok := m.messengers[niceName(chat.Messenger)].(Editor); ok {
+			sent := &sentMessage{}
+			b.sent[chat.key()] = sent
+			m.logError(m.push(msg, chat, sent))
+		}
+	}
+
+	b.timer = time.AfterFunc(window, func() {
+		m.coalescer.Lock()
+		defer m.coalescer.Unlock()
+
+		m.flushBurst(key, b)
+	})
+
+	m.coalescer.bursts[key] = b
+}
+
+// flushBurst sends the merged message to the targets that don't support edits unless the burst is
+// already flushed. Must be called with the coalescer lock held.
+func (m *Metachat) flushBurst(key chatKey, b *burst) {
+	if m.coalescer.bursts[key] != b {
+		return
+	}
+
+	b.timer.Stop()
+	delete(m.coalescer.bursts, key)
+
+	for _, chat := range b.targets {
+		if _, ok := b.sent[chat.key()]; !ok {
+			m.logError(m.send(b.msg, chat))
+		}
+	}
+}
+
+// stopCoalescing sends the merged messages of the open bursts to the targets that don't support edits
+// right away, bypassing the outboxes as they are stopped along with Metachat.
+func (m *Metachat) stopCoalescing() {
+	m.coalescer.Lock()
+	defer m.coalescer.Unlock()
+
+	for key, b := range m.coalescer.bursts {
+		b.timer.Stop()
+		delete(m.coalescer.bursts, key)
+
+		for _, chat := range b.targets {
+			if _, ok := b.sent[chat.key()]; !ok {
+				msg := b.msg
+				msg.Text = markRelayed(m.identities.translateMentions(msg.Text, msg.Messenger, chat.Messenger))
+				m.logError(m.messengers[niceName(chat.Messenger)].Send(msg, chat.ID))
+			}
+		}
+	}
+}
+
+func (m *Metachat) sendAll(msg Message, targets []Chat) {
+	for _, chat := range targets {
+		m.logError(m.send(msg, chat))
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,169 @@
+// Package conformance checks the message conversions of the messenger types against a shared set of
+// canonical messages, so that every client renders and parses the same formatting.
+//
+// Each messenger type has a directory of golden files named after its type:
+//
+//	<case>.out        the native payload the case message is sent as
+//	<case>.in         a native payload the platform delivers for the case, optional
+//	<case>.in.golden  the message converted from <case>.in, as JSON
+//
+// The checks run as TestConformance of the metachat command. Run it with -update to write
+// the current results to the golden files and review the diff:
+//
+//	go test -run TestConformance . -update
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+type (
+	// Case is a canonical message.
+	Case struct {
+		Name    string
+		Message metachat.Message
+	}
+
+	// Mismatch is a conversion result differing from its golden file.
+	Mismatch struct {
+		File     string
+		Expected string
+		Actual   string
+	}
+
+	// Mismatches is a list of conversion results differing from their golden files.
+	Mismatches []Mismatch
+)
+
+// Cases are the canonical messages every messenger type is checked with.
+var Cases = []Case{
+	{Name: "plain", Message: metachat.Message{Author: "Alice", Text: "Hello, world"}},
+	{Name: "system", Message: metachat.Message{Text: "Room settings changed"}},
+	{Name: "bold", Message: metachat.Message{Author: "Alice", Text: "This is " + metachat.Bold("important")}},
+	{Name: "italic", Message: metachat.Message{Author: "Alice", Text: "This is " + metachat.Italic("emphasized")}},
+	{Name: "strikethrough", Message: metachat.Message{Author: "Alice",
+		Text: "This is " + metachat.Strikethrough("wrong")}},
+	{Name: "underline", Message: metachat.Message{Author: "Alice",
+		Text: "This is " + metachat.Underline("underlined")}},
+	{Name: "spoiler", Message: metachat.Message{Author: "Alice", Text: "The end: " + metachat.Spoiler("he wins")}},
+	{Name: "link", Message: metachat.Message{Author: "Alice", Text: "See https://example.com/?a=1&b=2 please"}},
+	{Name: "preformatted", Message: metachat.Message{Author: "Alice",
+		Text: "Code:\n" + metachat.Preformatted("if a*b > c_d {\n\treturn\n}")}},
+	{Name: "mention", Message: metachat.Message{Author: "Alice", Text: "Hi " + metachat.Mention("Bob")}},
+	{Name: "account-mention", Message: metachat.Message{Author: "Alice", Text: "Hi " + metachat.MentionOf("Bob", "42")}},
+	{Name: "quote", Message: metachat.Message{Author: "Alice",
+		Text: metachat.Quote("Are you there?", "Bob") + " Yes"}},
+	{Name: "edit", Message: metachat.Message{Author: "Alice", Text: metachat.Edit("Fixed typo")}},
+	{Name: "markup", Message: metachat.Message{Author: "Alice",
+		Text: "2*3 = 6, snake_case, `tick`, [brackets] <tag> & ~tilde~"}},
+	{Name: "unicode", Message: metachat.Message{Author: "Алиса", Text: "Привет 👋 " + metachat.Bold("мир")}},
+}
+
+// Check converts the cases with the converter of the messenger type and compares the results with
+// the golden files in dir. If update is set, the results are written to the golden files instead.
+func Check(typeName, dir string, update bool) error {
+	converter, ok := metachat.ConverterOf(typeName)
+	if !ok {
+		return errors.Errorf("messenger type '%s' has no converter", typeName)
+	}
+
+	if update {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var mismatches Mismatches
+	for _, c := range Cases {
+		native, err := converter.ToNative(c.Message)
+		if err != nil {
+			return errors.Wrapf(err, "%s: can't convert case '%s'", typeName, c.Name)
+		}
+
+		mismatch, err := compare(filepath.Join(dir, c.Name+".out"), string(native), update)
+		if err != nil {
+			return err
+		}
+
+		if mismatch != nil {
+			mismatches = append(mismatches, *mismatch)
+		}
+
+		payload, err := ioutil.ReadFile(filepath.Join(dir, c.Name+".in"))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		msg, err := converter.FromNative(payload)
+		if err != nil {
+			return errors.Wrapf(err, "%s: can't convert %s.in", typeName, c.Name)
+		}
+
+		converted, err := json.MarshalIndent(msg, "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mismatch, err = compare(filepath.Join(dir, c.Name+".in.golden"), string(converted)+"\n", update)
+		if err != nil {
+			return err
+		}
+
+		if mismatch != nil {
+			mismatches = append(mismatches, *mismatch)
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return mismatches
+	}
+
+	return nil
+}
+
+func compare(path, actual string, update bool) (*Mismatch, error) {
+	if update {
+		return nil, errors.WithStack(ioutil.WriteFile(path, []byte(actual), 0644))
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	if err != nil || string(expected) != actual {
+		return &Mismatch{File: path, Expected: string(expected), Actual: actual}, nil
+	}
+
+	return nil, nil
+}
+
+func (m Mismatch) Error() string {
+	if m.Expected == "" {
+		return fmt.Sprintf("%s: no golden file, got %q", m.File, m.Actual)
+	}
+
+	return fmt.Sprintf("%s: expected %q, got %q", m.File, m.Expected, m.Actual)
+}
+
+func (m Mismatches) Error() string {
+	messages := make([]string, 0, len(m))
+	for _, mismatch := range m {
+		messages = append(messages, mismatch.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
@@ -0,0 +1,71 @@
+package metachat
+
+import (
+	"sort"
+)
+
+// CredentialReport is the result of the credentials check of a messenger instance. Supported is false
+// if the messenger doesn't implement CredentialChecker, Chats is nil if it can't tell which chats it sees.
+type CredentialReport struct {
+	Messenger string
+	Supported bool
+	Err       error
+	Chats     map[string]bool
+}
+
+// CheckCredentials validates the configuration, creates the messengers without starting them and
+// checks their credentials and access to the chats of the rooms.
+func CheckCredentials(config Config) ([]CredentialReport, error) {
+	err := Validate(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms, _, err := loadRooms(config)
+	if err != nil {
+		return nil, err
+	}
+
+	chats := make(map[string][]string)
+	seen := make(map[chatKey]bool)
+	for _, room := range rooms {
+		for _, chat := range room.Chats {
+			if seen[chat.key()] {
+				continue
+			}
+
+			seen[chat.key()] = true
+			chats[niceName(chat.Messenger)] = append(chats[niceName(chat.Messenger)], chat.ID)
+		}
+	}
+
+	var reports []CredentialReport
+	check := func(messenger Messenger) {
+		report := CredentialReport{Messenger: messenger.Name()}
+		if checker, ok := messenger.(CredentialChecker); ok {
+			ids := chats[niceName(messenger.Name())]
+			sort.Strings(ids)
+
+			report.Supported = true
+			report.Chats, report.Err = checker.CheckCredentials(ids)
+		}
+
+		reports = append(reports, report)
+	}
+
+	for _, messenger := range config.Messengers {
+		check(messenger)
+	}
+
+	for _, instance := range config.Instances {
+		messenger, err := NewMessenger(instance)
+		if err != nil {
+			reports = append(reports, CredentialReport{Messenger: instance.Name, Supported: true, Err: err})
+			continue
+		}
+
+		check(messenger)
+	}
+
+	return reports, nil
+}
@@ -0,0 +1,44 @@
+package metachat_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/metachattest"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	failing := metachattest.NewCheckingMessenger("c")
+	failing.Err = errors.New("invalid token")
+
+	reports, err := metachat.CheckCredentials(metachat.Config{
+		Port: 8080,
+		Rooms: []metachat.Room{
+			room("team", chat("a", "1"), chat("b", "2"), chat("c", "3")),
+			room("ops", chat("a", "4"), chat("a", "1")),
+		},
+		Messengers: []metachat.Messenger{metachattest.NewCheckingMessenger("a", "1", "5"),
+			metachattest.NewMessenger("b"), failing},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []metachat.CredentialReport{
+		{Messenger: "a", Supported: true, Chats: map[string]bool{"1": true, "4": false}},
+		{Messenger: "b"},
+		{Messenger: "c", Supported: true, Err: failing.Err},
+	}
+
+	if !reflect.DeepEqual(reports, expected) {
+		t.Errorf("got %+v instead of %+v", reports, expected)
+	}
+
+	_, err = metachat.CheckCredentials(metachat.Config{Port: 8080, Rooms: []metachat.Room{room("team", chat("x", "1"))}})
+	if err == nil {
+		t.Error("invalid configuration is checked")
+	}
+}
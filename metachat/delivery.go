@@ -0,0 +1,253 @@
+package metachat
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	outboxSize     = 1000
+	maxSendRetries = 5
+)
+
+// DefaultRateLimit is used for messengers that don't declare their own limits.
+var DefaultRateLimit = RateLimit{Interval: time.Second, Burst: 1}
+
+type (
+	// RateLimit allows Burst messages at once and one more message every Interval.
+	RateLimit struct {
+		Interval time.Duration
+		Burst    int
+	}
+
+	// RateLimited is implemented by messengers with platform-specific outbound rate limits.
+	RateLimited interface {
+		RateLimits(chat string) []RateLimit
+	}
+
+	// Editor is implemented by messengers able to change already sent messages.
+	Editor interface {
+		SendEditable(Message, string) (string, error)
+		Edit(Message, string, string) error
+	}
+
+	// RetryAfterError is returned by Messenger.Send when the platform asks to slow down.
+	// The message is sent again once the Duration passes.
+	RetryAfterError struct {
+		Duration time.Duration
+	}
+
+	// outbox is a rate limited queue of messages for a single chat.
+	outbox struct {
+		messenger Messenger
+		chat      string
+		queue     chan delivery
+		buckets   []*bucket
+		done      chan struct{}
+	}
+
+	// delivery is a single outbox item. If sent is set, the message is sent with an Editor and
+	// its ID is stored to sent, or the message is edited if its ID is already known. Part is the index
+	// of the item among the parts of a split message. If upload is set, the message is sent with
+	// an Uploader.
+	delivery struct {
+		msg    Message
+		sent   *sentMessage
+		part   int
+		upload bool
+	}
+
+	// sentMessage holds the IDs of the parts of a sent message. It's only accessed by the goroutine
+	// of the outbox it was queued to.
+	sentMessage struct {
+		ids []string
+	}
+
+	// bucket is a token bucket for a single rate limit.
+	bucket struct {
+		limit  RateLimit
+		tokens float64
+		last   time.Time
+	}
+
+	outboxMap struct {
+		sync.Mutex
+		outboxes map[chatKey]*outbox
+		done     chan struct{}
+	}
+)
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry after %s", e.Duration)
+}
+
+func newOutbox(messenger Messenger, chat string, done chan struct{}) *outbox {
+	limits := []RateLimit{DefaultRateLimit}
+	if limited, ok := messenger.(RateLimited); ok {
+		limits = limited.RateLimits(chat)
+	}
+
+	buckets := make([]*bucket, 0, len(limits))
+	for _, limit := range limits {
+		buckets = append(buckets, newBucket(limit))
+	}
+
+	box := &outbox{
+		messenger: messenger,
+		chat:      chat,
+		queue:     make(chan delivery, outboxSize),
+		buckets:   buckets,
+		done:      done,
+	}
+
+	go box.run()
+
+	return box
+}
+
+func (o *outbox) push(item delivery) error {
+	select {
+	case <-o.done:
+		return errors.Errorf("metachat is stopped, message to %s chat '%s' is dropped", o.messenger.Name(), o.chat)
+
+	default:
+	}
+
+	select {
+	case o.queue <- item:
+		return nil
+
+	default:
+		source := "metachat"
+		if item.msg.Messenger != "" {
+			source = fmt.Sprintf("%s chat '%s'", item.msg.Messenger, item.msg.Chat)
+		}
+
+		return errors.Errorf("outbound queue of %s chat '%s' is full, message from %s is dropped", o.messenger.Name(),
+			o.chat, source)
+	}
+}
+
+func (o *outbox) run() {
+	for {
+		select {
+		case item := <-o.queue:
+			err := o.send(item)
+			if err != nil {
+				log.Printf("%+v", err)
+			}
+
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *outbox) send(item delivery) error {
+	for attempt := 0; ; attempt++ {
+		o.wait()
+
+		err := o.deliver(item)
+		retry, ok := errors.Cause(err).(*RetryAfterError)
+		if !ok || attempt == maxSendRetries {
+			return err
+		}
+
+		time.Sleep(retry.Duration)
+	}
+}
+
+func (o *outbox) deliver(item delivery) error {
+	if uploader, ok := o.messenger.(Uploader); ok && item.upload {
+		return uploader.Upload(item.msg, o.chat)
+	}
+
+	editor, ok := o.messenger.(Editor)
+	if !ok || item.sent == nil || item.part > len(item.sent.ids) {
+		// A part can't be tracked if a previous one failed, so it's sent as it is.
+		return o.messenger.Send(item.msg, o.chat)
+	}
+
+	if item.part < len(item.sent.ids) {
+		return editor.Edit(item.msg, o.chat, item.sent.ids[item.part])
+	}
+
+	id, err := editor.SendEditable(item.msg, o.chat)
+	if err != nil {
+		return err
+	}
+
+	item.sent.ids = append(item.sent.ids, id)
+
+	return nil
+}
+
+// wait blocks until every bucket of the outbox allows sending a message.
+func (o *outbox) wait() {
+	for _, b := range o.buckets {
+		for {
+			delay := b.take(time.Now())
+			if delay == 0 {
+				break
+			}
+
+			time.Sleep(delay)
+		}
+	}
+}
+
+func newBucket(limit RateLimit) *bucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	return &bucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// take consumes a token if there is one and returns zero, otherwise returns the time
+// until the next token is available.
+func (b *bucket) take(now time.Time) time.Duration {
+	if b.limit.Interval <= 0 {
+		return 0
+	}
+
+	b.tokens += float64(now.Sub(b.last)) / float64(b.limit.Interval)
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) * float64(b.limit.Interval))
+}
+
+func (m *outboxMap) get(messenger Messenger, chat Chat) *outbox {
+	m.Lock()
+	defer m.Unlock()
+
+	key := chat.key()
+	box, ok := m.outboxes[key]
+	if !ok {
+		box = newOutbox(messenger, chat.ID, m.done)
+		m.outboxes[key] = box
+	}
+
+	return box
+}
+
+// stop makes the outboxes drop their queues and refuse new messages.
+func (m *outboxMap) stop() {
+	m.Lock()
+	defer m.Unlock()
+
+	close(m.done)
+}
@@ -0,0 +1,381 @@
+package metachat_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/metachattest"
+)
+
+func TestDeliveryMarksRelayedMessages(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))}})
+
+	h.Messenger("a").Receive("1", "alice", "hello")
+
+	sent := waitSent(t, h.Messenger("b"), 1)
+	if sent[0].Chat != "2" || sent[0].Message.Author != "alice" || sent[0].Text() != "hello" {
+		t.Errorf("unexpected delivery %+v", sent[0])
+	}
+
+	if !strings.HasSuffix(sent[0].Message.Text, metachat.OriginMarker) {
+		t.Errorf("message %q has no origin marker", sent[0].Message.Text)
+	}
+
+	h.Messenger("b").Receive("2", "bridge", "echo"+metachat.OriginMarker)
+	expectNone(t, h.Messenger("a"))
+}
+
+func TestDeliveryRelaysRepliesToRelayedMessages(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))}})
+
+	quote := metachat.Quote("hello"+metachat.OriginMarker, "alice")
+	if strings.Contains(quote, metachat.OriginMarker) {
+		t.Errorf("quote %q has the origin marker", quote)
+	}
+
+	h.Messenger("b").Receive("2", "bob", "#{quote author=alice}hello"+metachat.OriginMarker+"{quote}# hi")
+
+	sent := waitSent(t, h.Messenger("a"), 1)
+	if !strings.HasSuffix(sent[0].Text(), " hi") {
+		t.Errorf("unexpected delivery %+v", sent[0])
+	}
+}
+
+func TestDeliveryRetriesAfterRateLimit(t *testing.T) {
+	b := metachattest.NewMessenger("b")
+	b.Fail(&metachat.RetryAfterError{Duration: 10 * time.Millisecond})
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Messengers: []metachat.Messenger{b},
+	})
+
+	h.Messenger("a").Receive("1", "alice", "hello")
+
+	sent := waitSent(t, b, 1)
+	if len(sent) != 1 || sent[0].Text() != "hello" {
+		t.Errorf("unexpected deliveries %+v", sent)
+	}
+}
+
+func TestDeliveryLogsFullQueue(t *testing.T) {
+	b := metachattest.NewMessenger("b")
+	b.Limits = []metachat.RateLimit{{Interval: time.Hour, Burst: 1}}
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Messengers: []metachat.Messenger{b},
+	})
+
+	output := captureLog(t)
+
+	// One message is sent at once, another one waits for the rate limit and the queue holds a thousand more.
+	for i := 0; i < 1003; i++ {
+		h.Messenger("a").Receive("1", "alice", strconv.Itoa(i))
+	}
+
+	want := "outbound queue of b chat '2' is full, message from a chat '1' is dropped"
+	for deadline := time.Now().Add(metachattest.Timeout); !strings.Contains(output.String(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("log %q doesn't report the dropped message", output.String())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveryKeepsOrderPerChat(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))}})
+
+	texts := []string{"one", "two", "three", "four", "five"}
+	for _, text := range texts {
+		h.Messenger("a").Receive("1", "alice", text)
+	}
+
+	sent := waitSent(t, h.Messenger("b"), len(texts))
+	for i, text := range texts {
+		if sent[i].Text() != text {
+			t.Errorf("message %d is %q instead of %q", i, sent[i].Text(), text)
+		}
+	}
+}
+
+func TestDeliverySplitsLongMessages(t *testing.T) {
+	b := metachattest.NewMessenger("b")
+	b.Length = 60
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Messengers: []metachat.Messenger{b},
+	})
+
+	text := strings.Repeat("word ", 20) + metachat.Bold(strings.Repeat("bold ", 10))
+	h.Messenger("a").Receive("1", "al", text)
+
+	waitSent(t, b, 2)
+	time.Sleep(100 * time.Millisecond)
+
+	sent := b.Sent()
+	var joined []string
+	for _, s := range sent {
+		if length := len([]rune(metachat.PlainText(s.Text()))); length > b.Length {
+			t.Errorf("part %q is %d characters long", s.Text(), length)
+		}
+
+		if !strings.HasSuffix(s.Message.Text, metachat.OriginMarker) {
+			t.Errorf("part %q has no origin marker", s.Message.Text)
+		}
+
+		joined = append(joined, metachat.PlainText(s.Text()))
+	}
+
+	if strings.Join(strings.Fields(strings.Join(joined, " ")), " ") !=
+		strings.Join(strings.Fields(metachat.PlainText(text)), " ") {
+		t.Errorf("parts %q don't add up to the message", joined)
+	}
+
+	if last := sent[len(sent)-1].Text(); !metachat.BoldRegexp.MatchString(last) {
+		t.Errorf("last part %q lost the formatting", last)
+	}
+}
+
+func TestDeliveryUploadsLongMessages(t *testing.T) {
+	b := metachattest.NewUploadingMessenger("b")
+	b.Length = 60
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Messengers: []metachat.Messenger{b},
+	})
+
+	text := strings.Repeat("word ", 20)
+	h.Messenger("a").Receive("1", "al", text)
+	h.Messenger("a").Receive("1", "al", "short")
+
+	sent := waitSent(t, b.Messenger, 2)
+	if !sent[0].Uploaded || sent[0].Text() != text {
+		t.Errorf("long message is delivered as %+v", sent[0])
+	}
+
+	if sent[1].Uploaded || sent[1].Text() != "short" {
+		t.Errorf("short message is delivered as %+v", sent[1])
+	}
+}
+
+func TestDeliveryCoalescesBursts(t *testing.T) {
+	editable := metachattest.NewEditableMessenger("e")
+	team := room("team", chat("a", "1"), chat("b", "2"), chat("e", "3"))
+	team.Coalesce = metachat.Duration{Duration: 200 * time.Millisecond}
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{team},
+		Messengers: []metachat.Messenger{editable},
+	})
+
+	h.Messenger("a").Receive("1", "alice", "one")
+	waitSent(t, editable.Messenger, 1)
+	h.Messenger("a").Receive("1", "alice", "two")
+
+	edited := waitSent(t, editable.Messenger, 2)
+	if edited[1].Edited != edited[0].ID || edited[1].Text() != "one\ntwo" {
+		t.Errorf("unexpected edit %+v of %+v", edited[1], edited[0])
+	}
+
+	merged := waitSent(t, h.Messenger("b"), 1)
+	if merged[0].Text() != "one\ntwo" {
+		t.Errorf("merged message is %q", merged[0].Text())
+	}
+
+	h.Messenger("b").Reset()
+	expectNone(t, h.Messenger("b"))
+}
+
+func TestDeliveryEndsBurstOnAnotherAuthor(t *testing.T) {
+	team := room("team", chat("a", "1"), chat("b", "2"))
+	team.Coalesce = metachat.Duration{Duration: 200 * time.Millisecond}
+
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{team}})
+
+	h.Messenger("a").Inject(metachat.Message{Chat: "1", Author: "alice", AuthorID: "A1", Text: "one"})
+	h.Messenger("a").Inject(metachat.Message{Chat: "1", Author: "Alice Smith", AuthorID: "A1", Text: "two"})
+	h.Messenger("a").Inject(metachat.Message{Chat: "1", Author: "bob", AuthorID: "B1", Text: "reply"})
+	h.Messenger("a").Inject(metachat.Message{Chat: "1", Author: "alice", AuthorID: "A1", Text: "three"})
+
+	sent := waitSent(t, h.Messenger("b"), 3)
+
+	texts := make([]string, 0, len(sent))
+	for _, s := range sent {
+		texts = append(texts, s.Text())
+	}
+
+	if strings.Join(texts, "|") != "one\ntwo|reply|three" {
+		t.Errorf("got %q", texts)
+	}
+}
+
+func TestDeliveryLimitsBurstAge(t *testing.T) {
+	team := room("team", chat("a", "1"), chat("b", "2"))
+	team.Coalesce = metachat.Duration{Duration: 100 * time.Millisecond}
+
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{team}})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(60 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			h.Messenger("a").Receive("1", "alice", strconv.Itoa(i))
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	waitSent(t, h.Messenger("b"), 1)
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("first merged message is delivered after %s", elapsed)
+	}
+}
+
+func TestDeliveryCoalescesForMixedTargets(t *testing.T) {
+	editable := metachattest.NewEditableMessenger("e")
+	team := room("team", chat("a", "1"), chat("b", "2"), chat("e", "3"))
+	team.Coalesce = metachat.Duration{Duration: 300 * time.Millisecond}
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{team},
+		Messengers: []metachat.Messenger{editable},
+	})
+
+	for _, text := range []string{"one", "two", "three"} {
+		h.Messenger("a").Receive("1", "alice", text)
+	}
+
+	edits := waitSent(t, editable.Messenger, 3)
+	for i, s := range edits[1:] {
+		if s.Edited != edits[0].ID {
+			t.Errorf("message %d %+v isn't an edit of %+v", i+2, s, edits[0])
+		}
+	}
+
+	if last := edits[2].Text(); last != "one\ntwo\nthree" {
+		t.Errorf("editable target got %q", last)
+	}
+
+	expectNone(t, h.Messenger("b"))
+
+	merged := waitSent(t, h.Messenger("b"), 1)
+	if merged[0].Text() != "one\ntwo\nthree" || merged[0].Edited != "" {
+		t.Errorf("target without edits got %+v", merged[0])
+	}
+}
+
+func TestStopDeliversPendingBursts(t *testing.T) {
+	team := room("team", chat("a", "1"), chat("b", "2"))
+	team.Coalesce = metachat.Duration{Duration: time.Hour}
+
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{team}})
+
+	h.Messenger("a").Receive("1", "alice", "one")
+	h.Messenger("a").Receive("1", "alice", "two")
+
+	// The command reply is queued after the messages, so once it's sent the burst is open.
+	postCommand(t, h, "a", "1", "", "metachat chatID")
+
+	err := h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := h.Messenger("b").Sent()
+	if len(sent) != 1 || sent[0].Text() != "one\ntwo" {
+		t.Errorf("got %+v on shutdown", sent)
+	}
+}
+
+func startHarness(t *testing.T, config metachat.Config) *metachattest.Harness {
+	t.Helper()
+
+	h, err := metachattest.Start(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := h.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return h
+}
+
+func waitSent(t *testing.T, messenger *metachattest.Messenger, count int) []metachattest.Sent {
+	t.Helper()
+
+	sent, err := messenger.WaitSent(count, metachattest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sent
+}
+
+func expectNone(t *testing.T, messenger *metachattest.Messenger) {
+	t.Helper()
+
+	err := messenger.ExpectNone(100 * time.Millisecond)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// logBuffer collects the log output of the test.
+type logBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	output := &logBuffer{}
+	log.SetOutput(output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return output
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.buffer.String()
+}
+
+func room(name string, chats ...metachat.Chat) metachat.Room {
+	return metachat.Room{Name: name, Chats: chats}
+}
+
+func chat(messenger, id string) metachat.Chat {
+	return metachat.Chat{Messenger: messenger, ID: id}
+}
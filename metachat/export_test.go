@@ -0,0 +1,9 @@
+package metachat
+
+// SplitReserve, SplitMessage and SplitText expose the splitting of long messages to the table tests.
+const SplitReserve = splitReserve
+
+var (
+	SplitMessage = splitMessage
+	SplitText    = splitText
+)
@@ -3,15 +3,24 @@ package metachat
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"unicode"
 )
 
+// OriginMarker is an invisible sequence appended to every message sent by Metachat.
+// Messages containing it were relayed by a Metachat instance and must not be relayed again.
+const OriginMarker = "\u2063\u200b\u2063"
+
 // Set of pre-compiled regular expressions for all Metachat tags.
 var (
 	BoldRegexp          = regexp.MustCompile("#{bold}(.*?){bold}#")
 	ItalicRegexp        = regexp.MustCompile("#{italic}(.*?){italic}#")
 	StrikethroughRegexp = regexp.MustCompile("#{strikethrough}(.*?){strikethrough}#")
+	UnderlineRegexp     = regexp.MustCompile("#{underline}(.*?){underline}#")
+	SpoilerRegexp       = regexp.MustCompile("#{spoiler}(.*?){spoiler}#")
 	PreformattedRegexp  = regexp.MustCompile("(?s)#{preformatted}(.*?){preformatted}#")
-	MentionRegexp       = regexp.MustCompile("#{mention}(.*?){mention}#")
+	MentionRegexp       = regexp.MustCompile("#{mention(?: id=[^}]*)?}(.*?){mention}#")
+	MentionIDRegexp     = regexp.MustCompile("#{mention id=([^}]*)}(.*?){mention}#")
 	QuoteRegexp         = regexp.MustCompile("#{quote author=(.*?)}(.*?){quote}#")
 	EditRegexp          = regexp.MustCompile("#{edit}(.*?){edit}#")
 )
@@ -31,6 +40,16 @@ func Strikethrough(text string) string {
 	return fmt.Sprintf("#{strikethrough}%s{strikethrough}#", text)
 }
 
+// Underline marks text as underlined using Metachat tag.
+func Underline(text string) string {
+	return fmt.Sprintf("#{underline}%s{underline}#", text)
+}
+
+// Spoiler marks text as spoiler using Metachat tag.
+func Spoiler(text string) string {
+	return fmt.Sprintf("#{spoiler}%s{spoiler}#", text)
+}
+
 // Preformatted marks text as preformatted using Metachat tag.
 func Preformatted(text string) string {
 	return fmt.Sprintf("#{preformatted}%s{preformatted}#", text)
@@ -41,12 +60,44 @@ func Mention(text string) string {
 	return fmt.Sprintf("#{mention}%s{mention}#", text)
 }
 
-// Quote marks text as quote using Metachat tag.
+// MentionOf marks text as mention of the account with the provided ID using Metachat tag.
+// The ID is specific to the messenger the message comes from or is sent to.
+func MentionOf(text, id string) string {
+	return fmt.Sprintf("#{mention id=%s}%s{mention}#", id, text)
+}
+
+// Quote marks text as quote using Metachat tag. The origin marker is removed from the quoted text,
+// so that a reply to a relayed message isn't taken for a relayed message itself.
 func Quote(text, author string) string {
-	return fmt.Sprintf("#{quote author=%s}%s{quote}#", author, text)
+	return fmt.Sprintf("#{quote author=%s}%s{quote}#", author, strings.Replace(text, OriginMarker, "", -1))
 }
 
 // Edit marks text as edited using Metachat tag.
 func Edit(text string) string {
 	return fmt.Sprintf("#{edit}%s{edit}#", text)
 }
+
+// PlainText renders the Metachat tags of the text as plain text.
+func PlainText(text string) string {
+	content := BoldRegexp.ReplaceAllString(text, "${1}")
+	content = ItalicRegexp.ReplaceAllString(content, "${1}")
+	content = StrikethroughRegexp.ReplaceAllString(content, "${1}")
+	content = UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = PreformattedRegexp.ReplaceAllString(content, "${1}")
+	content = MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = QuoteRegexp.ReplaceAllString(content, "> ${1}: ${2}\n\n")
+	content = EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	return content
+}
+
+func markRelayed(text string) string {
+	return text + OriginMarker
+}
+
+// isRelayed reports whether the message ends with the origin marker. Quoted relayed messages
+// may contain the marker elsewhere.
+func isRelayed(msg Message) bool {
+	return strings.HasSuffix(strings.TrimRightFunc(msg.Text, unicode.IsSpace), OriginMarker)
+}
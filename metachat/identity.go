@@ -0,0 +1,364 @@
+package metachat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const identityCommand = "metachat identity"
+
+type (
+	// Identity links the accounts of a person on different messengers, so that mentions of the person
+	// are rendered as real mentions on every messenger. Accounts maps messenger IDs to the account IDs
+	// on them: Slack user IDs like U0123ABCD, Telegram user IDs or @usernames, Skype IDs like 8:live:alice.
+	Identity struct {
+		Name     string            `json:"name" required:"true"`
+		Accounts map[string]string `json:"accounts"`
+	}
+
+	// IdentityStore persists identities linked at runtime.
+	IdentityStore interface {
+		Load() ([]Identity, error)
+		Save([]Identity) error
+	}
+
+	// directory is the set of known identities along with the pending identity codes.
+	directory struct {
+		sync.RWMutex
+		identities []Identity
+		store      IdentityStore
+		codes      map[string]identityCode
+	}
+
+	// account is an account ID on a messenger.
+	account struct {
+		messenger string
+		id        string
+	}
+
+	// identityCode is issued for an account to link it with an account on another messenger. Once the code
+	// is used from the other account, a confirmation code with that account as pending is issued, as
+	// the first code is posted in a shared chat and anyone could use it.
+	identityCode struct {
+		account account
+		pending account
+		author  string
+		expires time.Time
+	}
+)
+
+// handleIdentityCommand either issues a code for the account of the message author or, if the message
+// contains a code, uses it. A code used from another account is exchanged for a confirmation code, which
+// links both accounts once it's posted from the account the first code was issued for. Using the first
+// code and confirming the link from the first account proves that the same person controls both accounts.
+func (m *Metachat) handleIdentityCommand(msg Message) error {
+	if msg.AuthorID == "" {
+		return m.reply(msg, "Accounts of this messenger can't be linked.")
+	}
+
+	code := strings.TrimSpace(strings.TrimPrefix(msg.Text, identityCommand))
+	if code == "" {
+		return m.issueIdentityCode(msg)
+	}
+
+	return m.useIdentityCode(msg, code)
+}
+
+func (m *Metachat) issueIdentityCode(msg Message) error {
+	code, err := m.identities.issueCode(identityCode{account: newAccount(msg.Messenger, msg.AuthorID),
+		author: msg.Author})
+
+	if err != nil {
+		return err
+	}
+
+	return m.reply(msg, fmt.Sprintf("Post '%s %s' from your account on another messenger within %d minutes.",
+		identityCommand, code, int(pairingCodeTTL.Minutes())))
+}
+
+func (m *Metachat) useIdentityCode(msg Message, code string) error {
+	m.identities.Lock()
+	m.identities.removeExpiredCodes()
+	c, ok := m.identities.codes[code]
+	m.identities.Unlock()
+
+	if !ok {
+		return m.reply(msg, "Identity code is invalid or expired.")
+	}
+
+	current := newAccount(msg.Messenger, msg.AuthorID)
+	if c.pending != (account{}) {
+		return m.confirmIdentityCode(msg, code, c)
+	}
+
+	if c.account.messenger == current.messenger {
+		return m.reply(msg, "Identity code must be used from another messenger.")
+	}
+
+	m.identities.Lock()
+	delete(m.identities.codes, code)
+	m.identities.Unlock()
+
+	confirmation, err := m.identities.issueCode(identityCode{account: c.account, pending: current, author: c.author})
+	if err != nil {
+		return err
+	}
+
+	return m.reply(msg, fmt.Sprintf("Post '%s %s' from your account on %s within %d minutes to confirm the link.",
+		identityCommand, confirmation, c.account.messenger, int(pairingCodeTTL.Minutes())))
+}
+
+// confirmIdentityCode links the accounts of the confirmation code if it's posted from the account the first
+// code was issued for.
+func (m *Metachat) confirmIdentityCode(msg Message, code string, c identityCode) error {
+	if newAccount(msg.Messenger, msg.AuthorID) != c.account {
+		return m.reply(msg, "Identity code must be confirmed from the account it was issued for.")
+	}
+
+	m.identities.Lock()
+	delete(m.identities.codes, code)
+	m.identities.Unlock()
+
+	name, err := m.identities.link(c.account, c.pending, c.author)
+	if err != nil {
+		return err
+	}
+
+	return m.reply(msg, fmt.Sprintf("Account is linked to identity '%s'.", name))
+}
+
+// issueCode stores the code with a new random value and the expiration time.
+func (d *directory) issueCode(c identityCode) (string, error) {
+	code, err := newPairingCode()
+	if err != nil {
+		return "", err
+	}
+
+	c.expires = time.Now().Add(pairingCodeTTL)
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.removeExpiredCodes()
+	d.codes[code] = c
+
+	return code, nil
+}
+
+// link adds both accounts to the same identity and persists the result. An existing identity of
+// the first account is preferred, then the one of the second account, otherwise a new identity named
+// after the author of the first account is created. The accounts are removed from other identities.
+func (d *directory) link(first, second account, author string) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	index := d.find(first)
+	if index < 0 {
+		index = d.find(second)
+	}
+
+	if index < 0 {
+		d.identities = append(d.identities, Identity{Name: d.uniqueName(author), Accounts: make(map[string]string)})
+		index = len(d.identities) - 1
+	}
+
+	for _, acc := range []account{first, second} {
+		if other := d.find(acc); other >= 0 && other != index {
+			d.identities[other] = d.identities[other].without(acc.messenger)
+		}
+
+		d.identities[index] = d.identities[index].with(acc)
+	}
+
+	if d.store != nil {
+		if err := d.store.Save(d.identities); err != nil {
+			return "", err
+		}
+	}
+
+	return d.identities[index].Name, nil
+}
+
+// translateMentions replaces the account IDs of the mentions in the text sent from the source messenger
+// with the IDs of the same people on the target messenger. Mentions without IDs are looked up by the identity
+// name, as identity names are unique. Mentions of unknown accounts aren't, the name may belong to someone else.
+// The mentions that aren't found lose their IDs.
+func (d *directory) translateMentions(text, source, target string) string {
+	if niceName(source) == niceName(target) || !MentionRegexp.MatchString(text) {
+		return text
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	return MentionRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		name := MentionRegexp.FindStringSubmatch(match)[1]
+
+		var index int
+		if groups := MentionIDRegexp.FindStringSubmatch(match); groups != nil {
+			index = d.find(newAccount(source, groups[1]))
+		} else {
+			index = d.findByName(name)
+		}
+
+		if index >= 0 {
+			if id, ok := d.identities[index].account(target); ok {
+				return MentionOf(name, id)
+			}
+		}
+
+		return Mention(name)
+	})
+}
+
+func (d *directory) find(acc account) int {
+	for i, identity := range d.identities {
+		if id, ok := identity.account(acc.messenger); ok && id == acc.id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (d *directory) findByName(name string) int {
+	for i, identity := range d.identities {
+		if strings.EqualFold(identity.Name, name) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// uniqueName returns the name or the name with the smallest numeric suffix no identity has.
+func (d *directory) uniqueName(name string) string {
+	if name == "" {
+		name = "identity"
+	}
+
+	result := name
+	for i := 2; d.findByName(result) >= 0; i++ {
+		result = fmt.Sprintf("%s %d", name, i)
+	}
+
+	return result
+}
+
+func (d *directory) removeExpiredCodes() {
+	now := time.Now()
+	for code, c := range d.codes {
+		if now.After(c.expires) {
+			delete(d.codes, code)
+		}
+	}
+}
+
+// account returns the account ID of the identity on the messenger.
+func (i Identity) account(messenger string) (string, bool) {
+	for name, id := range i.Accounts {
+		if niceName(name) == niceName(messenger) {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// with returns a copy of the identity with the account added, replacing its account on the same messenger.
+func (i Identity) with(acc account) Identity {
+	result := i.without(acc.messenger)
+	result.Accounts[acc.messenger] = acc.id
+
+	return result
+}
+
+// without returns a copy of the identity without its account on the messenger.
+func (i Identity) without(messenger string) Identity {
+	accounts := make(map[string]string, len(i.Accounts))
+	for name, id := range i.Accounts {
+		if niceName(name) != niceName(messenger) {
+			accounts[name] = id
+		}
+	}
+
+	return Identity{Name: i.Name, Accounts: accounts}
+}
+
+func newAccount(messenger, id string) account {
+	return account{messenger: niceName(messenger), id: id}
+}
+
+// loadIdentities returns the configured identities overridden by the stored ones.
+func loadIdentities(config Config) ([]Identity, error) {
+	identities := append([]Identity(nil), config.Identities...)
+	if config.IdentityStore == nil {
+		return identities, nil
+	}
+
+	stored, err := config.IdentityStore.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, identity := range stored {
+		replaced := false
+		for i := range identities {
+			if strings.EqualFold(identities[i].Name, identity.Name) {
+				identities[i] = identity
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			identities = append(identities, identity)
+		}
+	}
+
+	return identities, nil
+}
+
+func validateIdentities(identities []Identity, messengerExists func(id string) bool) error {
+	names := make(map[string]bool)
+	accounts := make(map[account]string)
+
+	for _, identity := range identities {
+		if identity.Name == "" {
+			return errors.New("identity has no name")
+		}
+
+		if names[strings.ToLower(identity.Name)] {
+			return errors.Errorf("identity name '%s' is not unique", identity.Name)
+		}
+
+		names[strings.ToLower(identity.Name)] = true
+
+		messengers := make([]string, 0, len(identity.Accounts))
+		for messenger := range identity.Accounts {
+			messengers = append(messengers, messenger)
+		}
+
+		sort.Strings(messengers)
+
+		for _, messenger := range messengers {
+			if !messengerExists(messenger) {
+				return errors.Errorf("messenger '%s' from identity '%s' not found", messenger, identity.Name)
+			}
+
+			acc := newAccount(messenger, identity.Accounts[messenger])
+			if other, ok := accounts[acc]; ok {
+				return errors.Errorf("account '%s' of messenger '%s' is listed in identities '%s' and '%s'",
+					acc.id, messenger, other, identity.Name)
+			}
+
+			accounts[acc] = identity.Name
+		}
+	}
+
+	return nil
+}
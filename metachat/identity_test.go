@@ -0,0 +1,82 @@
+package metachat_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/metachattest"
+)
+
+var identityCodeRegexp = regexp.MustCompile(`metachat identity (\d{6})`)
+
+func TestIdentityCommandRequiresConfirmation(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))}})
+
+	code := identityCode(t, postCommand(t, h, "a", "1", "A1", "metachat identity"))
+
+	reply := postCommand(t, h, "b", "2", "B1", "metachat identity "+code)
+	confirmation := identityCode(t, reply)
+	if !strings.Contains(reply, "from your account on a") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	reply = postCommand(t, h, "b", "2", "B2", "metachat identity "+code)
+	if reply != "Identity code is invalid or expired." {
+		t.Errorf("code is accepted twice: %q", reply)
+	}
+
+	expectMention(t, h, metachat.MentionOf("alice", "B1"), metachat.Mention("alice"))
+
+	for _, account := range []struct{ messenger, chat, id string }{{"a", "1", "A2"}, {"b", "2", "B1"}} {
+		reply = postCommand(t, h, account.messenger, account.chat, account.id, "metachat identity "+confirmation)
+		if reply != "Identity code must be confirmed from the account it was issued for." {
+			t.Errorf("confirmation from %s on %s is accepted: %q", account.id, account.messenger, reply)
+		}
+	}
+
+	reply = postCommand(t, h, "a", "1", "A1", "metachat identity "+confirmation)
+	if reply != "Account is linked to identity 'admin'." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	expectMention(t, h, metachat.MentionOf("alice", "B1"), metachat.MentionOf("alice", "A1"))
+}
+
+func TestMentionsOfUnknownAccountsKeepNames(t *testing.T) {
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Identities: []metachat.Identity{{Name: "Bob", Accounts: map[string]string{"a": "A9", "b": "B9"}}},
+	})
+
+	expectMention(t, h, metachat.MentionOf("Bob", "B9"), metachat.MentionOf("Bob", "A9"))
+	expectMention(t, h, metachat.Mention("Bob"), metachat.MentionOf("Bob", "A9"))
+	expectMention(t, h, metachat.MentionOf("Bob", "B7"), metachat.Mention("Bob"))
+}
+
+// expectMention posts the mention from messenger b and checks how it's delivered to messenger a.
+func expectMention(t *testing.T, h *metachattest.Harness, mention, expected string) {
+	t.Helper()
+
+	h.Messenger("a").Reset()
+	h.Messenger("b").Receive("2", "carol", "hi "+mention)
+
+	sent := waitSent(t, h.Messenger("a"), 1)
+	if text := sent[0].Text(); text != "hi "+expected {
+		t.Errorf("%q is delivered as %q instead of %q", mention, text, "hi "+expected)
+	}
+
+	h.Messenger("a").Reset()
+}
+
+func identityCode(t *testing.T, reply string) string {
+	t.Helper()
+
+	groups := identityCodeRegexp.FindStringSubmatch(reply)
+	if groups == nil {
+		t.Fatalf("reply %q has no identity code", reply)
+	}
+
+	return groups[1]
+}
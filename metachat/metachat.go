@@ -1,9 +1,13 @@
 package metachat
 
 import (
+	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -13,6 +17,14 @@ import (
 
 const chatIDCommand = "metachat chatID"
 
+// Chat directions. Inbound messages are the ones metachat reads from a chat, outbound messages
+// are the ones it delivers to a chat.
+const (
+	DirectionBoth     = "both"
+	DirectionInbound  = "inbound-only"
+	DirectionOutbound = "outbound-only"
+)
+
 type (
 	// Messenger is a common interface that must be implemented by all messenger clients.
 	Messenger interface {
@@ -23,38 +35,89 @@ type (
 		Send(Message, string) error
 	}
 
-	// Message is a platform-independent message representation.
+	// Joiner is implemented by messengers receiving only the messages of the chats they joined, like IRC
+	// channels. Join is called with the chats of the rooms before the messenger is started and with
+	// the chats linked with pairing codes.
+	Joiner interface {
+		Join(chats []string)
+	}
+
+	// Stopper is implemented by messengers holding messages back, like mail digests. Stop is called by
+	// Metachat.Stop after the open coalescing bursts are sent and should send the held messages.
+	Stopper interface {
+		Stop()
+	}
+
+	// CredentialChecker is implemented by messengers able to verify their credentials without starting.
+	// The returned map reports whether the bot can see each of the chats, it's nil if the messenger
+	// can't tell.
+	CredentialChecker interface {
+		CheckCredentials(chats []string) (map[string]bool, error)
+	}
+
+	// Message is a platform-independent message representation. Messenger is the ID of the messenger
+	// instance the message comes from. AuthorID is the account ID of the author on that messenger,
+	// it's used to link the accounts of a person and is empty if the messenger can't tell.
 	Message struct {
 		Messenger string
 		Chat      string
 		Author    string
+		AuthorID  string `json:",omitempty"`
+		Avatar    string `json:",omitempty"`
 		Text      string
 	}
 
-	// Chat represents a single messenger chat.
+	// Chat represents a single messenger chat. Messenger is the messenger instance ID.
 	Chat struct {
-		Messenger string `json:"messenger"`
-		ID        string `json:"id"`
+		Messenger string `json:"messenger" required:"true"`
+		ID        string `json:"id" required:"true"`
+		Direction string `json:"direction,omitempty"`
 	}
 
 	// Room is a set of chats.
 	Room struct {
-		Name  string `json:"name"`
-		Chats []Chat `json:"chats"`
+		Name     string   `json:"name" required:"true"`
+		Chats    []Chat   `json:"chats"`
+		Coalesce Duration `json:"coalesce,omitempty"`
 	}
 
-	// Config structure.
+	// Config structure. Instances are created with the registered factories and started
+	// along with Messengers. Rooms are extended with the rooms and chats from RoomStore, Identities
+	// are overridden by the ones with the same names from IdentityStore. Admins can link chats.
 	Config struct {
-		Port       int         `json:"port"`
-		Rooms      []Room      `json:"rooms"`
-		Messengers []Messenger `json:"-"`
+		Port          int               `json:"port" required:"true"`
+		Rooms         []Room            `json:"rooms"`
+		Instances     []MessengerConfig `json:"messengers"`
+		Identities    []Identity        `json:"identities"`
+		Admins        []Admin           `json:"admins"`
+		Messengers    []Messenger       `json:"-"`
+		RoomStore     RoomStore         `json:"-"`
+		IdentityStore IdentityStore     `json:"-"`
+	}
+
+	// chatKey identifies a chat across all messengers.
+	chatKey struct {
+		messenger string
+		id        string
 	}
 
 	// Metachat structure.
 	Metachat struct {
-		port       int
-		messengers map[string]Messenger
-		rooms      map[string]Room
+		messengers      map[string]Messenger
+		rooms           map[string]Room
+		stored          map[string]Room
+		index           map[chatKey][]string
+		roomsLock       sync.RWMutex
+		store           RoomStore
+		admins          map[account]bool
+		pairings        map[string]pairing
+		pairingFailures map[chatKey]pairingFailures
+		outboxes        *outboxMap
+		coalescer       *coalescer
+		identities      *directory
+		server          *http.Server
+		stopped         chan struct{}
+		stopOnce        sync.Once
 	}
 )
 
@@ -64,26 +127,80 @@ func New(config Config) (*Metachat, error) {
 		return nil, errors.New("port can't be nil")
 	}
 
+	instances := append([]Messenger(nil), config.Messengers...)
+	for _, instance := range config.Instances {
+		if instance.Name == "" {
+			return nil, errors.Errorf("messenger of type '%s' has no name", instance.Type)
+		}
+
+		messenger, err := NewMessenger(instance)
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, messenger)
+	}
+
 	messengers := make(map[string]Messenger)
-	for _, messenger := range config.Messengers {
+	for _, messenger := range instances {
+		if _, ok := messengers[niceName(messenger.Name())]; ok {
+			return nil, errors.Errorf("messenger ID '%s' is not unique", messenger.Name())
+		}
+
 		messengers[niceName(messenger.Name())] = messenger
 	}
 
-	rooms := make(map[string]Room)
-	for _, room := range config.Rooms {
-		rooms[niceName(room.Name)] = room
+	rooms, stored, err := loadRooms(config)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := loadIdentities(config)
+	if err != nil {
+		return nil, err
+	}
+
+	admins := make(map[account]bool)
+	for _, admin := range config.Admins {
+		admins[newAccount(admin.Messenger, admin.ID)] = true
 	}
 
 	metachat := &Metachat{
-		port:       config.Port,
-		messengers: messengers,
-		rooms:      rooms,
+		messengers:      messengers,
+		rooms:           rooms,
+		stored:          stored,
+		store:           config.RoomStore,
+		admins:          admins,
+		pairings:        make(map[string]pairing),
+		pairingFailures: make(map[chatKey]pairingFailures),
+		outboxes:        &outboxMap{outboxes: make(map[chatKey]*outbox), done: make(chan struct{})},
+		coalescer:       &coalescer{bursts: make(map[chatKey]*burst)},
+		identities: &directory{identities: identities, store: config.IdentityStore,
+			codes: make(map[string]identityCode)},
+		server:  &http.Server{Addr: ":" + strconv.Itoa(config.Port)},
+		stopped: make(chan struct{}),
+	}
+
+	messengerExists := func(id string) bool {
+		_, ok := messengers[niceName(id)]
+
+		return ok
+	}
+
+	if err := validateRooms(rooms, messengerExists); err != nil {
+		return nil, err
+	}
+
+	if err := validateAdmins(config.Admins, messengerExists); err != nil {
+		return nil, err
 	}
 
-	if err := metachat.validate(); err != nil {
+	if err := validateIdentities(identities, messengerExists); err != nil {
 		return nil, err
 	}
 
+	metachat.buildIndex()
+
 	return metachat, nil
 }
 
@@ -95,7 +212,7 @@ func (m *Metachat) Start() error {
 	}
 
 	out := merge(chans)
-	errChan := make(chan error)
+	errChan := make(chan error, len(m.messengers)+1)
 
 	m.registerHandlers(errChan)
 	m.startMessengers(errChan)
@@ -103,33 +220,185 @@ func (m *Metachat) Start() error {
 	for {
 		select {
 		case msg := <-out:
+			if isRelayed(msg) {
+				continue
+			}
+
 			if isCommand(msg) {
-				err := m.handleCommand(msg)
-				if err != nil {
-					return err
-				}
+				// A failed command, e.g. a reply that can't be queued, must not stop the bridge.
+				m.logError(m.handleCommand(msg))
 			} else {
-				chats := m.getTargetChats(msg)
-				for _, chat := range chats {
-					err := m.messengers[niceName(chat.Messenger)].Send(msg, chat.ID)
-					if err != nil {
-						return err
-					}
-				}
+				chats, window := m.getTargetChats(msg)
+				m.deliver(msg, chats, window)
 			}
 
 		case err := <-errChan:
 			return err
+
+		case <-m.stopped:
+			return nil
 		}
 	}
 }
 
-func (m *Metachat) validate() error {
-	for _, room := range m.rooms {
+// Stop shuts the HTTP server down, sends the open coalescing bursts, drops the queued messages, stops
+// the messengers implementing Stopper and makes Start return. Other messengers can't be stopped.
+func (m *Metachat) Stop() error {
+	var err error
+	m.stopOnce.Do(func() {
+		close(m.stopped)
+		m.stopCoalescing()
+		m.outboxes.stop()
+
+		for _, msgr := range m.messengers {
+			if stopper, ok := msgr.(Stopper); ok {
+				stopper.Stop()
+			}
+		}
+
+		err = errors.WithStack(m.server.Close())
+	})
+
+	return err
+}
+
+// Validate checks the configuration without creating the messengers, so that it can be done offline.
+// It checks that messenger IDs are unique and their types are registered, that rooms refer to existing
+// messengers with valid directions, that no chat is listed twice in a room, that admins refer to existing
+// messengers and that identities have unique names and refer to existing messengers.
+func Validate(config Config) error {
+	if config.Port == 0 {
+		return errors.New("port can't be nil")
+	}
+
+	ids := make(map[string]bool)
+	for _, messenger := range config.Messengers {
+		ids[niceName(messenger.Name())] = true
+	}
+
+	for _, instance := range config.Instances {
+		if instance.Name == "" {
+			return errors.Errorf("messenger of type '%s' has no name", instance.Type)
+		}
+
+		if _, ok := ConfigType(instance.Type); !ok {
+			return errors.Errorf("unknown type '%s' of messenger '%s'", instance.Type, instance.Name)
+		}
+
+		if ids[niceName(instance.Name)] {
+			return errors.Errorf("messenger ID '%s' is not unique", instance.Name)
+		}
+
+		ids[niceName(instance.Name)] = true
+	}
+
+	rooms, _, err := loadRooms(config)
+	if err != nil {
+		return err
+	}
+
+	identities, err := loadIdentities(config)
+	if err != nil {
+		return err
+	}
+
+	messengerExists := func(id string) bool {
+		return ids[niceName(id)]
+	}
+
+	if err := validateRooms(rooms, messengerExists); err != nil {
+		return err
+	}
+
+	if err := validateAdmins(config.Admins, messengerExists); err != nil {
+		return err
+	}
+
+	return validateIdentities(identities, messengerExists)
+}
+
+// loadRooms returns the configured rooms extended with the stored ones, along with the stored rooms.
+// A stored room with the name of a configured room adds its chats to it.
+func loadRooms(config Config) (map[string]Room, map[string]Room, error) {
+	rooms := make(map[string]Room)
+	for _, room := range config.Rooms {
+		if _, ok := rooms[niceName(room.Name)]; ok {
+			return nil, nil, errors.Errorf("room name '%s' is not unique", room.Name)
+		}
+
+		room.Chats = append([]Chat(nil), room.Chats...)
+		rooms[niceName(room.Name)] = room
+	}
+
+	stored := make(map[string]Room)
+	if config.RoomStore != nil {
+		list, err := config.RoomStore.Load()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, room := range list {
+			name := niceName(room.Name)
+			stored[name] = room
+
+			existing, ok := rooms[name]
+			if !ok {
+				existing = Room{Name: room.Name}
+			}
+
+			for _, chat := range room.Chats {
+				if !existing.contains(chat) {
+					existing.Chats = append(existing.Chats, chat)
+				}
+			}
+
+			rooms[name] = existing
+		}
+	}
+
+	return rooms, stored, nil
+}
+
+func validateRooms(rooms map[string]Room, messengerExists func(id string) bool) error {
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		room := rooms[name]
+		chats := make(map[chatKey]bool)
+
 		for _, chat := range room.Chats {
-			if _, ok := m.messengers[niceName(chat.Messenger)]; !ok {
+			if !messengerExists(chat.Messenger) {
 				return errors.Errorf("messenger '%s' from room '%s' not found", chat.Messenger, room.Name)
 			}
+
+			switch chat.Direction {
+			case "", DirectionBoth, DirectionInbound, DirectionOutbound:
+			default:
+				return errors.Errorf("unknown direction '%s' of chat '%s' from room '%s'", chat.Direction, chat.ID,
+					room.Name)
+			}
+
+			if chats[chat.key()] {
+				return errors.Errorf("chat '%s' of messenger '%s' is listed twice in room '%s'", chat.ID,
+					chat.Messenger, room.Name)
+			}
+
+			chats[chat.key()] = true
+		}
+	}
+
+	return nil
+}
+
+func validateAdmins(admins []Admin, messengerExists func(id string) bool) error {
+	for _, admin := range admins {
+		if !messengerExists(admin.Messenger) {
+			return errors.Errorf("messenger '%s' of admin '%s' not found", admin.Messenger, admin.ID)
 		}
 	}
 
@@ -150,13 +419,22 @@ func (m *Metachat) registerHandlers(errChan chan error) {
 		}
 	}
 
+	m.server.Handler = r
+
 	go func(errChan chan error) {
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(m.port), r)
+		err := m.server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			errChan <- err
+		}
 	}(errChan)
 }
 
 func (m *Metachat) startMessengers(errChan chan error) {
 	for _, msgr := range m.messengers {
+		if joiner, ok := msgr.(Joiner); ok {
+			joiner.Join(m.roomChats(msgr.Name()))
+		}
+
 		go func(msgr Messenger, errChan chan error) {
 			err := msgr.Start()
 			if err != nil {
@@ -166,9 +444,79 @@ func (m *Metachat) startMessengers(errChan chan error) {
 	}
 }
 
+// roomChats returns the IDs of the chats of the messenger that belong to rooms.
+func (m *Metachat) roomChats(messenger string) []string {
+	m.roomsLock.RLock()
+	defer m.roomsLock.RUnlock()
+
+	var result []string
+	seen := make(map[string]bool)
+	for _, room := range m.rooms {
+		for _, chat := range room.Chats {
+			if niceName(chat.Messenger) == niceName(messenger) && !seen[chat.ID] {
+				seen[chat.ID] = true
+				result = append(result, chat.ID)
+			}
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
 func (m *Metachat) handleCommand(msg Message) error {
-	if msg.Text == chatIDCommand {
-		err := m.messengers[niceName(msg.Messenger)].Send(Message{Text: msg.Chat}, msg.Chat)
+	switch {
+	case msg.Text == chatIDCommand:
+		return m.reply(msg, msg.Chat)
+
+	case msg.Text == pairCommand || strings.HasPrefix(msg.Text, pairCommand+" "):
+		return m.handlePairCommand(msg)
+
+	case msg.Text == identityCommand || strings.HasPrefix(msg.Text, identityCommand+" "):
+		return m.handleIdentityCommand(msg)
+	}
+
+	return nil
+}
+
+func (m *Metachat) reply(msg Message, text string) error {
+	return m.send(Message{Text: text}, Chat{Messenger: msg.Messenger, ID: msg.Chat})
+}
+
+// send queues the message for delivery to the chat.
+func (m *Metachat) send(msg Message, chat Chat) error {
+	return m.push(msg, chat, nil)
+}
+
+// push queues the message for delivery to the chat marking it as relayed by metachat. Messages over
+// the length limit of the messenger are uploaded as a file or split into several deliveries.
+func (m *Metachat) push(msg Message, chat Chat, sent *sentMessage) error {
+	msg.Text = m.identities.translateMentions(msg.Text, msg.Messenger, chat.Messenger)
+	messenger := m.messengers[niceName(chat.Messenger)]
+	box := m.outboxes.get(messenger, chat)
+
+	limited, ok := messenger.(LengthLimited)
+	if !ok {
+		msg.Text = markRelayed(msg.Text)
+		return box.push(delivery{msg: msg, sent: sent})
+	}
+
+	unit := Characters
+	if counter, ok := messenger.(LengthCounter); ok {
+		unit = counter.LengthUnit()
+	}
+
+	parts := splitMessage(msg, limited.MaxLength(), unit)
+	if uploader, ok := messenger.(Uploader); ok && len(parts) > 1 && sent == nil && uploader.UploadLong() {
+		msg.Text = markRelayed(msg.Text)
+		return box.push(delivery{msg: msg, upload: true})
+	}
+
+	for i, part := range parts {
+		part.Text = markRelayed(part.Text)
+
+		err := box.push(delivery{msg: part, sent: sent, part: i})
 		if err != nil {
 			return err
 		}
@@ -177,26 +525,71 @@ func (m *Metachat) handleCommand(msg Message) error {
 	return nil
 }
 
-func (m *Metachat) getTargetChats(msg Message) []Chat {
+func (m *Metachat) logError(err error) {
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+}
+
+// buildIndex maps every chat to the rooms its messages are delivered to.
+// Must be called with the rooms lock held or before the Metachat is started.
+func (m *Metachat) buildIndex() {
+	names := make([]string, 0, len(m.rooms))
+	for name := range m.rooms {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	index := make(map[chatKey][]string)
+	for _, name := range names {
+		for _, chat := range m.rooms[name].Chats {
+			if chat.sends() {
+				key := chat.key()
+				index[key] = append(index[key], name)
+			}
+		}
+	}
+
+	m.index = index
+}
+
+// getTargetChats returns the chats the message must be delivered to and the longest coalescing
+// window of the source chat rooms. A chat shared by several rooms of the source chat is returned only once.
+func (m *Metachat) getTargetChats(msg Message) ([]Chat, time.Duration) {
+	m.roomsLock.RLock()
+	defer m.roomsLock.RUnlock()
+
+	source := newChatKey(msg.Messenger, msg.Chat)
+	seen := map[chatKey]bool{source: true}
+
 	result := make([]Chat, 0)
-	for _, room := range m.rooms {
-		if !isMessageFromRoom(msg, room) {
-			continue
+	var window time.Duration
+	for _, name := range m.index[source] {
+		room := m.rooms[name]
+		if room.Coalesce.Duration > window {
+			window = room.Coalesce.Duration
 		}
 
 		for _, chat := range room.Chats {
-			if chat.Messenger != msg.Messenger || chat.ID != msg.Chat {
+			key := chat.key()
+			if !seen[key] && chat.receives() {
+				seen[key] = true
 				result = append(result, chat)
 			}
 		}
 	}
 
-	return result
+	return result, window
 }
 
 func (m *Metachat) postMessageHandler(w http.ResponseWriter, r *http.Request) {
 	roomName := chi.URLParam(r, "room")
+
+	m.roomsLock.RLock()
 	room, ok := m.rooms[roomName]
+	m.roomsLock.RUnlock()
+
 	if !ok {
 		render.Status(r, http.StatusNotFound)
 		render.JSON(w, r, render.M{})
@@ -213,7 +606,11 @@ func (m *Metachat) postMessageHandler(w http.ResponseWriter, r *http.Request) {
 	message.Author = ""
 
 	for _, chat := range room.Chats {
-		err := m.messengers[niceName(chat.Messenger)].Send(message, chat.ID)
+		if !chat.receives() {
+			continue
+		}
+
+		err := m.send(message, chat)
 		if err != nil {
 			render.Status(r, http.StatusInternalServerError)
 			render.JSON(w, r, render.M{"error": err.Error()})
@@ -225,17 +622,27 @@ func (m *Metachat) postMessageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func isCommand(message Message) bool {
-	return message.Text == chatIDCommand
+	return message.Text == chatIDCommand || message.Text == pairCommand ||
+		strings.HasPrefix(message.Text, pairCommand+" ") || message.Text == identityCommand ||
+		strings.HasPrefix(message.Text, identityCommand+" ")
 }
 
-func isMessageFromRoom(msg Message, room Room) bool {
-	for _, chat := range room.Chats {
-		if msg.Chat == chat.ID {
-			return true
-		}
-	}
+func newChatKey(messenger, id string) chatKey {
+	return chatKey{messenger: niceName(messenger), id: id}
+}
+
+func (c Chat) key() chatKey {
+	return newChatKey(c.Messenger, c.ID)
+}
+
+// sends reports whether messages from the chat are delivered to the rest of its room.
+func (c Chat) sends() bool {
+	return c.Direction != DirectionOutbound
+}
 
-	return false
+// receives reports whether messages from the rest of the room are delivered to the chat.
+func (c Chat) receives() bool {
+	return c.Direction != DirectionInbound
 }
 
 func merge(chans []<-chan Message) <-chan Message {
@@ -0,0 +1,306 @@
+package metachat_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/metachattest"
+)
+
+func TestChatIDCommand(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))}})
+
+	h.Messenger("a").Receive("1", "alice", "metachat chatID")
+
+	sent := waitSent(t, h.Messenger("a"), 1)
+	if sent[0].Chat != "1" || sent[0].Text() != "1" {
+		t.Errorf("unexpected reply %+v", sent[0])
+	}
+
+	expectNone(t, h.Messenger("b"))
+}
+
+func TestPostToRoom(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"),
+		metachat.Chat{Messenger: "b", ID: "2", Direction: metachat.DirectionInbound})}})
+
+	err := h.Post("team", metachat.Message{Author: "mallory", Text: "deploy finished"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := waitSent(t, h.Messenger("a"), 1)
+	if sent[0].Message.Author != "" || sent[0].Text() != "deploy finished" {
+		t.Errorf("unexpected delivery %+v", sent[0])
+	}
+
+	expectNone(t, h.Messenger("b"))
+
+	if err := h.Post("unknown", metachat.Message{Text: "lost"}); err == nil {
+		t.Error("posting to an unknown room succeeded")
+	}
+}
+
+func TestMessengersJoinRoomChats(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{
+		room("team", chat("a", "3"), chat("b", "2")),
+		room("ops", chat("A", "1"), chat("b", "2"), chat("a", "3")),
+	}})
+
+	// Chats are joined before the messengers start, so they are once a command is answered.
+	postCommand(t, h, "a", "3", "", "metachat chatID")
+
+	if joined := strings.Join(h.Messenger("a").Joined(), ","); joined != "1,3" {
+		t.Errorf("a joined %q", joined)
+	}
+
+	if joined := strings.Join(h.Messenger("b").Joined(), ","); joined != "2" {
+		t.Errorf("b joined %q", joined)
+	}
+}
+
+// stoppingMessenger is a fake messenger recording the messages sent before it's stopped.
+type stoppingMessenger struct {
+	*metachattest.Messenger
+	sentBeforeStop []metachattest.Sent
+}
+
+func (m *stoppingMessenger) Stop() {
+	m.sentBeforeStop = m.Sent()
+	m.Messenger.Stop(nil)
+}
+
+func TestStopStopsMessengers(t *testing.T) {
+	team := room("team", chat("a", "1"), chat("b", "2"))
+	team.Coalesce = metachat.Duration{Duration: time.Hour}
+
+	b := &stoppingMessenger{Messenger: metachattest.NewMessenger("b")}
+	h := startHarness(t, metachat.Config{Messengers: []metachat.Messenger{b}, Rooms: []metachat.Room{team}})
+
+	h.Messenger("a").Receive("1", "alice", "held")
+	postCommand(t, h, "a", "1", "", "metachat chatID")
+
+	err := h.Metachat.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The open burst is sent before the messenger is stopped, so that it can send it along with its own.
+	if len(b.sentBeforeStop) != 1 || b.sentBeforeStop[0].Text() != "held" {
+		t.Errorf("messenger got %+v before stopping", b.sentBeforeStop)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	tests := []struct {
+		name       string
+		rooms      []metachat.Room
+		messengers []string
+		from       metachat.Chat
+		want       map[string][]string
+	}{
+		{
+			name: "same chat ID on two messengers",
+			rooms: []metachat.Room{
+				room("first", chat("a", "1"), chat("b", "2")),
+				room("second", chat("c", "1"), chat("b", "3")),
+			},
+			from: chat("c", "1"),
+			want: map[string][]string{"b": {"3"}},
+		},
+		{
+			name: "chat in two rooms",
+			rooms: []metachat.Room{
+				room("first", chat("a", "1"), chat("b", "2")),
+				room("second", chat("a", "1"), chat("c", "3")),
+			},
+			from: chat("a", "1"),
+			want: map[string][]string{"b": {"2"}, "c": {"3"}},
+		},
+		{
+			name: "overlapping rooms deliver once",
+			rooms: []metachat.Room{
+				room("first", chat("a", "1"), chat("b", "2"), chat("c", "3")),
+				room("second", chat("a", "1"), chat("b", "2")),
+			},
+			from: chat("a", "1"),
+			want: map[string][]string{"b": {"2"}, "c": {"3"}},
+		},
+		{
+			name: "message from the other room of a shared chat",
+			rooms: []metachat.Room{
+				room("first", chat("a", "1"), chat("b", "2")),
+				room("second", chat("a", "1"), chat("c", "3")),
+			},
+			from: chat("c", "3"),
+			want: map[string][]string{"a": {"1"}},
+		},
+		{
+			name: "inbound-only chat doesn't receive",
+			rooms: []metachat.Room{room("first", chat("a", "1"),
+				metachat.Chat{Messenger: "b", ID: "2", Direction: metachat.DirectionInbound}, chat("c", "3"))},
+			from: chat("a", "1"),
+			want: map[string][]string{"c": {"3"}},
+		},
+		{
+			name: "inbound-only chat sends",
+			rooms: []metachat.Room{room("first", chat("a", "1"),
+				metachat.Chat{Messenger: "b", ID: "2", Direction: metachat.DirectionInbound})},
+			from: chat("b", "2"),
+			want: map[string][]string{"a": {"1"}},
+		},
+		{
+			name: "outbound-only chat doesn't send",
+			rooms: []metachat.Room{room("first", chat("a", "1"),
+				metachat.Chat{Messenger: "b", ID: "2", Direction: metachat.DirectionOutbound})},
+			from: chat("b", "2"),
+			want: map[string][]string{},
+		},
+		{
+			name: "outbound-only chat receives",
+			rooms: []metachat.Room{room("first", chat("a", "1"),
+				metachat.Chat{Messenger: "b", ID: "2", Direction: metachat.DirectionOutbound})},
+			from: chat("a", "1"),
+			want: map[string][]string{"b": {"2"}},
+		},
+		{
+			name: "instances of one type are told apart",
+			rooms: []metachat.Room{
+				room("first", chat("Work Slack", "C1"), chat("a", "1")),
+				room("second", chat("Home Slack", "C1"), chat("a", "2")),
+			},
+			messengers: []string{"Work Slack", "Home Slack"},
+			from:       chat("home-slack", "C1"),
+			want:       map[string][]string{"a": {"2"}},
+		},
+		{
+			name:       "instance names are normalized",
+			rooms:      []metachat.Room{room("first", chat("work-slack", "C1"), chat("a", "1"))},
+			messengers: []string{"Work Slack"},
+			from:       chat("Work Slack", "C1"),
+			want:       map[string][]string{"a": {"1"}},
+		},
+		{
+			name:  "unknown chat",
+			rooms: []metachat.Room{room("first", chat("a", "1"), chat("b", "2"))},
+			from:  chat("a", "2"),
+			want:  map[string][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := metachat.Config{Rooms: test.rooms}
+			for _, id := range test.messengers {
+				config.Messengers = append(config.Messengers, metachattest.NewMessenger(id))
+			}
+
+			h := startHarness(t, config)
+
+			h.Messenger(test.from.Messenger).Inject(metachat.Message{Messenger: test.from.Messenger,
+				Chat: test.from.ID, Author: "alice", Text: "hello"})
+
+			messengers := make(map[string]bool)
+			for _, r := range test.rooms {
+				for _, c := range r.Chats {
+					messengers[c.Messenger] = true
+				}
+			}
+
+			for id := range messengers {
+				if chats := test.want[id]; len(chats) > 0 {
+					waitSent(t, h.Messenger(id), len(chats))
+				}
+			}
+
+			// Duplicate and misrouted deliveries are given some time to arrive.
+			time.Sleep(100 * time.Millisecond)
+
+			for id := range messengers {
+				expectChats(t, id, h.Messenger(id).Sent(), test.want[id])
+			}
+		})
+	}
+}
+
+// expectChats checks that the messages were sent exactly once to every one of the chats.
+func expectChats(t *testing.T, messenger string, sent []metachattest.Sent, chats []string) {
+	t.Helper()
+
+	var got []string
+	for _, s := range sent {
+		got = append(got, s.Chat)
+	}
+
+	sort.Strings(got)
+	sort.Strings(chats)
+
+	if strings.Join(got, ",") != strings.Join(chats, ",") {
+		t.Errorf("%s got messages to chats %v instead of %v", messenger, got, chats)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	messengers := []metachat.Messenger{metachattest.NewMessenger("a"), metachattest.NewMessenger("b")}
+
+	tests := []struct {
+		name   string
+		config metachat.Config
+		err    string
+	}{
+		{
+			name:   "valid",
+			config: metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("B", "2"))}},
+		},
+		{
+			name:   "unknown messenger",
+			config: metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("c", "2"))}},
+			err:    "messenger 'c' from room 'team' not found",
+		},
+		{
+			name:   "duplicate chat",
+			config: metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("A", "1"))}},
+			err:    "chat '1' of messenger 'A' is listed twice in room 'team'",
+		},
+		{
+			name:   "duplicate room",
+			config: metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1")), room("Team", chat("b", "2"))}},
+			err:    "room name 'Team' is not unique",
+		},
+		{
+			name: "unknown direction",
+			config: metachat.Config{Rooms: []metachat.Room{room("team",
+				metachat.Chat{Messenger: "a", ID: "1", Direction: "sideways"})}},
+			err: "unknown direction 'sideways' of chat '1' from room 'team'",
+		},
+		{
+			name:   "unknown messenger type",
+			config: metachat.Config{Instances: []metachat.MessengerConfig{{Name: "c", Type: "carrier-pigeon"}}},
+			err:    "unknown type 'carrier-pigeon' of messenger 'c'",
+		},
+		{
+			name:   "unknown admin messenger",
+			config: metachat.Config{Admins: []metachat.Admin{{Messenger: "c", ID: "alice"}}},
+			err:    "messenger 'c' of admin 'alice' not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Port = 8080
+			test.config.Messengers = messengers
+
+			err := metachat.Validate(test.config)
+			if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("got %v instead of %q", err, test.err)
+			}
+		})
+	}
+
+	if err := metachat.Validate(metachat.Config{Messengers: messengers}); err == nil {
+		t.Error("configuration without a port is valid")
+	}
+}
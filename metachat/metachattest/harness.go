@@ -0,0 +1,232 @@
+package metachattest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+type (
+	// Harness is a running Metachat. Close stops it along with the fake messengers.
+	Harness struct {
+		Metachat *metachat.Metachat
+		URL      string
+
+		messengers map[string]*Messenger
+		done       chan struct{}
+		err        error
+	}
+
+	// RoomStore is an in-memory metachat.RoomStore.
+	RoomStore struct {
+		sync.Mutex
+		rooms []metachat.Room
+		err   error
+	}
+)
+
+// Start starts Metachat with the configuration. Every messenger the rooms refer to that isn't
+// in config.Messengers gets a fake messenger, and a free port is used if config.Port is unset.
+// Start returns once the HTTP server is ready.
+func Start(config metachat.Config) (*Harness, error) {
+	h := &Harness{messengers: make(map[string]*Messenger), done: make(chan struct{})}
+
+	for _, messenger := range config.Messengers {
+		switch fake := messenger.(type) {
+		case *Messenger:
+			h.messengers[niceName(fake.Name())] = fake
+
+		case *EditableMessenger:
+			h.messengers[niceName(fake.Name())] = fake.Messenger
+		}
+	}
+
+	config.Messengers = append([]metachat.Messenger(nil), config.Messengers...)
+	for _, room := range config.Rooms {
+		for _, chat := range room.Chats {
+			if _, ok := h.messengers[niceName(chat.Messenger)]; !ok && !configured(config, chat.Messenger) {
+				fake := NewMessenger(chat.Messenger)
+				h.messengers[niceName(chat.Messenger)] = fake
+				config.Messengers = append(config.Messengers, fake)
+			}
+		}
+	}
+
+	if config.Port == 0 {
+		port, err := freePort()
+		if err != nil {
+			return nil, err
+		}
+
+		config.Port = port
+	}
+
+	meta, err := metachat.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Metachat = meta
+	h.URL = "http://127.0.0.1:" + strconv.Itoa(config.Port)
+
+	go func() {
+		h.err = meta.Start()
+		close(h.done)
+	}()
+
+	err = h.waitReady()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Close stops Metachat and the fake messengers and waits for Metachat to stop.
+func (h *Harness) Close() error {
+	err := h.Metachat.Stop()
+	for _, messenger := range h.messengers {
+		messenger.Stop(nil)
+	}
+
+	if waitErr := h.Wait(Timeout); err == nil {
+		err = waitErr
+	}
+
+	return err
+}
+
+// Messenger returns the fake messenger with the ID or nil if there's no such fake.
+func (h *Harness) Messenger(id string) *Messenger {
+	return h.messengers[niceName(id)]
+}
+
+// Post posts the message to the room with the Metachat HTTP API.
+func (h *Harness) Post(room string, msg metachat.Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := http.Post(h.URL+"/rooms/"+url.PathEscape(room), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got %s from room '%s'", resp.Status, room)
+	}
+
+	return nil
+}
+
+// Wait waits for Metachat to stop and returns its error, e.g. after a fake messenger is stopped.
+func (h *Harness) Wait(timeout time.Duration) error {
+	select {
+	case <-h.done:
+		return h.err
+
+	case <-time.After(timeout):
+		return errors.Errorf("metachat is still running after %s", timeout)
+	}
+}
+
+func (h *Harness) waitReady() error {
+	deadline := time.Now().Add(Timeout)
+	for {
+		resp, err := http.Get(h.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+
+		select {
+		case <-h.done:
+			if h.err != nil {
+				return h.err
+			}
+
+			return errors.New("metachat stopped before its HTTP server was ready")
+
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			return errors.Wrap(err, "metachat HTTP server didn't start")
+		}
+	}
+}
+
+// Load returns the saved rooms.
+func (s *RoomStore) Load() ([]metachat.Room, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]metachat.Room(nil), s.rooms...), nil
+}
+
+// Fail makes Save return the error without saving the rooms, nil makes it save them again.
+func (s *RoomStore) Fail(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.err = err
+}
+
+// Save replaces the saved rooms.
+func (s *RoomStore) Save(rooms []metachat.Room) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.rooms = append([]metachat.Room(nil), rooms...)
+
+	return nil
+}
+
+func configured(config metachat.Config, id string) bool {
+	for _, messenger := range config.Messengers {
+		if niceName(messenger.Name()) == niceName(id) {
+			return true
+		}
+	}
+
+	for _, instance := range config.Instances {
+		if niceName(instance.Name) == niceName(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// niceName matches the messenger ID normalization of Metachat.
+func niceName(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "-", -1))
+}
@@ -0,0 +1,301 @@
+// Package metachattest provides an in-memory fake messenger and a harness running Metachat with fakes,
+// so that routing, commands and delivery can be tested without messenger accounts.
+//
+//	h, err := metachattest.Start(metachat.Config{Rooms: []metachat.Room{{Name: "team", Chats: []metachat.Chat{
+//		{Messenger: "a", ID: "1"}, {Messenger: "b", ID: "2"}}}}})
+//
+//	h.Messenger("a").Receive("1", "alice", "hello")
+//	sent, err := h.Messenger("b").WaitSent(1, metachattest.Timeout)
+package metachattest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// Timeout is a reasonable time to wait for a delivery.
+const Timeout = 5 * time.Second
+
+type (
+	// Sent is a message sent to a fake messenger. Edited is the ID of the message it replaces, if any,
+	// Uploaded reports whether it's sent as a file.
+	Sent struct {
+		Chat     string
+		Message  metachat.Message
+		ID       string
+		Edited   string
+		Uploaded bool
+	}
+
+	// Messenger is a fake messenger recording the sent messages. Limits are its rate limits,
+	// no limits are applied by default. Length is its maximum message length, messages aren't split
+	// if it's zero. Handler is returned as its webhook handler.
+	Messenger struct {
+		Limits  []metachat.RateLimit
+		Length  int
+		Handler http.Handler
+
+		id          string
+		messageChan chan metachat.Message
+		stop        chan error
+		lock        sync.Mutex
+		changed     chan struct{}
+		sent        []Sent
+		joined      []string
+		failures    []error
+		lastID      int
+	}
+
+	// EditableMessenger is a fake messenger supporting edits.
+	EditableMessenger struct {
+		*Messenger
+	}
+
+	// CheckingMessenger is a fake messenger checking its credentials. Visible lists the chats it sees,
+	// Err is returned as the result of the check.
+	CheckingMessenger struct {
+		*Messenger
+		Visible []string
+		Err     error
+	}
+
+	// UploadingMessenger is a fake messenger uploading the messages over its Length.
+	UploadingMessenger struct {
+		*Messenger
+	}
+)
+
+// NewMessenger is a fake messenger constructor.
+func NewMessenger(id string) *Messenger {
+	return &Messenger{
+		id:          id,
+		messageChan: make(chan metachat.Message, 100),
+		stop:        make(chan error, 1),
+		changed:     make(chan struct{}),
+	}
+}
+
+// NewEditableMessenger is a fake editable messenger constructor.
+func NewEditableMessenger(id string) *EditableMessenger {
+	return &EditableMessenger{Messenger: NewMessenger(id)}
+}
+
+// NewCheckingMessenger is a fake checking messenger constructor.
+func NewCheckingMessenger(id string, visible ...string) *CheckingMessenger {
+	return &CheckingMessenger{Messenger: NewMessenger(id), Visible: visible}
+}
+
+// NewUploadingMessenger is a fake uploading messenger constructor.
+func NewUploadingMessenger(id string) *UploadingMessenger {
+	return &UploadingMessenger{Messenger: NewMessenger(id)}
+}
+
+// Name returns the messenger instance ID.
+func (m *Messenger) Name() string {
+	return m.id
+}
+
+// MessageChan returns a read-only message channel.
+func (m *Messenger) MessageChan() <-chan metachat.Message {
+	return m.messageChan
+}
+
+// Webhook returns the Handler.
+func (m *Messenger) Webhook() http.Handler {
+	return m.Handler
+}
+
+// Start blocks until Stop is called.
+func (m *Messenger) Start() error {
+	return <-m.stop
+}
+
+// Stop makes Start return the error. Only the first call has an effect.
+func (m *Messenger) Stop(err error) {
+	select {
+	case m.stop <- err:
+	default:
+	}
+}
+
+// Send records the message unless a failure is queued.
+func (m *Messenger) Send(msg metachat.Message, chat string) error {
+	_, err := m.record(Sent{Chat: chat, Message: msg})
+
+	return err
+}
+
+// RateLimits returns the Limits.
+func (m *Messenger) RateLimits(chat string) []metachat.RateLimit {
+	return m.Limits
+}
+
+// MaxLength returns the Length.
+func (m *Messenger) MaxLength() int {
+	return m.Length
+}
+
+// Join records the joined chats.
+func (m *Messenger) Join(chats []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.joined = append(m.joined, chats...)
+}
+
+// Joined returns the chats joined so far.
+func (m *Messenger) Joined() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]string(nil), m.joined...)
+}
+
+// Receive injects an incoming message from the chat.
+func (m *Messenger) Receive(chat, author, text string) {
+	m.Inject(metachat.Message{Chat: chat, Author: author, Text: text})
+}
+
+// Inject injects an incoming message. Messenger is set to the messenger ID if it's empty.
+func (m *Messenger) Inject(msg metachat.Message) {
+	if msg.Messenger == "" {
+		msg.Messenger = m.id
+	}
+
+	m.messageChan <- msg
+}
+
+// Fail makes the next sends fail with the errors, one error per attempt.
+func (m *Messenger) Fail(errs ...error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.failures = append(m.failures, errs...)
+}
+
+// Sent returns the messages sent so far.
+func (m *Messenger) Sent() []Sent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]Sent(nil), m.sent...)
+}
+
+// Reset forgets the sent messages.
+func (m *Messenger) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sent = nil
+}
+
+// WaitSent waits until at least count messages are sent and returns them.
+func (m *Messenger) WaitSent(count int, timeout time.Duration) ([]Sent, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		m.lock.Lock()
+		sent := append([]Sent(nil), m.sent...)
+		changed := m.changed
+		m.lock.Unlock()
+
+		if len(sent) >= count {
+			return sent, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return sent, errors.Errorf("%s got %d messages instead of %d in %s", m.id, len(sent), count, timeout)
+		}
+	}
+}
+
+// ExpectNone waits for the duration and returns an error if anything is sent meanwhile.
+func (m *Messenger) ExpectNone(duration time.Duration) error {
+	sent, err := m.WaitSent(1, duration)
+	if err != nil {
+		return nil
+	}
+
+	return errors.Errorf("%s got an unexpected message '%s' to chat '%s'", m.id, sent[0].Text(), sent[0].Chat)
+}
+
+func (m *Messenger) record(sent Sent) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.failures) > 0 {
+		err := m.failures[0]
+		m.failures = m.failures[1:]
+
+		return "", err
+	}
+
+	sent.ID = sent.Edited
+	if sent.ID == "" {
+		m.lastID++
+		sent.ID = strconv.Itoa(m.lastID)
+	}
+
+	m.sent = append(m.sent, sent)
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	return sent.ID, nil
+}
+
+// SendEditable records the message and returns its ID.
+func (m *EditableMessenger) SendEditable(msg metachat.Message, chat string) (string, error) {
+	return m.record(Sent{Chat: chat, Message: msg})
+}
+
+// Edit records the message as a replacement of the message with the provided ID.
+func (m *EditableMessenger) Edit(msg metachat.Message, chat, id string) error {
+	_, err := m.record(Sent{Chat: chat, Message: msg, Edited: id})
+
+	return err
+}
+
+// CheckCredentials reports which of the chats are Visible, or Err if it's set.
+func (m *CheckingMessenger) CheckCredentials(chats []string) (map[string]bool, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	result := make(map[string]bool, len(chats))
+	for _, chat := range chats {
+		result[chat] = false
+		for _, visible := range m.Visible {
+			if chat == visible {
+				result[chat] = true
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// UploadLong reports true, messages over the Length are uploaded.
+func (m *UploadingMessenger) UploadLong() bool {
+	return true
+}
+
+// Upload records the message as uploaded.
+func (m *UploadingMessenger) Upload(msg metachat.Message, chat string) error {
+	_, err := m.record(Sent{Chat: chat, Message: msg, Uploaded: true})
+
+	return err
+}
+
+// Text returns the message text without the Metachat origin marker.
+func (s Sent) Text() string {
+	return strings.TrimSuffix(s.Message.Text, metachat.OriginMarker)
+}
@@ -0,0 +1,249 @@
+package metachat
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	pairCommand    = "metachat pair"
+	pairingCodeTTL = 10 * time.Minute
+
+	// maxPairingFailures is the number of invalid pairing codes a chat may post within pairingCodeTTL.
+	maxPairingFailures = 5
+)
+
+type (
+	// Admin is an account allowed to link chats with pairing codes. ID is the account ID of the admin
+	// on the messenger, the one messages have as AuthorID: the user ID on Slack, Telegram, Discord,
+	// Mattermost and Rocket.Chat, the Skype ID, the Matrix user ID like @alice:example.org, the address
+	// on mail and the nick on IRC and XMPP, where it's only as reliable as the nick registration.
+	Admin struct {
+		Messenger string `json:"messenger" required:"true"`
+		ID        string `json:"id" required:"true"`
+	}
+
+	pairing struct {
+		chat    Chat
+		expires time.Time
+	}
+
+	// pairingFailures counts the invalid pairing codes posted in a chat until the reset time.
+	pairingFailures struct {
+		count int
+		reset time.Time
+	}
+)
+
+// handlePairCommand either issues a new pairing code for the chat the message came from
+// or, if the message contains a code, links the chat with the one the code was issued for.
+// Only admins can use the command.
+func (m *Metachat) handlePairCommand(msg Message) error {
+	if msg.AuthorID == "" || !m.admins[newAccount(msg.Messenger, msg.AuthorID)] {
+		return m.reply(msg, "Only admins can link chats.")
+	}
+
+	code := strings.TrimSpace(strings.TrimPrefix(msg.Text, pairCommand))
+	if code == "" {
+		return m.issuePairingCode(msg)
+	}
+
+	return m.usePairingCode(msg, code)
+}
+
+func (m *Metachat) issuePairingCode(msg Message) error {
+	m.removeExpiredPairings()
+
+	code, err := newPairingCode()
+	if err != nil {
+		return err
+	}
+
+	m.pairings[code] = pairing{
+		chat:    Chat{Messenger: msg.Messenger, ID: msg.Chat},
+		expires: time.Now().Add(pairingCodeTTL),
+	}
+
+	return m.reply(msg, fmt.Sprintf("Post '%s %s' in the chat you want to link within %d minutes.",
+		pairCommand, code, int(pairingCodeTTL.Minutes())))
+}
+
+func (m *Metachat) usePairingCode(msg Message, code string) error {
+	m.removeExpiredPairings()
+
+	chat := Chat{Messenger: msg.Messenger, ID: msg.Chat}
+	if failures := m.pairingFailures[chat.key()]; failures.count >= maxPairingFailures {
+		return m.reply(msg, "Too many invalid pairing codes, try again later.")
+	}
+
+	p, ok := m.pairings[code]
+	if !ok {
+		failures := m.pairingFailures[chat.key()]
+		if failures.count == 0 {
+			failures.reset = time.Now().Add(pairingCodeTTL)
+		}
+
+		failures.count++
+		m.pairingFailures[chat.key()] = failures
+
+		return m.reply(msg, "Pairing code is invalid or expired.")
+	}
+
+	if p.chat.key() == chat.key() {
+		return m.reply(msg, "Pairing code must be used in another chat.")
+	}
+
+	if niceName(p.chat.Messenger) == niceName(chat.Messenger) {
+		return m.reply(msg, "Pairing code must be used in a chat on another messenger.")
+	}
+
+	name, err := m.linkChats(p.chat, chat)
+	if err != nil {
+		m.logError(err)
+		return m.reply(msg, "Couldn't save the room, the chats aren't linked.")
+	}
+
+	delete(m.pairings, code)
+
+	return m.reply(msg, fmt.Sprintf("Chat is linked to room '%s'.", name))
+}
+
+// linkChats adds both chats to the same room and persists the change. An existing room of
+// the first chat is preferred, then the one of the second chat, otherwise a new room is created.
+// Only the rooms created and the chats added at runtime are stored, so that later changes
+// of the configured rooms take effect. If the rooms can't be saved, the change is rolled back,
+// otherwise the messengers that are Joiners join the chats.
+func (m *Metachat) linkChats(first, second Chat) (string, error) {
+	m.roomsLock.Lock()
+	defer m.roomsLock.Unlock()
+
+	name, ok := m.findRoom(first)
+	if !ok {
+		name, ok = m.findRoom(second)
+	}
+
+	if !ok {
+		name = m.uniqueRoomName(niceName(first.Messenger + "-" + first.ID))
+		m.rooms[name] = Room{Name: name}
+	}
+
+	room := m.rooms[name]
+	stored, wasStored := m.stored[name]
+	previous, previousStored := room, stored
+	stored.Name = room.Name
+
+	for _, chat := range []Chat{first, second} {
+		if !room.contains(chat) {
+			room.Chats = append(room.Chats, chat)
+			stored.Chats = append(stored.Chats, chat)
+		}
+	}
+
+	m.rooms[name] = room
+	m.stored[name] = stored
+	m.buildIndex()
+
+	if m.store != nil {
+		if err := m.store.Save(m.storedRooms()); err != nil {
+			m.rooms[name] = previous
+			if !ok {
+				delete(m.rooms, name)
+			}
+
+			m.stored[name] = previousStored
+			if !wasStored {
+				delete(m.stored, name)
+			}
+
+			m.buildIndex()
+
+			return "", err
+		}
+	}
+
+	for _, chat := range []Chat{first, second} {
+		if joiner, ok := m.messengers[niceName(chat.Messenger)].(Joiner); ok {
+			joiner.Join([]string{chat.ID})
+		}
+	}
+
+	return name, nil
+}
+
+func (m *Metachat) findRoom(chat Chat) (string, bool) {
+	for name, room := range m.rooms {
+		if room.contains(chat) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// uniqueRoomName returns the name or the name with the smallest numeric suffix no room has.
+func (m *Metachat) uniqueRoomName(name string) string {
+	result := name
+	for i := 2; ; i++ {
+		if _, ok := m.rooms[result]; !ok {
+			return result
+		}
+
+		result = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+func (m *Metachat) storedRooms() []Room {
+	names := make([]string, 0, len(m.stored))
+	for name := range m.stored {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	result := make([]Room, 0, len(names))
+	for _, name := range names {
+		result = append(result, m.stored[name])
+	}
+
+	return result
+}
+
+func (m *Metachat) removeExpiredPairings() {
+	now := time.Now()
+	for code, p := range m.pairings {
+		if now.After(p.expires) {
+			delete(m.pairings, code)
+		}
+	}
+
+	for key, failures := range m.pairingFailures {
+		if now.After(failures.reset) {
+			delete(m.pairingFailures, key)
+		}
+	}
+}
+
+func (r Room) contains(chat Chat) bool {
+	for _, c := range r.Chats {
+		if c.key() == chat.key() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,250 @@
+package metachat_test
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/metachat/metachattest"
+)
+
+var pairingCodeRegexp = regexp.MustCompile(`metachat pair (\d{6})`)
+
+var pairingAdmins = []metachat.Admin{{Messenger: "a", ID: "U1"}, {Messenger: "b", ID: "U2"}}
+
+func TestPairCommandLinksChats(t *testing.T) {
+	store := &metachattest.RoomStore{}
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("c", "3"))},
+		Messengers: []metachat.Messenger{metachattest.NewMessenger("b")},
+		RoomStore:  store,
+		Admins:     pairingAdmins,
+	})
+
+	code := issuePairingCode(t, h, "a", "1")
+
+	reply := postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Chat is linked to room 'team'." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	if joined := h.Messenger("b").Joined(); len(joined) != 1 || joined[0] != "2" {
+		t.Errorf("linked chat isn't joined: %q", joined)
+	}
+
+	h.Messenger("b").Receive("2", "bob", "hello")
+
+	sent := waitSent(t, h.Messenger("a"), 1)
+	if sent[0].Chat != "1" || sent[0].Text() != "hello" {
+		t.Errorf("unexpected delivery %+v", sent[0])
+	}
+
+	rooms, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rooms) != 1 || rooms[0].Name != "team" || len(rooms[0].Chats) != 1 || rooms[0].Chats[0].ID != "2" {
+		t.Errorf("stored rooms %+v aren't just the linked chat", rooms)
+	}
+
+	reply = postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Pairing code is invalid or expired." {
+		t.Errorf("code is accepted twice: %q", reply)
+	}
+}
+
+func TestPairCommandCreatesUniqueRoom(t *testing.T) {
+	store := &metachattest.RoomStore{}
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("a-1", chat("c", "3"), chat("d", "4"))},
+		Messengers: []metachat.Messenger{metachattest.NewMessenger("a"), metachattest.NewMessenger("b")},
+		RoomStore:  store,
+		Admins:     pairingAdmins,
+	})
+
+	code := issuePairingCode(t, h, "a", "1")
+
+	reply := postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Chat is linked to room 'a-1-2'." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	h.Messenger("c").Receive("3", "carol", "hello")
+	waitSent(t, h.Messenger("d"), 1)
+	expectNone(t, h.Messenger("a"))
+	expectNone(t, h.Messenger("b"))
+}
+
+func TestPairCommandRequiresAdmin(t *testing.T) {
+	h := startHarness(t, metachat.Config{
+		Rooms:  []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Admins: pairingAdmins,
+	})
+
+	tests := []struct {
+		name     string
+		authorID string
+	}{
+		{name: "no account ID"},
+		{name: "admin of another messenger", authorID: "U2"},
+		{name: "not an admin", authorID: "U3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := postCommand(t, h, "a", "1", test.authorID, "metachat pair")
+			if reply != "Only admins can link chats." {
+				t.Errorf("unexpected reply %q", reply)
+			}
+		})
+	}
+}
+
+func TestPairCommandLimitsFailures(t *testing.T) {
+	h := startHarness(t, metachat.Config{
+		Rooms:  []metachat.Room{room("team", chat("a", "1"), chat("b", "2"))},
+		Admins: pairingAdmins,
+	})
+
+	code := issuePairingCode(t, h, "a", "1")
+	wrong := fmt.Sprintf("%06d", (atoi(t, code)+1)%1000000)
+
+	for i := 0; i < 5; i++ {
+		reply := postCommand(t, h, "b", "2", "U2", "metachat pair "+wrong)
+		if reply != "Pairing code is invalid or expired." {
+			t.Fatalf("unexpected reply %q to attempt %d", reply, i+1)
+		}
+	}
+
+	reply := postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Too many invalid pairing codes, try again later." {
+		t.Errorf("valid code is accepted after too many failures: %q", reply)
+	}
+}
+
+func TestPairCommandRejectsSameChat(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"))},
+		Admins: pairingAdmins[:1]})
+
+	code := issuePairingCode(t, h, "a", "1")
+
+	reply := postCommand(t, h, "a", "1", "U1", "metachat pair "+code)
+	if reply != "Pairing code must be used in another chat." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestPairCommandRejectsSameMessenger(t *testing.T) {
+	h := startHarness(t, metachat.Config{Rooms: []metachat.Room{room("team", chat("a", "1"), chat("a", "2"))},
+		Admins: pairingAdmins[:1]})
+
+	code := issuePairingCode(t, h, "a", "1")
+
+	reply := postCommand(t, h, "a", "2", "U1", "metachat pair "+code)
+	if reply != "Pairing code must be used in a chat on another messenger." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestPairCommandSurvivesStoreFailure(t *testing.T) {
+	store := &metachattest.RoomStore{}
+	store.Fail(errors.New("disk is full"))
+
+	h := startHarness(t, metachat.Config{
+		Rooms:      []metachat.Room{room("team", chat("a", "1"), chat("c", "3"))},
+		Messengers: []metachat.Messenger{metachattest.NewMessenger("b")},
+		RoomStore:  store,
+		Admins:     pairingAdmins,
+	})
+
+	code := issuePairingCode(t, h, "a", "1")
+
+	reply := postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Couldn't save the room, the chats aren't linked." {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	h.Messenger("b").Receive("2", "bob", "hello")
+	expectNone(t, h.Messenger("a"))
+
+	store.Fail(nil)
+
+	reply = postCommand(t, h, "b", "2", "U2", "metachat pair "+code)
+	if reply != "Chat is linked to room 'team'." {
+		t.Errorf("code isn't accepted after the store recovers: %q", reply)
+	}
+
+	h.Messenger("b").Receive("2", "bob", "hello")
+	waitSent(t, h.Messenger("a"), 1)
+}
+
+func TestStoredRoomsExtendConfiguredRooms(t *testing.T) {
+	store := &metachattest.RoomStore{}
+	err := store.Save([]metachat.Room{room("team", chat("b", "2")), room("extra", chat("c", "3"), chat("d", "4"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := startHarness(t, metachat.Config{
+		Rooms: []metachat.Room{room("team", chat("a", "1"), chat("e", "5"))},
+		Messengers: []metachat.Messenger{metachattest.NewMessenger("b"), metachattest.NewMessenger("c"),
+			metachattest.NewMessenger("d")},
+		RoomStore: store,
+	})
+
+	h.Messenger("a").Receive("1", "alice", "hello")
+
+	waitSent(t, h.Messenger("b"), 1)
+	waitSent(t, h.Messenger("e"), 1)
+	expectNone(t, h.Messenger("c"))
+
+	h.Messenger("c").Receive("3", "carol", "hi")
+	waitSent(t, h.Messenger("d"), 1)
+}
+
+// issuePairingCode requests a pairing code in the chat as an admin and returns it.
+func issuePairingCode(t *testing.T, h *metachattest.Harness, messenger, chat string) string {
+	t.Helper()
+
+	reply := postCommand(t, h, messenger, chat, "U1", "metachat pair")
+
+	groups := pairingCodeRegexp.FindStringSubmatch(reply)
+	if groups == nil {
+		t.Fatalf("reply %q has no pairing code", reply)
+	}
+
+	return groups[1]
+}
+
+// postCommand posts the command to the chat from the account and returns the reply.
+func postCommand(t *testing.T, h *metachattest.Harness, messenger, chat, authorID, text string) string {
+	t.Helper()
+
+	fake := h.Messenger(messenger)
+	fake.Reset()
+	fake.Inject(metachat.Message{Chat: chat, Author: "admin", AuthorID: authorID, Text: text})
+
+	reply := waitSent(t, fake, 1)
+	fake.Reset()
+
+	if reply[0].Chat != chat {
+		t.Errorf("reply is sent to chat '%s' instead of '%s'", reply[0].Chat, chat)
+	}
+
+	return reply[0].Text()
+}
+
+func atoi(t *testing.T, s string) int {
+	t.Helper()
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
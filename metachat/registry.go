@@ -0,0 +1,158 @@
+package metachat
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Factory creates a messenger instance from its JSON configuration. The created messenger
+	// must return the provided ID from Name and use it as Message.Messenger.
+	Factory func(id string, config json.RawMessage) (Messenger, error)
+
+	// MessengerConfig is a configuration of a messenger instance. Name is the instance ID that chats
+	// refer to, so several instances of the same type can be bridged. The type-specific settings are placed
+	// in the same JSON object next to the name and the type, e.g. {"name":"corp-slack","type":"slack","token":"..."}.
+	MessengerConfig struct {
+		Name     string          `json:"name" required:"true"`
+		Type     string          `json:"type" required:"true"`
+		Settings json.RawMessage `json:"-"`
+	}
+
+	// Converter exposes the message conversions of a messenger type, so that all types can be checked
+	// against the same set of messages. ToNative returns the payload sent to the platform, FromNative
+	// converts a payload received from the platform. Payloads are JSON for JSON APIs and raw text
+	// for text protocols.
+	Converter interface {
+		ToNative(Message) ([]byte, error)
+		FromNative([]byte) (Message, error)
+	}
+
+	registry struct {
+		sync.RWMutex
+		factories  map[string]Factory
+		configs    map[string]reflect.Type
+		converters map[string]Converter
+	}
+)
+
+var factories = &registry{
+	factories:  make(map[string]Factory),
+	configs:    make(map[string]reflect.Type),
+	converters: make(map[string]Converter),
+}
+
+// Register makes a messenger type available by the provided name. Messenger packages call it from init,
+// so importing a package is enough to make its type configurable. Config is a zero value of the type's
+// configuration structure, it describes the settings accepted in configuration files.
+// It panics if the name is already taken.
+func Register(typeName string, factory Factory, config interface{}) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	if factory == nil {
+		panic("metachat: Register factory is nil")
+	}
+
+	if _, ok := factories.factories[niceName(typeName)]; ok {
+		panic("metachat: Register called twice for messenger type " + typeName)
+	}
+
+	factories.factories[niceName(typeName)] = factory
+	factories.configs[niceName(typeName)] = reflect.TypeOf(config)
+}
+
+// RegisterConverter makes the conversions of a registered messenger type available for conformance checks.
+// It panics if the type isn't registered or already has a converter.
+func RegisterConverter(typeName string, converter Converter) {
+	factories.Lock()
+	defer factories.Unlock()
+
+	if _, ok := factories.factories[niceName(typeName)]; !ok {
+		panic("metachat: RegisterConverter called for unknown messenger type " + typeName)
+	}
+
+	if _, ok := factories.converters[niceName(typeName)]; ok {
+		panic("metachat: RegisterConverter called twice for messenger type " + typeName)
+	}
+
+	factories.converters[niceName(typeName)] = converter
+}
+
+// ConverterOf returns the converter of the messenger type.
+func ConverterOf(typeName string) (Converter, bool) {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	converter, ok := factories.converters[niceName(typeName)]
+
+	return converter, ok
+}
+
+// Types returns the sorted names of the registered messenger types.
+func Types() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	result := make([]string, 0, len(factories.factories))
+	for typeName := range factories.factories {
+		result = append(result, typeName)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// ConfigType returns the type of the configuration structure of the messenger type.
+func ConfigType(typeName string) (reflect.Type, bool) {
+	factories.RLock()
+	defer factories.RUnlock()
+
+	configType, ok := factories.configs[niceName(typeName)]
+
+	return configType, ok
+}
+
+// NewMessenger creates a messenger instance using the factory registered for its type.
+func NewMessenger(config MessengerConfig) (Messenger, error) {
+	factories.RLock()
+	factory, ok := factories.factories[niceName(config.Type)]
+	factories.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown type '%s' of messenger '%s'", config.Type, config.Name)
+	}
+
+	settings := config.Settings
+	if len(settings) == 0 {
+		settings = json.RawMessage("{}")
+	}
+
+	messenger, err := factory(config.Name, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create messenger '%s'", config.Name)
+	}
+
+	return messenger, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *MessengerConfig) UnmarshalJSON(data []byte) error {
+	type plain MessengerConfig
+
+	var value plain
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	*c = MessengerConfig(value)
+	c.Settings = append(json.RawMessage(nil), data...)
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package metachat
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// splitReserve is the part of the length limit left for what a messenger adds to every part besides
+// the author name: the prefix markup, at most 7 characters like "**[]** " on Mattermost, the 3 characters
+// of OriginMarker, and the markup of the tags reopened in the part, e.g. the 8 characters of "```\n"
+// and "\n```" around a preformatted block. The remaining 14 characters cover a few emphasis markers.
+const splitReserve = 32
+
+const (
+	// Characters count the length of a text in Unicode code points.
+	Characters LengthUnit = iota
+
+	// UTF16Units count the length of a text in UTF-16 code units, so characters outside
+	// the Basic Multilingual Plane, like most emoji, are two units long.
+	UTF16Units
+)
+
+type (
+	// LengthLimited is implemented by messengers with a maximum message length. MaxLength is counted
+	// in characters of the message text as the recipients see it, or in the units the messenger reports
+	// as a LengthCounter. Longer messages are split.
+	LengthLimited interface {
+		MaxLength() int
+	}
+
+	// LengthUnit is the unit a maximum message length is counted in.
+	LengthUnit int
+
+	// LengthCounter is implemented by LengthLimited messengers counting MaxLength in other units than characters.
+	LengthCounter interface {
+		LengthUnit() LengthUnit
+	}
+
+	// Uploader is implemented by messengers able to send a message as a text file attachment. If UploadLong
+	// reports true, messages over the length limit are uploaded instead of being split, except the ones
+	// sent with an Editor, since an attachment can't be edited.
+	Uploader interface {
+		UploadLong() bool
+		Upload(Message, string) error
+	}
+
+	// openTag is a Metachat tag open at some position of a text.
+	openTag struct {
+		name   string
+		marker string
+	}
+)
+
+var tagMarkerRegexp = regexp.MustCompile(`^#\{(bold|italic|strikethrough|underline|spoiler|preformatted|mention|edit|` +
+	`quote)(?: (?:author|id)=[^}]*)?\}`)
+
+// splitMessage splits the message into parts not longer than the limit. It prefers to split at line breaks,
+// then at spaces, and never inside a mention. Tags spanning a split are closed at the end of a part and
+// opened again at the start of the next one, so every part is formatted as the original text was.
+func splitMessage(msg Message, limit int, unit LengthUnit) []Message {
+	budget := limit - unit.length(msg.Author) - splitReserve
+	if limit <= 0 || budget < 1 || unit.textLength(msg.Text) <= budget {
+		return []Message{msg}
+	}
+
+	var parts []Message
+	for text := msg.Text; text != ""; {
+		head := text
+		if unit.textLength(text) > budget {
+			head, text = splitText(text, budget, unit)
+		} else {
+			text = ""
+		}
+
+		if strings.TrimSpace(PlainText(head)) == "" {
+			continue
+		}
+
+		part := msg
+		part.Text = head
+		parts = append(parts, part)
+	}
+
+	return parts
+}
+
+// splitText cuts the longest head of the text that fits the budget. A line break is only preferred
+// in the second half of the budget, so that a short first line doesn't become a part of its own.
+func splitText(text string, budget int, unit LengthUnit) (string, string) {
+	var (
+		stack               []openTag
+		length, lineLength  int
+		lineCut, spaceCut   = -1, -1
+		lineTags, spaceTags []openTag
+		hardCut             = -1
+		hardTags            []openTag
+	)
+
+	for i := 0; i < len(text); {
+		if marker := tagMarkerRegexp.FindStringSubmatch(text[i:]); marker != nil {
+			stack = append(stack, openTag{name: marker[1], marker: marker[0]})
+			length += unit.decorationLength(marker[0])
+			i += len(marker[0])
+			continue
+		}
+
+		if n := len(stack); n > 0 && strings.HasPrefix(text[i:], "{"+stack[n-1].name+"}#") {
+			i += len(stack[n-1].name) + 3
+			stack = stack[:n-1]
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if length+unit.runeLength(r) > budget && hardCut >= 0 {
+			break
+		}
+
+		i += size
+		length += unit.runeLength(r)
+
+		if inMention(stack) {
+			continue
+		}
+
+		switch r {
+		case '\n':
+			lineCut, lineLength, lineTags = i, length, copyTags(stack)
+
+		case ' ':
+			spaceCut, spaceTags = i, copyTags(stack)
+		}
+
+		hardCut, hardTags = i, copyTags(stack)
+	}
+
+	cut, tags := hardCut, hardTags
+	switch {
+	case lineCut > 0 && lineLength > budget/2:
+		cut, tags = lineCut, lineTags
+
+	case spaceCut > 0:
+		cut, tags = spaceCut, spaceTags
+
+	case cut < 0:
+		// The budget ends inside the first mention, it's sent whole.
+		return text, ""
+	}
+
+	// Tags closed right at the cut stay in the head instead of being opened again empty.
+	for n := len(tags); n > 0 && strings.HasPrefix(text[cut:], "{"+tags[n-1].name+"}#"); n-- {
+		cut += len(tags[n-1].name) + 3
+		tags = tags[:n-1]
+	}
+
+	var head, tail strings.Builder
+	head.WriteString(strings.TrimRight(text[:cut], " \n"))
+	for i := len(tags) - 1; i >= 0; i-- {
+		head.WriteString("{" + tags[i].name + "}#")
+	}
+
+	for _, tag := range tags {
+		tail.WriteString(tag.marker)
+	}
+
+	tail.WriteString(text[cut:])
+
+	return head.String(), tail.String()
+}
+
+// decorationLength returns the length of what PlainText renders for the opening tag marker.
+func (u LengthUnit) decorationLength(marker string) int {
+	switch {
+	case strings.HasPrefix(marker, "#{mention"):
+		return len("@")
+
+	case marker == "#{edit}":
+		return len("Edit: ")
+
+	case strings.HasPrefix(marker, "#{quote author="):
+		return u.length(marker) - len("#{quote author=}") + len("> : \n\n")
+
+	default:
+		return 0
+	}
+}
+
+// textLength returns the length of the text as the recipients see it.
+func (u LengthUnit) textLength(text string) int {
+	return u.length(PlainText(text))
+}
+
+func (u LengthUnit) length(text string) int {
+	result := 0
+	for _, r := range text {
+		result += u.runeLength(r)
+	}
+
+	return result
+}
+
+func (u LengthUnit) runeLength(r rune) int {
+	if u == UTF16Units && r > 0xFFFF {
+		return 2
+	}
+
+	return 1
+}
+
+func inMention(stack []openTag) bool {
+	for _, tag := range stack {
+		if tag.name == "mention" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyTags(tags []openTag) []openTag {
+	return append([]openTag(nil), tags...)
+}
@@ -0,0 +1,133 @@
+package metachat_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		budget int
+		unit   metachat.LengthUnit
+		head   string
+		tail   string
+	}{
+		{name: "space", text: "hello world foo", budget: 12, head: "hello world", tail: "foo"},
+		{name: "early line break", text: "ab\ncdef ghij klmn", budget: 12, head: "ab\ncdef", tail: "ghij klmn"},
+		{name: "late line break", text: "abcdefg\nhij klm", budget: 10, head: "abcdefg", tail: "hij klm"},
+		{name: "no break", text: "abcdefghij", budget: 4, head: "abcd", tail: "efghij"},
+		{
+			name:   "nested tags",
+			text:   metachat.Bold("one " + metachat.Italic("two three")),
+			budget: 8,
+			head:   metachat.Bold("one " + metachat.Italic("two")),
+			tail:   metachat.Bold(metachat.Italic("three")),
+		},
+		{
+			name:   "tags closed at the cut",
+			text:   metachat.Bold("one two") + " three",
+			budget: 8,
+			head:   metachat.Bold("one two"),
+			tail:   "three",
+		},
+		{
+			name:   "preformatted lines",
+			text:   metachat.Preformatted("line one\nline two\nline three"),
+			budget: 12,
+			head:   metachat.Preformatted("line one"),
+			tail:   metachat.Preformatted("line two\nline three"),
+		},
+		{
+			name:   "preformatted word",
+			text:   metachat.Preformatted("abcdefghij"),
+			budget: 4,
+			head:   metachat.Preformatted("abcd"),
+			tail:   metachat.Preformatted("efghij"),
+		},
+		{
+			name:   "mention at the boundary",
+			text:   "hi " + metachat.Mention("alice smith") + " bye",
+			budget: 8,
+			head:   "hi",
+			tail:   metachat.Mention("alice smith") + " bye",
+		},
+		{
+			name:   "mention over the budget",
+			text:   metachat.Mention("alice smith"),
+			budget: 4,
+			head:   metachat.Mention("alice smith"),
+		},
+		{name: "multibyte", text: "привет мир", budget: 8, head: "привет", tail: "мир"},
+		{name: "emoji in characters", text: "😀😀😀😀 😀", budget: 3, head: "😀😀😀", tail: "😀 😀"},
+		{
+			name:   "emoji in UTF-16 units",
+			text:   "😀😀😀 😀😀",
+			budget: 8,
+			unit:   metachat.UTF16Units,
+			head:   "😀😀😀",
+			tail:   "😀😀",
+		},
+		{name: "odd UTF-16 budget", text: "😀😀😀", budget: 5, unit: metachat.UTF16Units, head: "😀😀", tail: "😀"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			head, tail := metachat.SplitText(test.text, test.budget, test.unit)
+			if head != test.head || tail != test.tail {
+				t.Errorf("got %q and %q instead of %q and %q", head, tail, test.head, test.tail)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		budget int
+		unit   metachat.LengthUnit
+		parts  []string
+	}{
+		{name: "short", text: "hello world", budget: 11, parts: []string{"hello world"}},
+		{name: "long", text: "one two three four", budget: 8, parts: []string{"one two", "three", "four"}},
+		{name: "blank part", text: "one     \n\n     two", budget: 4, parts: []string{"one", "two"}},
+		{
+			name:   "bold",
+			text:   metachat.Bold("one two three"),
+			budget: 8,
+			parts:  []string{metachat.Bold("one two"), metachat.Bold("three")},
+		},
+		{name: "emoji in characters", text: "😀😀😀 😀😀", budget: 8, parts: []string{"😀😀😀 😀😀"}},
+		{
+			name:   "emoji in UTF-16 units",
+			text:   "😀😀😀 😀😀",
+			budget: 8,
+			unit:   metachat.UTF16Units,
+			parts:  []string{"😀😀😀", "😀😀"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := metachat.Message{Author: "al", Text: test.text}
+			parts := metachat.SplitMessage(msg, len(msg.Author)+metachat.SplitReserve+test.budget, test.unit)
+
+			texts := make([]string, 0, len(parts))
+			for _, part := range parts {
+				if part.Author != msg.Author {
+					t.Errorf("part %+v has another author", part)
+				}
+
+				texts = append(texts, part.Text)
+			}
+
+			if strings.Join(texts, "|") != strings.Join(test.parts, "|") {
+				t.Errorf("got %q instead of %q", texts, test.parts)
+			}
+		})
+	}
+}
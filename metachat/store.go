@@ -0,0 +1,106 @@
+package metachat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// RoomStore persists the rooms created and the chats added to rooms at runtime.
+	RoomStore interface {
+		Load() ([]Room, error)
+		Save([]Room) error
+	}
+
+	// FileRoomStore is a RoomStore backed by a JSON file.
+	FileRoomStore struct {
+		sync.Mutex
+		path string
+	}
+
+	// FileIdentityStore is an IdentityStore backed by a JSON file.
+	FileIdentityStore struct {
+		sync.Mutex
+		path string
+	}
+)
+
+// NewFileRoomStore is a FileRoomStore constructor.
+func NewFileRoomStore(path string) *FileRoomStore {
+	return &FileRoomStore{path: path}
+}
+
+// Load reads rooms from the file. A missing file means there are no stored rooms.
+func (s *FileRoomStore) Load() ([]Room, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var rooms []Room
+
+	return rooms, readJSONFile(s.path, &rooms)
+}
+
+// Save writes rooms to the file, replacing its previous content.
+func (s *FileRoomStore) Save(rooms []Room) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return writeJSONFile(s.path, rooms)
+}
+
+// NewFileIdentityStore is a FileIdentityStore constructor.
+func NewFileIdentityStore(path string) *FileIdentityStore {
+	return &FileIdentityStore{path: path}
+}
+
+// Load reads identities from the file. A missing file means there are no stored identities.
+func (s *FileIdentityStore) Load() ([]Identity, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var identities []Identity
+
+	return identities, readJSONFile(s.path, &identities)
+}
+
+// Save writes identities to the file, replacing its previous content.
+func (s *FileIdentityStore) Save(identities []Identity) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return writeJSONFile(s.path, identities)
+}
+
+// readJSONFile unmarshals the file into value, a missing file leaves it unchanged.
+func readJSONFile(path string, value interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(json.Unmarshal(content, value))
+}
+
+// writeJSONFile replaces the file with the JSON representation of value.
+func writeJSONFile(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, path))
+}
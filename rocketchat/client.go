@@ -0,0 +1,360 @@
+package rocketchat
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const reconnectDelay = 5 * time.Second
+
+// maxLength is the default Rocket.Chat message length limit.
+const maxLength = 5000
+
+// maxSeenMessages is the number of recent messages whose edit time is remembered.
+const maxSeenMessages = 1000
+
+type (
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// Config structure. Token is a personal access token of the user with the provided ID.
+	Config struct {
+		ID         string     `json:"-"`
+		URL        string     `json:"url" required:"true"`
+		UserID     string     `json:"userID" required:"true"`
+		Token      string     `json:"token" required:"true"`
+		HTTPClient httpClient `json:"-"`
+	}
+
+	// Client is a Rocket.Chat client.
+	Client struct {
+		id          string
+		httpClient  httpClient
+		url         string
+		userID      string
+		token       string
+		seen        *messageLog
+		messageChan chan metachat.Message
+	}
+
+	// messageLog remembers the edit time of recent messages. The realtime API reports every change
+	// of a message, like reactions, thread replies and link previews, not only new messages and edits.
+	messageLog struct {
+		editedAt map[string]string
+		order    []string
+	}
+
+	message struct {
+		ID       string          `json:"_id"`
+		RoomID   string          `json:"rid"`
+		Text     string          `json:"msg"`
+		Type     string          `json:"t"`
+		EditedAt json.RawMessage `json:"editedAt"`
+		User     struct {
+			ID       string `json:"_id"`
+			Username string `json:"username"`
+			Name     string `json:"name"`
+		} `json:"u"`
+	}
+
+	// ddpMessage is a message of the Meteor DDP protocol used by the Rocket.Chat realtime API.
+	ddpMessage struct {
+		Msg        string        `json:"msg"`
+		ID         string        `json:"id,omitempty"`
+		Version    string        `json:"version,omitempty"`
+		Support    []string      `json:"support,omitempty"`
+		Method     string        `json:"method,omitempty"`
+		Name       string        `json:"name,omitempty"`
+		Params     []interface{} `json:"params,omitempty"`
+		Collection string        `json:"collection,omitempty"`
+		Fields     *struct {
+			Args []message `json:"args"`
+		} `json:"fields,omitempty"`
+		Error *struct {
+			Reason string `json:"reason"`
+		} `json:"error,omitempty"`
+	}
+
+	postMessageResponse struct {
+		Message message `json:"message"`
+	}
+)
+
+func init() {
+	metachat.Register("rocketchat", newMessenger, Config{})
+	metachat.RegisterConverter("rocketchat", converter{})
+}
+
+// NewClient is a Rocket.Chat client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" || config.UserID == "" || config.Token == "" {
+		return nil, errors.New("URL, user ID and token can't be nil")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Rocket.Chat"
+	}
+
+	client := &Client{
+		id:          id,
+		httpClient:  httpClient,
+		url:         strings.TrimSuffix(config.URL, "/"),
+		userID:      config.UserID,
+		token:       config.Token,
+		seen:        &messageLog{editedAt: make(map[string]string)},
+		messageChan: make(chan metachat.Message, 100),
+	}
+
+	err := client.do(http.MethodGet, "/api/v1/me", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Start listens to the realtime API and reconnects whenever the connection is lost.
+func (c *Client) Start() error {
+	for {
+		err := c.listen()
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// Send sends a message to room with the provided ID.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to room with the provided ID and returns the message ID.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
+	var result postMessageResponse
+	err := c.do(http.MethodPost, "/api/v1/chat.postMessage", map[string]string{
+		"roomId": chat,
+		"text":   convertToRocketChat(msg),
+	}, &result)
+
+	if err != nil {
+		return "", err
+	}
+
+	return result.Message.ID, nil
+}
+
+// Edit replaces the text of the message with the provided ID.
+func (c *Client) Edit(msg metachat.Message, chat, id string) error {
+	return c.do(http.MethodPost, "/api/v1/chat.update", map[string]string{
+		"roomId": chat,
+		"msgId":  id,
+		"text":   convertToRocketChat(msg),
+	}, nil)
+}
+
+// MaxLength returns the default Rocket.Chat message length limit.
+func (c *Client) MaxLength() int {
+	return maxLength
+}
+
+// CheckCredentials verifies the token and reports the rooms the bot has access to.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	err := c.do(http.MethodGet, "/api/v1/me", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		visible[chat] = c.do(http.MethodGet, "/api/v1/rooms.info?roomId="+url.QueryEscape(chat), nil, nil) == nil
+	}
+
+	return visible, nil
+}
+
+func (c *Client) listen() error {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(c.url, "http")+"/websocket", nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer conn.Close()
+
+	requests := []ddpMessage{
+		{Msg: "connect", Version: "1", Support: []string{"1"}},
+		{Msg: "method", ID: "login", Method: "login", Params: []interface{}{map[string]string{"resume": c.token}}},
+		{Msg: "sub", ID: "messages", Name: "stream-room-messages", Params: []interface{}{"__my_messages__", false}},
+	}
+
+	for _, req := range requests {
+		err = conn.WriteJSON(req)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	for {
+		var resp ddpMessage
+		err = conn.ReadJSON(&resp)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch resp.Msg {
+		case "ping":
+			err = conn.WriteJSON(ddpMessage{Msg: "pong"})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+		case "result", "nosub":
+			if resp.Error != nil {
+				return errors.Errorf("realtime API request '%s' failed: %s", resp.ID, resp.Error.Reason)
+			}
+
+		case "changed":
+			if resp.Collection != "stream-room-messages" || resp.Fields == nil {
+				continue
+			}
+
+			for _, msg := range resp.Fields.Args {
+				if msg.Text == "" || msg.Type != "" || msg.User.ID == c.userID || !c.seen.update(msg) {
+					continue
+				}
+
+				c.messageChan <- c.convertToMetachat(msg)
+			}
+		}
+	}
+}
+
+// update records the message and reports whether it's new or edited since it was seen last time.
+func (l *messageLog) update(msg message) bool {
+	editedAt := string(msg.EditedAt)
+	if editedAt == "null" {
+		editedAt = ""
+	}
+
+	previous, ok := l.editedAt[msg.ID]
+	if ok && (editedAt == "" || editedAt == previous) {
+		return false
+	}
+
+	if !ok {
+		l.order = append(l.order, msg.ID)
+		if len(l.order) > maxSeenMessages {
+			delete(l.editedAt, l.order[0])
+			l.order = l.order[1:]
+		}
+	}
+
+	l.editedAt[msg.ID] = editedAt
+
+	return true
+}
+
+func (c *Client) do(method, path string, payload, result interface{}) error {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("X-User-Id", c.userID)
+	req.Header.Set("X-Auth-Token", c.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay := time.Second
+		reset, err := strconv.ParseInt(resp.Header.Get("X-Ratelimit-Reset"), 10, 64)
+		if err == nil {
+			if until := time.Until(time.Unix(0, reset*int64(time.Millisecond))); until > 0 {
+				delay = until
+			}
+		}
+
+		return &metachat.RetryAfterError{Duration: delay}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got %s from %s %s", resp.Status, method, path)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
@@ -0,0 +1,308 @@
+package rocketchat
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakeServer is a Rocket.Chat server answering the REST API and replaying the recorded realtime API stream
+// from testdata/stream.jsonl to every WebSocket connection. REST requests are handed over to the test.
+type fakeServer struct {
+	server   *httptest.Server
+	requests chan request
+	logins   chan ddpMessage
+	pongs    chan struct{}
+	conns    chan *websocket.Conn
+}
+
+type request struct {
+	path string
+	body map[string]string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	stream := readFixture(t, "testdata/stream.jsonl")
+	s := &fakeServer{
+		requests: make(chan request, 10),
+		logins:   make(chan ddpMessage, 10),
+		pongs:    make(chan struct{}, 10),
+		conns:    make(chan *websocket.Conn, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-User-Id") != "bot" || r.Header.Get("X-Auth-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/api/v1/me":
+			w.Write([]byte(`{"_id":"bot","username":"metachat","success":true}`))
+
+		case "/api/v1/rooms.info":
+			if r.URL.Query().Get("roomId") != "GENERAL" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+
+		case "/api/v1/chat.postMessage", "/api/v1/chat.update":
+			var body map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+
+			s.requests <- request{path: r.URL.Path, body: body}
+
+			if body["text"] == "slow down" {
+				w.Header().Set("X-Ratelimit-Reset", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			w.Write([]byte(`{"message":{"_id":"m9","rid":"GENERAL"},"success":true}`))
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/websocket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, want := range []string{"connect", "method", "sub"} {
+			var req ddpMessage
+			if err := conn.ReadJSON(&req); err != nil || req.Msg != want {
+				t.Errorf("got %+v instead of %s: %v", req, want, err)
+				return
+			}
+
+			if req.Msg == "method" {
+				s.logins <- req
+			}
+		}
+
+		for _, frame := range stream {
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		var resp ddpMessage
+		if err := conn.ReadJSON(&resp); err == nil && resp.Msg == "pong" {
+			s.pongs <- struct{}{}
+		}
+
+		s.conns <- conn
+	})
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// accept waits for the client to log in, get the recorded stream and answer its ping.
+func (s *fakeServer) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	select {
+	case login := <-s.logins:
+		params, _ := json.Marshal(login.Params)
+		if login.Method != "login" || string(params) != `[{"resume":"token"}]` {
+			t.Errorf("unexpected login %+v", login)
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't log in")
+	}
+
+	select {
+	case <-s.pongs:
+	case <-time.After(testTimeout):
+		t.Error("client didn't answer the ping")
+	}
+
+	conn := <-s.conns
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestListenRelaysNewAndEditedMessages(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, s.server.URL)
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.listen() }()
+
+	conn := s.accept(t)
+
+	want := []metachat.Message{
+		{Messenger: "Rocket.Chat", Chat: "GENERAL", Author: "Alice", AuthorID: "u1",
+			Text: "Hello, " + metachat.Bold("world")},
+		{Messenger: "Rocket.Chat", Chat: "GENERAL", Author: "Alice", AuthorID: "u1",
+			Text: metachat.Edit("Hello, " + metachat.Italic("everyone"))},
+		{Messenger: "Rocket.Chat", Chat: "GENERAL", Author: "bob", AuthorID: "u2", Text: "bye"},
+	}
+
+	expectMessages(t, c, want)
+	conn.Close()
+	expectClosed(t, errs)
+
+	// The stream is replayed after reconnecting and the messages aren't relayed again.
+	go func() { errs <- c.listen() }()
+
+	conn = s.accept(t)
+	expectMessages(t, c, nil)
+	conn.Close()
+	expectClosed(t, errs)
+}
+
+func TestSendAndEdit(t *testing.T) {
+	s := newFakeServer(t)
+	c := newTestClient(t, s.server.URL)
+
+	id, err := c.SendEditable(metachat.Message{Author: "Alice", Text: metachat.Bold("hi")}, "GENERAL")
+	if err != nil || id != "m9" {
+		t.Fatalf("got message ID %q: %v", id, err)
+	}
+
+	expectRequest(t, s, "/api/v1/chat.postMessage", map[string]string{"roomId": "GENERAL", "text": "*[Alice]* *hi*"})
+
+	err = c.Edit(metachat.Message{Text: "fixed"}, "GENERAL", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectRequest(t, s, "/api/v1/chat.update", map[string]string{"roomId": "GENERAL", "msgId": "m9", "text": "fixed"})
+
+	err = c.Send(metachat.Message{Text: "slow down"}, "GENERAL")
+	if _, ok := err.(*metachat.RetryAfterError); !ok {
+		t.Errorf("got %v instead of a rate limit error", err)
+	}
+
+	visible, err := c.CheckCredentials([]string{"GENERAL", "secret"})
+	if err != nil || !visible["GENERAL"] || visible["secret"] {
+		t.Errorf("got visible rooms %v: %v", visible, err)
+	}
+}
+
+func TestNewClientChecksToken(t *testing.T) {
+	s := newFakeServer(t)
+
+	_, err := NewClient(Config{URL: s.server.URL, UserID: "bot", Token: "wrong"})
+	if err == nil {
+		t.Error("client is created with a wrong token")
+	}
+}
+
+func newTestClient(t *testing.T, url string) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{URL: url + "/", UserID: "bot", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func expectMessages(t *testing.T, c *Client, want []metachat.Message) {
+	t.Helper()
+
+	for _, msg := range want {
+		select {
+		case got := <-c.MessageChan():
+			if got != msg {
+				t.Errorf("got %+v instead of %+v", got, msg)
+			}
+
+		case <-time.After(testTimeout):
+			t.Fatalf("message %+v isn't relayed", msg)
+		}
+	}
+
+	select {
+	case got := <-c.MessageChan():
+		t.Errorf("message %+v is relayed", got)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func expectClosed(t *testing.T, errs <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("listen returned no error after the connection is closed")
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatal("listen didn't return after the connection is closed")
+	}
+}
+
+func expectRequest(t *testing.T, s *fakeServer, path string, body map[string]string) {
+	t.Helper()
+
+	select {
+	case req := <-s.requests:
+		if req.path != path || len(req.body) != len(body) {
+			t.Errorf("got %+v instead of %s %v", req, path, body)
+			return
+		}
+
+		for key, value := range body {
+			if req.body[key] != value {
+				t.Errorf("%s of %s is %q instead of %q", key, path, req.body[key], value)
+			}
+		}
+
+	case <-time.After(testTimeout):
+		t.Errorf("%s isn't requested", path)
+	}
+}
+
+// readFixture returns the lines of the recorded fixture.
+func readFixture(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	var result [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result = append(result, []byte(line))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
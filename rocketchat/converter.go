@@ -0,0 +1,82 @@
+package rocketchat
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+var (
+	preformattedRegexp  = regexp.MustCompile("(?s)```(?:[a-zA-Z0-9+-]*\n)?(.*?)```")
+	codeRegexp          = regexp.MustCompile("`([^`]+?)`")
+	boldRegexp          = regexp.MustCompile(`\*(.+?)\*`)
+	italicRegexp        = regexp.MustCompile(`\b_(.+?)_\b`)
+	strikethroughRegexp = regexp.MustCompile(`~(.+?)~`)
+	mentionRegexp       = regexp.MustCompile(`\B@([a-zA-Z0-9.\-_]+)`)
+	linkRegexp          = regexp.MustCompile(`\[(.*?)\]\((https?://.*?)\)|<(https?://[^|>]*)\|[^>]*>`)
+)
+
+func convertToRocketChat(msg metachat.Message) string {
+	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, "*${1}*")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~${1}~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "```\n${1}\n```")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> *${1}*: ${2}\n\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	if msg.Author != "" {
+		content = fmt.Sprintf("*[%s]* %s", msg.Author, content)
+	}
+
+	return content
+}
+
+func (c *Client) convertToMetachat(msg message) metachat.Message {
+	content := preformattedRegexp.ReplaceAllString(msg.Text, metachat.Preformatted("${1}"))
+	content = codeRegexp.ReplaceAllString(content, metachat.Preformatted("${1}"))
+	content = boldRegexp.ReplaceAllString(content, metachat.Bold("${1}"))
+	content = italicRegexp.ReplaceAllString(content, metachat.Italic("${1}"))
+	content = strikethroughRegexp.ReplaceAllString(content, metachat.Strikethrough("${1}"))
+	content = linkRegexp.ReplaceAllString(content, "${2}${3}")
+	content = mentionRegexp.ReplaceAllString(content, metachat.Mention("${1}"))
+
+	if len(msg.EditedAt) > 0 && string(msg.EditedAt) != "null" {
+		content = metachat.Edit(content)
+	}
+
+	author := msg.User.Name
+	if author == "" {
+		author = msg.User.Username
+	}
+
+	return metachat.Message{
+		Messenger: c.id,
+		Chat:      msg.RoomID,
+		Author:    author,
+		AuthorID:  msg.User.ID,
+		Text:      content,
+	}
+}
+
+// converter exposes the Rocket.Chat conversions. Inbound payloads are realtime API messages.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(convertToRocketChat(msg)), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var msg message
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	return (&Client{id: "Rocket.Chat"}).convertToMetachat(msg), nil
+}
@@ -32,14 +32,16 @@ type (
 
 	// Config structure.
 	Config struct {
-		Username    string     `json:"username"`
-		Password    string     `json:"password"`
-		DisplayName string     `json:"displayName"`
+		ID          string     `json:"-"`
+		Username    string     `json:"username" required:"true"`
+		Password    string     `json:"password" required:"true"`
+		DisplayName string     `json:"displayName" required:"true"`
 		HTTPClient  httpClient `json:"-"`
 	}
 
 	// Client is a Skype client.
 	Client struct {
+		id                          string
 		httpClient                  httpClient
 		username                    string
 		password                    string
@@ -66,6 +68,7 @@ type (
 
 	resource struct {
 		ConversationLink string `json:"conversationLink,omitempty"`
+		From             string `json:"from,omitempty"`
 		Imdisplayname    string `json:"imdisplayname,omitempty"`
 		Messagetype      string `json:"messagetype"`
 		Content          string `json:"content,omitempty"`
@@ -78,6 +81,11 @@ type (
 	}
 )
 
+func init() {
+	metachat.Register("skype", newMessenger, Config{})
+	metachat.RegisterConverter("skype", converter{})
+}
+
 // NewClient is a Skype client constructor.
 func NewClient(config Config) (*Client, error) {
 	if config.Username == "" || config.Password == "" || config.DisplayName == "" {
@@ -89,7 +97,13 @@ func NewClient(config Config) (*Client, error) {
 		httpClient = http.DefaultClient
 	}
 
+	id := config.ID
+	if id == "" {
+		id = "Skype"
+	}
+
 	client := &Client{
+		id:          id,
 		httpClient:  httpClient,
 		username:    config.Username,
 		password:    config.Password,
@@ -101,9 +115,26 @@ func NewClient(config Config) (*Client, error) {
 	return client, nil
 }
 
-// Name returns the messenger name.
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
 func (c *Client) Name() string {
-	return "Skype"
+	return c.id
 }
 
 // MessageChan returns a read-only message channel.
@@ -132,7 +163,7 @@ func (c *Client) Start() error {
 		}
 
 		for _, r := range resources {
-			c.messageChan <- convertToMetachat(r)
+			c.messageChan <- c.convertToMetachat(r)
 		}
 	}
 }
@@ -172,6 +203,15 @@ func (c *Client) Send(msg metachat.Message, chat string) error {
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil {
+			seconds = 1
+		}
+
+		return &metachat.RetryAfterError{Duration: time.Duration(seconds) * time.Second}
+	}
+
 	if resp.StatusCode != http.StatusCreated {
 		return errors.New("can't send a message, status " + resp.Status)
 	}
@@ -179,6 +219,11 @@ func (c *Client) Send(msg metachat.Message, chat string) error {
 	return nil
 }
 
+// CheckCredentials logs in to Skype. The visibility of the chats is unknown.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	return nil, c.getTokens()
+}
+
 func (c *Client) getTokens() error {
 	loginParams, err := c.getLoginParams()
 	if err != nil {
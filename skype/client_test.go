@@ -0,0 +1,198 @@
+package skype_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+	"github.com/thehadalone/metachat/skype"
+	"github.com/thehadalone/metachat/skype/skypetest"
+)
+
+const (
+	testTimeout = 5 * time.Second
+	lockID      = "msmsgs@msnmsgr.com"
+	lockKey     = "Q1P7W2E4J9R8U3S5"
+	chat        = "19:team@thread.skype"
+)
+
+func TestLockAndKeyVectors(t *testing.T) {
+	for _, vector := range skypetest.LockAndKeyVectors {
+		response := skype.SkypeHMACSHA256(vector.Challenge, lockID, lockKey)
+		if response != vector.Response {
+			t.Errorf("got %s instead of %s for %s", response, vector.Response, vector.Challenge)
+		}
+	}
+}
+
+func TestStartRelaysSupportedMessages(t *testing.T) {
+	server := newServer()
+	c := newClient(t, server)
+	errs := start(c)
+
+	server.Push(
+		skypetest.TextMessage(chat, "Alice", ""),
+		skypetest.TextMessage(chat, "Alice", `<URIObject type="Picture.1" uri="https://example.com/1"/>`),
+		skypetest.Resource{ConversationLink: "https://" + skypetest.MessageHost + "/v1/users/ME/conversations/" + chat,
+			Imdisplayname: "Alice", Messagetype: "Control/Typing", Content: "typing"},
+		skypetest.TextMessage(chat, skypetest.DisplayName, "own message"),
+		skypetest.TextMessage(chat, "Alice", "<b>hello</b> &amp; bye"),
+	)
+
+	want := metachat.Message{Messenger: "Skype", Chat: chat, Author: "Alice", Text: metachat.Bold("hello") + " & bye"}
+	if msg := receive(t, c); msg != want {
+		t.Errorf("got %+v instead of %+v", msg, want)
+	}
+
+	stop(t, server, errs)
+
+	select {
+	case msg := <-c.MessageChan():
+		t.Errorf("unsupported message %+v is relayed", msg)
+
+	default:
+	}
+
+	if server.Logins() != 1 {
+		t.Errorf("logged in %d times", server.Logins())
+	}
+}
+
+func TestStartLogsInAgainWhenTokenExpires(t *testing.T) {
+	server := newServer()
+	server.TokenLifetime = -time.Minute
+
+	c := newClient(t, server)
+	errs := start(c)
+
+	server.Push(skypetest.TextMessage(chat, "Alice", "first"))
+	receive(t, c)
+
+	server.Push(skypetest.TextMessage(chat, "Alice", "second"))
+	if msg := receive(t, c); msg.Text != "second" {
+		t.Errorf("got %+v", msg)
+	}
+
+	stop(t, server, errs)
+
+	if server.Logins() < 3 {
+		t.Errorf("logged in only %d times with an expired token", server.Logins())
+	}
+}
+
+func TestRegistrationFollowsMessageHostRedirect(t *testing.T) {
+	server := newServer()
+	server.RedirectHost = "client-s2.gateway.messenger.live.com"
+
+	c := newClient(t, server)
+
+	err := c.Send(metachat.Message{Author: "Alice", Text: "hello"}, chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registrations := server.Registrations()
+	if len(registrations) != 2 || registrations[0] != skypetest.MessageHost ||
+		registrations[1] != server.RedirectHost {
+		t.Errorf("got registrations at %v", registrations)
+	}
+
+	sent := server.Sent()
+	if len(sent) != 1 || sent[0].Chat != chat || !strings.Contains(sent[0].Content, "hello") {
+		t.Errorf("got sent messages %+v", sent)
+	}
+
+	errs := start(c)
+	server.Push(skypetest.TextMessage(chat, "Alice", "hi"))
+	if msg := receive(t, c); msg.Text != "hi" {
+		t.Errorf("got %+v", msg)
+	}
+
+	stop(t, server, errs)
+
+	if server.Logins() != 1 {
+		t.Errorf("logged in %d times", server.Logins())
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	c := newClient(t, server)
+
+	_, err := c.CheckCredentials([]string{chat})
+	if err != nil {
+		t.Errorf("valid credentials are rejected: %v", err)
+	}
+
+	server.Password = "wrong"
+
+	_, err = c.CheckCredentials([]string{chat})
+	if err == nil {
+		t.Error("wrong credentials are accepted")
+	}
+}
+
+// newServer starts a fake server checking the lock-and-key responses.
+func newServer() *skypetest.Server {
+	server := skypetest.NewServer()
+	server.PollTimeout = 10 * time.Millisecond
+	server.LockAndKey = func(challenge string) string {
+		return skype.SkypeHMACSHA256(challenge, lockID, lockKey)
+	}
+
+	return server
+}
+
+func newClient(t *testing.T, server *skypetest.Server) *skype.Client {
+	t.Helper()
+
+	c, err := skype.NewClient(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func start(c *skype.Client) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Start()
+	}()
+
+	return errs
+}
+
+// stop closes the server and waits for the client to return the polling error.
+func stop(t *testing.T, server *skypetest.Server, errs <-chan error) {
+	t.Helper()
+
+	server.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("client stopped without an error")
+		}
+
+	case <-time.After(testTimeout):
+		t.Fatal("client doesn't stop")
+	}
+}
+
+func receive(t *testing.T, c *skype.Client) metachat.Message {
+	t.Helper()
+
+	select {
+	case msg := <-c.MessageChan():
+		return msg
+
+	case <-time.After(testTimeout):
+		t.Fatal("no message")
+	}
+
+	return metachat.Message{}
+}
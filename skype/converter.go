@@ -1,10 +1,12 @@
 package skype
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/thehadalone/metachat/metachat"
 )
 
@@ -17,13 +19,17 @@ var (
 	strikethroughRegexp = regexp.MustCompile(`<s\b.*?>(.*?)</s\b.*?>`)
 	preformattedRegexp  = regexp.MustCompile(`(?s)<pre\b.*?>(.*?)</pre\b.*?>`)
 	linkRegexp          = regexp.MustCompile(`<a\b.*?href="(.*?)">.*?</a>`)
-	mentionRegexp       = regexp.MustCompile(`<at\b.*?id=".*?">(.*?)</at>`)
+	mentionRegexp       = regexp.MustCompile(`<at\b.*?id="(.*?)">(.*?)</at>`)
+	contactRegexp       = regexp.MustCompile(`/contacts/([0-9]+:[^/]+)$`)
 	quoteRegexp         = regexp.MustCompile(`(?s)<quote\b.*?authorname="(.*?)".*?>(.*?)</quote>`)
 	urlRegexp           = regexp.MustCompile(`(https?://[^\s]+)`)
 	editRegexp          = regexp.MustCompile(`</?e_m\b.*?>`)
+
+	// escaper escapes the characters Skype parses as markup in the rich text content.
+	escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
 )
 
-func convertToMetachat(resource resource) metachat.Message {
+func (c *Client) convertToMetachat(resource resource) metachat.Message {
 	chatGroups := chatRegexp.FindStringSubmatch(resource.ConversationLink)
 	content := resource.Content
 
@@ -36,8 +42,11 @@ func convertToMetachat(resource resource) metachat.Message {
 	content = strikethroughRegexp.ReplaceAllString(content, metachat.Strikethrough("${1}"))
 	content = preformattedRegexp.ReplaceAllString(content, metachat.Preformatted("${1}"))
 	content = linkRegexp.ReplaceAllString(content, "${1}")
-	content = mentionRegexp.ReplaceAllString(content, metachat.Mention("${1}"))
-	content = quoteRegexp.ReplaceAllString(content, metachat.Quote("${2}", "${1}"))
+	content = mentionRegexp.ReplaceAllString(content, metachat.MentionOf("${2}", "${1}"))
+	content = quoteRegexp.ReplaceAllStringFunc(content, func(match string) string {
+		groups := quoteRegexp.FindStringSubmatch(match)
+		return metachat.Quote(groups[2], groups[1])
+	})
 	content = strings.Replace(content, "&lt;", "<", -1)
 	content = strings.Replace(content, "&gt;", ">", -1)
 	content = strings.Replace(content, "&amp;", "&", -1)
@@ -48,29 +57,38 @@ func convertToMetachat(resource resource) metachat.Message {
 		content = metachat.Edit(content)
 	}
 
+	var authorID string
+	if groups := contactRegexp.FindStringSubmatch(resource.From); groups != nil {
+		authorID = groups[1]
+	}
+
 	return metachat.Message{
-		Messenger: "Skype",
+		Messenger: c.id,
 		Chat:      chatGroups[1],
 		Author:    resource.Imdisplayname,
+		AuthorID:  authorID,
 		Text:      content,
 	}
 }
 
 func convertToSkype(msg metachat.Message) message {
-	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, `<b raw_pre="*" raw_post="*">${1}</b>`)
+	content := metachat.BoldRegexp.ReplaceAllString(escaper.Replace(msg.Text), `<b raw_pre="*" raw_post="*">${1}</b>`)
 	content = metachat.ItalicRegexp.ReplaceAllString(content, `<i raw_pre="_" raw_post="_">${1}</i>`)
 	content = metachat.StrikethroughRegexp.ReplaceAllString(content, `<s raw_pre="~" raw_post="~">${1}</s>`)
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "<u>${1}</u>")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
 
 	content = metachat.PreformattedRegexp.ReplaceAllString(content,
 		`<pre raw_pre="{{code}}" raw_post="{{code}}">${1}</pre>`)
 
+	content = metachat.MentionIDRegexp.ReplaceAllString(content, `<at id="${1}">${2}</at>`)
 	content = metachat.MentionRegexp.ReplaceAllString(content, `@${1}`)
 	content = metachat.QuoteRegexp.ReplaceAllString(content, "Quote from ${1}:\n${2}\n\n")
 	content = urlRegexp.ReplaceAllString(content, `<a href="${1}">${1}</a>`)
 	content = metachat.EditRegexp.ReplaceAllString(content, `Edit: ${1}`)
 
 	if msg.Author != "" {
-		content = fmt.Sprintf(`<b raw_pre="*" raw_post="*">[%s]</b> %s`, msg.Author, content)
+		content = fmt.Sprintf(`<b raw_pre="*" raw_post="*">[%s]</b> %s`, escaper.Replace(msg.Author), content)
 	}
 
 	return message{
@@ -79,3 +97,22 @@ func convertToSkype(msg metachat.Message) message {
 		Content:     content,
 	}
 }
+
+// converter exposes the Skype conversions. Inbound payloads are polled message resources.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	payload, err := json.MarshalIndent(convertToSkype(msg), "", "  ")
+
+	return payload, errors.WithStack(err)
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var r resource
+	err := json.Unmarshal(payload, &r)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	return (&Client{id: "Skype"}).convertToMetachat(r), nil
+}
@@ -38,12 +38,11 @@ func skypeHMACSHA256(input, id, key string) string {
 	high := big.NewInt(0)
 
 	for i := 0; i <= len(message32)-2; i = i + 2 {
-		message := big.NewInt(int64(message32[i+1]))
-		temp = temp.Mul(message, magic).Mod(temp, maxInt32)
+		temp = temp.Mul(big.NewInt(int64(message32[i])), magic).Mod(temp, maxInt32)
 		low = low.Add(low, temp).Mul(low, hash0).Add(low, hash1).Mod(low, maxInt32)
 		high = high.Add(high, low)
 
-		temp = message
+		temp = big.NewInt(int64(message32[i+1]))
 		low = low.Add(low, temp).Mul(low, hash2).Add(low, hash3).Mod(low, maxInt32)
 		high = high.Add(high, low)
 	}
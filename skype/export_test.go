@@ -0,0 +1,4 @@
+package skype
+
+// SkypeHMACSHA256 exposes the lock-and-key algorithm to the tests against skypetest.
+var SkypeHMACSHA256 = skypeHMACSHA256
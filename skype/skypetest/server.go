@@ -0,0 +1,353 @@
+// Package skypetest provides a fake Skype server reproducing the Microsoft Live login, the endpoint
+// registration and the message polling protocol, so that the Skype client can be run without an account.
+//
+// The server handles every host the client talks to, Client returns an HTTP client routing their
+// requests to it:
+//
+//	server := skypetest.NewServer()
+//	defer server.Close()
+//
+//	client, err := skype.NewClient(server.Config())
+package skypetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/thehadalone/metachat/skype"
+)
+
+// Hosts of the Skype services.
+const (
+	SkypeLoginHost = "login.skype.com"
+	LiveLoginHost  = "login.live.com"
+	MessageHost    = "client-s.gateway.messenger.live.com"
+)
+
+// Default credentials and tokens of the server.
+const (
+	Username          = "bot@example.com"
+	Password          = "secret"
+	DisplayName       = "Metachat"
+	PPFT              = "ppft-value"
+	T                 = "t-value"
+	SkypeToken        = "skype-token"
+	RegistrationToken = "UmVnaXN0cmF0aW9uVG9rZW4="
+	EndpointID        = "{2d3c2b8a-7a5e-4f7a-9c6e-0a1b2c3d4e5f}"
+)
+
+var (
+	lockAndKeyRegexp   = regexp.MustCompile(`^appId=([^;]+); time=(\d+); lockAndKeyResponse=([0-9a-f]{32})$`)
+	conversationRegexp = regexp.MustCompile(`^/v1/users/ME/conversations/([^/]+)/messages$`)
+)
+
+// LockAndKeyVectors are reference responses to the lock-and-key challenge of the endpoint registration
+// for the msmsgs@msnmsgr.com application ID and the Q1P7W2E4J9R8U3S5 key, computed with an independent
+// implementation of the algorithm.
+var LockAndKeyVectors = []LockAndKeyVector{
+	{Challenge: "1500000000", Response: "9556ff838aaaae2f3a00055dcc4f1834"},
+	{Challenge: "1234567890", Response: "fbf4e1fb616609488296b8a3e2e552ab"},
+	{Challenge: "1700000000", Response: "abe5fadd8fa2021a9041e263584ea4ab"},
+	{Challenge: "123", Response: "ddf43cc469316a450540dff2f861ed33"},
+}
+
+type (
+	// LockAndKeyVector is a challenge with its expected response.
+	LockAndKeyVector struct {
+		Challenge string
+		Response  string
+	}
+
+	// Resource is a message resource returned by polling.
+	Resource struct {
+		ConversationLink string `json:"conversationLink,omitempty"`
+		From             string `json:"from,omitempty"`
+		Imdisplayname    string `json:"imdisplayname,omitempty"`
+		Messagetype      string `json:"messagetype"`
+		Content          string `json:"content,omitempty"`
+	}
+
+	// Message is a message sent by the client.
+	Message struct {
+		Chat        string `json:"-"`
+		ContentType string `json:"contenttype"`
+		MessageType string `json:"messagetype"`
+		Content     string `json:"content"`
+	}
+
+	// Server is a fake Skype server. The fields can be changed before the client logs in.
+	//
+	// RedirectHost makes the endpoint registration redirect the client to another message host
+	// with the Location header. TokenLifetime is the registration token lifetime, a negative one makes
+	// the client log in again before every poll. PollTimeout is how long a poll waits for resources.
+	// LockAndKey, if set, computes the expected response to the lock-and-key challenge, otherwise only
+	// the format of the LockAndKey header is checked.
+	Server struct {
+		*httptest.Server
+
+		Username      string
+		Password      string
+		RedirectHost  string
+		TokenLifetime time.Duration
+		PollTimeout   time.Duration
+		LockAndKey    func(challenge string) string
+
+		lock          sync.Mutex
+		logins        int
+		registrations []string
+		resources     chan Resource
+		sent          []Message
+	}
+)
+
+// NewServer starts a fake Skype server.
+func NewServer() *Server {
+	s := &Server{
+		Username:      Username,
+		Password:      Password,
+		TokenLifetime: time.Hour,
+		PollTimeout:   100 * time.Millisecond,
+		resources:     make(chan Resource, 100),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Client returns an HTTP client sending the requests to any host to the server.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: &transport{addr: s.Listener.Addr().String()}}
+}
+
+// Config returns a Skype client configuration using the server.
+func (s *Server) Config() skype.Config {
+	return skype.Config{Username: s.Username, Password: s.Password, DisplayName: DisplayName, HTTPClient: s.Client()}
+}
+
+// Push queues resources for the next polls.
+func (s *Server) Push(resources ...Resource) {
+	for _, resource := range resources {
+		s.resources <- resource
+	}
+}
+
+// Logins returns the number of Skype tokens issued.
+func (s *Server) Logins() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.logins
+}
+
+// Registrations returns the hosts the endpoint registrations were requested from.
+func (s *Server) Registrations() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.registrations...)
+}
+
+// Sent returns the messages sent by the client.
+func (s *Server) Sent() []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Message(nil), s.sent...)
+}
+
+// TextMessage returns a text message resource from the chat.
+func TextMessage(chat, author, content string) Resource {
+	return Resource{
+		ConversationLink: "https://" + MessageHost + "/v1/users/ME/conversations/" + chat,
+		Imdisplayname:    author,
+		Messagetype:      "RichText",
+		Content:          content,
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	switch {
+	case host == SkypeLoginHost && r.Method == http.MethodGet && r.URL.Path == "/login/oauth/microsoft":
+		s.loginPage(w, r)
+
+	case host == LiveLoginHost && r.Method == http.MethodPost && r.URL.Path == "/ppsecure/post.srf":
+		s.liveLogin(w, r)
+
+	case host == SkypeLoginHost && r.Method == http.MethodPost && r.URL.Path == "/login/microsoft":
+		s.skypeToken(w, r)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/users/ME/endpoints":
+		s.register(w, r)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/users/ME/endpoints/"+EndpointID+"/subscriptions":
+		if s.authorized(w, r) {
+			w.WriteHeader(http.StatusCreated)
+		}
+
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/users/ME/endpoints/"+EndpointID+"/subscriptions/0/poll":
+		if s.authorized(w, r) {
+			s.poll(w)
+		}
+
+	case r.Method == http.MethodPost && conversationRegexp.MatchString(r.URL.Path):
+		if s.authorized(w, r) {
+			s.receive(w, r, conversationRegexp.FindStringSubmatch(r.URL.Path)[1])
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) loginPage(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "MSPRequ", Value: "id=N&lt=1500000000&co=1"})
+	http.SetCookie(w, &http.Cookie{Name: "MSPOK", Value: "$uuid-mspok"})
+	fmt.Fprintf(w, `<html><body><form><input type="hidden" name="PPFT" id="i0327" value="%s"/></form></body></html>`,
+		PPFT)
+}
+
+func (s *Server) liveLogin(w http.ResponseWriter, r *http.Request) {
+	_, errRequ := r.Cookie("MSPRequ")
+	_, errOK := r.Cookie("MSPOK")
+	if errRequ != nil || errOK != nil || r.PostFormValue("PPFT") != PPFT {
+		http.Error(w, "invalid login form", http.StatusBadRequest)
+		return
+	}
+
+	// Live shows the login form again instead of failing on wrong credentials.
+	if r.PostFormValue("login") != s.Username || r.PostFormValue("passwd") != s.Password {
+		fmt.Fprint(w, `<html><body><div id="passwordError">Your account or password is incorrect.</div></body></html>`)
+		return
+	}
+
+	fmt.Fprintf(w, `<html><body><form><input type="hidden" name="t" id="t" value="%s"/></form></body></html>`, T)
+}
+
+func (s *Server) skypeToken(w http.ResponseWriter, r *http.Request) {
+	if r.PostFormValue("t") != T {
+		http.Error(w, "invalid t", http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.logins++
+	s.lock.Unlock()
+
+	fmt.Fprintf(w, `<html><body><form><input type="hidden" name="skypetoken" value="%s"/>`+
+		`<input type="hidden" name="expires_in" value="86400"/></form></body></html>`, html.EscapeString(SkypeToken))
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.registrations = append(s.registrations, r.Host)
+	s.lock.Unlock()
+
+	if r.Header.Get("Authentication") != "skypetoken="+SkypeToken {
+		http.Error(w, "invalid skype token", http.StatusUnauthorized)
+		return
+	}
+
+	groups := lockAndKeyRegexp.FindStringSubmatch(r.Header.Get("LockAndKey"))
+	if groups == nil || s.LockAndKey != nil && s.LockAndKey(groups[2]) != groups[3] {
+		http.Error(w, "invalid lock and key response", http.StatusUnauthorized)
+		return
+	}
+
+	endpoint := url.PathEscape(EndpointID)
+	if s.RedirectHost != "" && r.Host != s.RedirectHost {
+		w.Header().Set("Location", "https://"+s.RedirectHost+"/v1/users/ME/endpoints/"+endpoint)
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	expires := time.Now().Add(s.TokenLifetime).Unix()
+	w.Header().Set("Location", "https://"+r.Host+"/v1/users/ME/endpoints/"+endpoint)
+	w.Header().Set("Set-RegistrationToken", fmt.Sprintf("registrationToken=%s; expires=%d; endpointId=%s",
+		RegistrationToken, expires, EndpointID))
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("RegistrationToken") != "registrationToken="+RegistrationToken {
+		http.Error(w, "invalid registration token", http.StatusUnauthorized)
+		return false
+	}
+
+	if s.RedirectHost != "" && r.Host != s.RedirectHost {
+		http.Error(w, "wrong message host", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) poll(w http.ResponseWriter) {
+	type eventMessage struct {
+		Resource Resource `json:"resource"`
+	}
+
+	var messages []eventMessage
+	select {
+	case resource := <-s.resources:
+		messages = append(messages, eventMessage{Resource: resource})
+
+	case <-time.After(s.PollTimeout):
+	}
+
+	for drained := len(messages) == 0; !drained; {
+		select {
+		case resource := <-s.resources:
+			messages = append(messages, eventMessage{Resource: resource})
+
+		default:
+			drained = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"eventMessages": messages})
+}
+
+func (s *Server) receive(w http.ResponseWriter, r *http.Request, chat string) {
+	var msg Message
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg.Chat, _ = url.PathUnescape(chat)
+
+	s.lock.Lock()
+	s.sent = append(s.sent, msg)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"OriginalArrivalTime":%d}`, time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+// transport sends the requests to the server keeping the original host in the Host header.
+type transport struct {
+	addr string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clone := req.Clone(req.Context())
+	clone.Host = req.URL.Host
+	clone.URL.Scheme = "http"
+	clone.URL.Host = t.addr
+
+	return http.DefaultTransport.RoundTrip(clone)
+}
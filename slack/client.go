@@ -3,8 +3,11 @@ package slack
 import (
 	"encoding/json"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
@@ -14,27 +17,64 @@ import (
 	"github.com/thehadalone/metachat/metachat"
 )
 
+const (
+	// maxLength is the message length Slack recommends, longer messages are truncated.
+	maxLength = 4000
+
+	defaultUsersRefresh = time.Hour
+
+	// failedLookupTTL is how long users.info isn't asked again about a user it failed to return.
+	failedLookupTTL = 5 * time.Minute
+)
+
 type (
-	// Config structure.
+	// Config structure. UsersRefresh is the interval of reloading all workspace users, an hour
+	// by default. PreferDisplayName makes users known by their display names instead of real names.
 	Config struct {
-		Token             string `json:"token"`
-		VerificationToken string `json:"verificationToken"`
+		ID                string            `json:"-"`
+		Token             string            `json:"token" required:"true"`
+		VerificationToken string            `json:"verificationToken" required:"true"`
+		UploadLong        bool              `json:"uploadLongMessages"`
+		UsersRefresh      metachat.Duration `json:"usersRefresh,omitempty"`
+		PreferDisplayName bool              `json:"preferDisplayName"`
 	}
 
 	// Client is a Slack client.
 	Client struct {
+		id                string
 		verificationToken string
+		uploadLong        bool
+		usersRefresh      time.Duration
+		preferDisplayName bool
 		api               *slack.Client
+		botUserID         string
+		botID             string
 		usersByID         *userMap
 		messageChan       chan metachat.Message
 	}
 
 	userMap struct {
 		sync.RWMutex
-		users map[string]string
+		users  map[string]string
+		failed map[string]time.Time
+	}
+
+	// userEvent is a callback event carrying a user object, team_join or user_change.
+	userEvent struct {
+		Token string `json:"token"`
+		Type  string `json:"type"`
+		Event struct {
+			Type string          `json:"type"`
+			User json.RawMessage `json:"user"`
+		} `json:"event"`
 	}
 )
 
+func init() {
+	metachat.Register("slack", newMessenger, Config{})
+	metachat.RegisterConverter("slack", converter{})
+}
+
 // NewClient is a Slack client constructor.
 func NewClient(config Config) (*Client, error) {
 	if config.Token == "" || config.VerificationToken == "" {
@@ -42,27 +82,67 @@ func NewClient(config Config) (*Client, error) {
 	}
 
 	api := slack.New(config.Token)
-	users, err := api.GetUsers()
+	auth, err := api.AuthTest()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	usersByID := &userMap{users: make(map[string]string)}
-	for _, user := range users {
-		usersByID.put(user.ID, user.RealName)
+	id := config.ID
+	if id == "" {
+		id = "Slack"
 	}
 
-	return &Client{
+	usersRefresh := config.UsersRefresh.Duration
+	if usersRefresh <= 0 {
+		usersRefresh = defaultUsersRefresh
+	}
+
+	c := &Client{
+		id:                id,
 		verificationToken: config.VerificationToken,
+		uploadLong:        config.UploadLong,
+		usersRefresh:      usersRefresh,
+		preferDisplayName: config.PreferDisplayName,
 		api:               api,
-		usersByID:         usersByID,
+		botUserID:         auth.UserID,
+		usersByID:         newUserMap(),
 		messageChan:       make(chan metachat.Message, 100),
-	}, nil
+	}
+
+	users, err := c.loadUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.ID == auth.UserID {
+			c.botID = user.Profile.BotID
+		}
+	}
+
+	return c, nil
 }
 
-// Name returns the messenger name.
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
 func (c *Client) Name() string {
-	return "Slack"
+	return c.id
 }
 
 // MessageChan returns a read-only message channel.
@@ -70,8 +150,18 @@ func (c *Client) MessageChan() <-chan metachat.Message {
 	return c.messageChan
 }
 
-// Start starts the client main loop.
+// Start starts the client main loop reloading the users periodically.
 func (c *Client) Start() error {
+	ticker := time.NewTicker(c.usersRefresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := c.loadUsers()
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -85,15 +175,73 @@ func (c *Client) Webhook() http.Handler {
 
 // Send sends a message to chat with the provided ID.
 func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to chat with the provided ID and returns the message timestamp.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
 	content := convertToSlack(msg)
-	_, _, err := c.api.PostMessage(chat, content, slack.PostMessageParameters{UnfurlLinks: true, UnfurlMedia: true,
-		Markdown: true})
+	_, timestamp, err := c.api.PostMessage(chat, content, slack.PostMessageParameters{UnfurlLinks: true,
+		UnfurlMedia: true, Markdown: true})
 
 	if err != nil {
-		return errors.WithStack(err)
+		return "", wrapError(err)
 	}
 
-	return nil
+	return timestamp, nil
+}
+
+// Edit replaces the text of the message with the provided timestamp. The text is escaped by
+// convertToSlack, UpdateMessage would escape it again.
+func (c *Client) Edit(msg metachat.Message, chat, timestamp string) error {
+	_, _, _, err := c.api.SendMessage(chat, slack.MsgOptionUpdate(timestamp),
+		slack.MsgOptionText(convertToSlack(msg), false))
+
+	return wrapError(err)
+}
+
+// RateLimits returns Slack limits: a message per second in any channel.
+func (c *Client) RateLimits(chat string) []metachat.RateLimit {
+	return []metachat.RateLimit{{Interval: time.Second, Burst: 1}}
+}
+
+// MaxLength returns the length Slack recommends to keep messages under.
+func (c *Client) MaxLength() int {
+	return maxLength
+}
+
+// UploadLong reports whether messages over the length limit are uploaded as a file.
+func (c *Client) UploadLong() bool {
+	return c.uploadLong
+}
+
+// Upload sends the message text as a snippet with the author as a comment.
+func (c *Client) Upload(msg metachat.Message, chat string) error {
+	text := strings.TrimSuffix(msg.Text, metachat.OriginMarker)
+	comment := convertToSlack(metachat.Message{Author: msg.Author, Text: metachat.OriginMarker})
+
+	_, err := c.api.UploadFile(slack.FileUploadParameters{Content: metachat.PlainText(text), Filetype: "text",
+		Filename: "message.txt", InitialComment: comment, Channels: []string{chat}})
+
+	return wrapError(err)
+}
+
+// CheckCredentials verifies the token and reports the channels the bot is a member of.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	_, err := c.api.AuthTest()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		channel, err := c.api.GetConversationInfo(chat, false)
+		visible[chat] = err == nil && (channel.IsMember || channel.IsIM)
+	}
+
+	return visible, nil
 }
 
 func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
@@ -104,6 +252,11 @@ func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if c.handleUserEvent(body) {
+		render.JSON(w, r, render.M{})
+		return
+	}
+
 	event, err := slackevents.ParseEvent(json.RawMessage(body),
 		slackevents.OptionVerifyToken(&slackevents.TokenComparator{VerificationToken: c.verificationToken}))
 
@@ -128,18 +281,16 @@ func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
 
 	if event.Type == slackevents.CallbackEvent {
 		if messageEvent, ok := event.InnerEvent.Data.(*slackevents.MessageEvent); ok {
-			if (messageEvent.Text == "" || messageEvent.User == "") &&
-				(messageEvent.Message.Text == "" || messageEvent.Message.User == "") {
-
-				return
-			}
-
 			msg := messageEvent
 			edit := messageEvent.Message != nil
 			if edit {
 				msg = messageEvent.Message
 			}
 
+			if msg.Text == "" || msg.User == "" || c.isOwn(msg) {
+				return
+			}
+
 			message, err := c.convertToMetachat(msg, messageEvent.Channel, edit)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -150,11 +301,103 @@ func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// TODO handle user join
-
 	render.JSON(w, r, render.M{})
 }
 
+// handleUserEvent updates the user cache on team_join and user_change events and reports whether
+// the event was one of them. The slackevents package doesn't parse these events.
+func (c *Client) handleUserEvent(body []byte) bool {
+	var event userEvent
+	err := json.Unmarshal(body, &event)
+	if err != nil || event.Type != slackevents.CallbackEvent ||
+		event.Event.Type != "team_join" && event.Event.Type != "user_change" {
+
+		return false
+	}
+
+	comparator := slackevents.TokenComparator{VerificationToken: c.verificationToken}
+	if !comparator.Verify(event.Token) {
+		return true
+	}
+
+	var user slack.User
+	err = json.Unmarshal(event.Event.User, &user)
+	if err == nil && user.ID != "" {
+		c.usersByID.put(user.ID, c.userName(user))
+	}
+
+	return true
+}
+
+// loadUsers replaces the cached user names with the ones of all workspace users.
+func (c *Client) loadUsers() ([]slack.User, error) {
+	users, err := c.api.GetUsers()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	names := make(map[string]string, len(users))
+	for _, user := range users {
+		names[user.ID] = c.userName(user)
+	}
+
+	c.usersByID.replace(names)
+
+	return users, nil
+}
+
+// lookupUser returns the name of the user, asking Slack for the users missing from the cache.
+// Failed lookups are remembered for failedLookupTTL, so unknown IDs don't cost an API call each.
+func (c *Client) lookupUser(id string) string {
+	if name, ok := c.usersByID.get(id); ok || c.api == nil || id == "" {
+		return name
+	}
+
+	if c.usersByID.failedRecently(id) {
+		return ""
+	}
+
+	user, err := c.api.GetUserInfo(id)
+	if err != nil {
+		c.usersByID.fail(id)
+		log.Printf("%+v", errors.WithStack(err))
+		return ""
+	}
+
+	name := c.userName(*user)
+	c.usersByID.put(id, name)
+
+	return name
+}
+
+// userName returns the display name of the user if it's preferred and set, otherwise the real name.
+func (c *Client) userName(user slack.User) string {
+	switch {
+	case c.preferDisplayName && user.Profile.DisplayName != "":
+		return user.Profile.DisplayName
+
+	case user.RealName != "":
+		return user.RealName
+
+	default:
+		return user.Name
+	}
+}
+
+// isOwn reports whether the message was posted by the metachat bot itself or with a webhook or another
+// bot token, which is how metachat posts with the author name and avatar.
+func (c *Client) isOwn(event *slackevents.MessageEvent) bool {
+	if event.SubType == "bot_message" || event.User != "" && event.User == c.botUserID {
+		return true
+	}
+
+	return event.BotID != "" && event.BotID == c.botID
+}
+
+func newUserMap() *userMap {
+	return &userMap{users: make(map[string]string), failed: make(map[string]time.Time)}
+}
+
 func (m *userMap) get(key string) (string, bool) {
 	m.RLock()
 	defer m.RUnlock()
@@ -169,4 +412,47 @@ func (m *userMap) put(key, value string) {
 	defer m.Unlock()
 
 	m.users[key] = value
+	delete(m.failed, key)
+}
+
+// fail remembers that the user couldn't be looked up.
+func (m *userMap) fail(key string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.failed[key] = time.Now().Add(failedLookupTTL)
+}
+
+// failedRecently reports whether the lookup of the user failed within failedLookupTTL.
+func (m *userMap) failedRecently(key string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	expires, ok := m.failed[key]
+	if ok && time.Now().After(expires) {
+		delete(m.failed, key)
+		return false
+	}
+
+	return ok
+}
+
+func (m *userMap) replace(users map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.users = users
+	for key := range m.failed {
+		if _, ok := users[key]; ok {
+			delete(m.failed, key)
+		}
+	}
+}
+
+func wrapError(err error) error {
+	if rateErr, ok := err.(*slack.RateLimitedError); ok {
+		return &metachat.RetryAfterError{Duration: rateErr.RetryAfter}
+	}
+
+	return errors.WithStack(err)
 }
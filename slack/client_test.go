@@ -0,0 +1,242 @@
+package slack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// fakeSlack serves auth.test, users.list and users.info of a workspace with the provided users.
+type fakeSlack struct {
+	sync.Mutex
+	users   map[string]slack.User
+	lookups map[string]int
+}
+
+func TestHandleEventsDropsOwnMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		relayed bool
+	}{
+		{name: "user message", event: `{"type":"message","channel":"C1","user":"U1","text":"hi"}`, relayed: true},
+		{name: "user edit", event: `{"type":"message","subtype":"message_changed","channel":"C1",` +
+			`"message":{"type":"message","user":"U1","text":"hi"}}`, relayed: true},
+		{name: "bot user message", event: `{"type":"message","channel":"C1","user":"UBOT","text":"hi"}`},
+		{name: "bot message", event: `{"type":"message","channel":"C1","user":"U2","bot_id":"BBOT","text":"hi"}`},
+		{name: "webhook message", event: `{"type":"message","subtype":"bot_message","channel":"C1",` +
+			`"bot_id":"B2","username":"Alice","text":"hi"}`},
+		{name: "webhook message with user", event: `{"type":"message","subtype":"bot_message","channel":"C1",` +
+			`"user":"U1","bot_id":"B2","text":"hi"}`},
+		{name: "bot edit", event: `{"type":"message","subtype":"message_changed","channel":"C1",` +
+			`"message":{"type":"message","subtype":"bot_message","bot_id":"B2","text":"hi"}}`},
+		{name: "deleted message", event: `{"type":"message","subtype":"message_deleted","channel":"C1"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{
+				id:                "slack",
+				verificationToken: "token",
+				botUserID:         "UBOT",
+				botID:             "BBOT",
+				usersByID:         &userMap{users: map[string]string{"U1": "Alice"}, failed: map[string]time.Time{}},
+				messageChan:       make(chan metachat.Message, 1),
+			}
+
+			body := `{"token":"token","type":"event_callback","event":` + test.event + `}`
+			w := httptest.NewRecorder()
+			c.handleEvents(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+
+			select {
+			case msg := <-c.messageChan:
+				if !test.relayed {
+					t.Errorf("message %+v is relayed", msg)
+				} else if msg.Author != "Alice" || !strings.Contains(msg.Text, "hi") {
+					t.Errorf("unexpected message %+v", msg)
+				}
+
+			default:
+				if test.relayed {
+					t.Error("message isn't relayed")
+				}
+			}
+		})
+	}
+}
+
+func TestUserEventsUpdateCache(t *testing.T) {
+	c := newClient(t, newFakeSlack(), Config{})
+
+	postEvent(t, c, "token", `{"type":"team_join","user":{"id":"U2","name":"bob","real_name":"Bob"}}`)
+	if name, ok := c.usersByID.get("U2"); !ok || name != "Bob" {
+		t.Errorf("joined user is %q", name)
+	}
+
+	postEvent(t, c, "wrong", `{"type":"user_change","user":{"id":"U1","name":"alice","real_name":"Mallory"}}`)
+	if name, _ := c.usersByID.get("U1"); name != "Alice" {
+		t.Errorf("user changed with a bad token is %q", name)
+	}
+
+	postEvent(t, c, "token", `{"type":"user_change","user":{"id":"U1","name":"alice","real_name":"Alice Smith"}}`)
+	if name, _ := c.usersByID.get("U1"); name != "Alice Smith" {
+		t.Errorf("changed user is %q", name)
+	}
+}
+
+func TestLookupUserCachesResults(t *testing.T) {
+	server := newFakeSlack()
+	c := newClient(t, server, Config{})
+
+	server.add(slack.User{ID: "U3", Name: "carol", RealName: "Carol"})
+
+	for i := 0; i < 2; i++ {
+		if name := c.lookupUser("U3"); name != "Carol" {
+			t.Errorf("user is %q", name)
+		}
+
+		if name := c.lookupUser("U4"); name != "" {
+			t.Errorf("unknown user is %q", name)
+		}
+	}
+
+	for _, id := range []string{"U3", "U4"} {
+		if count := server.lookupCount(id); count != 1 {
+			t.Errorf("user %s is looked up %d times", id, count)
+		}
+	}
+}
+
+func TestUserName(t *testing.T) {
+	tests := []struct {
+		name              string
+		user              slack.User
+		preferDisplayName bool
+		expected          string
+	}{
+		{name: "real name", user: user("alice", "Alice", "Al"), expected: "Alice"},
+		{name: "display name", user: user("alice", "Alice", "Al"), preferDisplayName: true, expected: "Al"},
+		{name: "no display name", user: user("alice", "Alice", ""), preferDisplayName: true, expected: "Alice"},
+		{name: "no real name", user: user("alice", "", ""), preferDisplayName: true, expected: "alice"},
+		{name: "no names", user: user("alice", "", "Al"), expected: "alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{preferDisplayName: test.preferDisplayName}
+			if name := c.userName(test.user); name != test.expected {
+				t.Errorf("got %q instead of %q", name, test.expected)
+			}
+		})
+	}
+}
+
+func newFakeSlack() *fakeSlack {
+	return &fakeSlack{
+		users: map[string]slack.User{
+			"UBOT": {ID: "UBOT", Name: "metachat", Profile: slack.UserProfile{BotID: "BBOT"}},
+			"U1":   {ID: "U1", Name: "alice", RealName: "Alice"},
+		},
+		lookups: make(map[string]int),
+	}
+}
+
+func (s *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	var response interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "auth.test":
+		response = map[string]interface{}{"ok": true, "user_id": "UBOT"}
+
+	case "users.list":
+		members := make([]slack.User, 0, len(s.users))
+		for _, user := range s.users {
+			members = append(members, user)
+		}
+
+		response = map[string]interface{}{"ok": true, "members": members,
+			"response_metadata": map[string]string{"next_cursor": ""}}
+
+	case "users.info":
+		id := r.FormValue("user")
+		s.lookups[id]++
+		if user, ok := s.users[id]; ok {
+			response = map[string]interface{}{"ok": true, "user": user}
+		} else {
+			response = map[string]interface{}{"ok": false, "error": "user_not_found"}
+		}
+
+	default:
+		response = map[string]interface{}{"ok": false, "error": "unknown_method"}
+	}
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// add adds the user without the client knowing, as if they joined after users.list.
+func (s *fakeSlack) add(user slack.User) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.users[user.ID] = user
+}
+
+func (s *fakeSlack) lookupCount(id string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lookups[id]
+}
+
+func newClient(t *testing.T, handler http.Handler, config Config) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	api := slack.SLACK_API
+	slack.SLACK_API = server.URL + "/"
+	t.Cleanup(func() { slack.SLACK_API = api })
+
+	config.Token = "xoxb"
+	config.VerificationToken = "token"
+
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func postEvent(t *testing.T, c *Client, token, event string) {
+	t.Helper()
+
+	body := `{"token":"` + token + `","type":"event_callback","event":` + event + `}`
+	w := httptest.NewRecorder()
+	c.Webhook().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func user(name, realName, displayName string) slack.User {
+	return slack.User{Name: name, RealName: realName, Profile: slack.UserProfile{DisplayName: displayName}}
+}
@@ -1,11 +1,13 @@
 package slack
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
 
 	"github.com/nlopes/slack/slackevents"
+	"github.com/pkg/errors"
 	"github.com/thehadalone/metachat/metachat"
 )
 
@@ -16,26 +18,32 @@ var (
 	preformattedRegexp  = regexp.MustCompile("(?s)```(.*?)```")
 	mentionRegexp       = regexp.MustCompile(`<@(.*?)>`)
 	urlRegexp           = regexp.MustCompile(`<(https?://.*?)>`)
+
+	// escaper escapes the control characters of the Slack message formatting.
+	escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
 )
 
 func convertToSlack(msg metachat.Message) string {
-	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, "*${1}*")
+	content := metachat.BoldRegexp.ReplaceAllString(escaper.Replace(msg.Text), "*${1}*")
 	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
 	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~${1}~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
 	content = metachat.PreformattedRegexp.ReplaceAllString(content, "```${1}```")
+	content = metachat.MentionIDRegexp.ReplaceAllString(content, "<@${1}>")
 	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
 	content = metachat.QuoteRegexp.ReplaceAllString(content, "Quote from ${1}:\n${2}\n\n")
 	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
 
 	if msg.Author != "" {
-		content = fmt.Sprintf("*[%s]* %s", msg.Author, content)
+		content = fmt.Sprintf("*[%s]* %s", escaper.Replace(msg.Author), content)
 	}
 
 	return content
 }
 
 func (c *Client) convertToMetachat(event *slackevents.MessageEvent, chat string, edit bool) (metachat.Message, error) {
-	author, _ := c.usersByID.get(event.User)
+	author := c.lookupUser(event.User)
 
 	content := boldRegexp.ReplaceAllString(event.Text, metachat.Bold("${1}"))
 	content = italicRegexp.ReplaceAllString(content, metachat.Italic("${1}"))
@@ -44,9 +52,7 @@ func (c *Client) convertToMetachat(event *slackevents.MessageEvent, chat string,
 	content = urlRegexp.ReplaceAllString(content, "${1}")
 	content = mentionRegexp.ReplaceAllStringFunc(content, func(match string) string {
 		id := mentionRegexp.FindStringSubmatch(match)[1]
-		name, _ := c.usersByID.get(id)
-
-		return "@" + name
+		return metachat.MentionOf(c.lookupUser(id), id)
 	})
 
 	content = strings.Replace(content, "&lt;", "<", -1)
@@ -58,9 +64,43 @@ func (c *Client) convertToMetachat(event *slackevents.MessageEvent, chat string,
 	}
 
 	return metachat.Message{
-		Messenger: "Slack",
+		Messenger: c.id,
 		Chat:      chat,
 		Author:    author,
+		AuthorID:  event.User,
 		Text:      content,
 	}, nil
 }
+
+// converter exposes the Slack conversions. Inbound payloads are message events along with the names
+// of the users they refer to.
+type converter struct{}
+
+type converterEvent struct {
+	Event slackevents.MessageEvent `json:"event"`
+	Users map[string]string        `json:"users,omitempty"`
+}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(convertToSlack(msg)), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var e converterEvent
+	err := json.Unmarshal(payload, &e)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	c := &Client{id: "Slack", usersByID: &userMap{users: make(map[string]string)}}
+	for id, name := range e.Users {
+		c.usersByID.put(id, name)
+	}
+
+	msg := &e.Event
+	if e.Event.Message != nil {
+		msg = e.Event.Message
+	}
+
+	return c.convertToMetachat(msg, e.Event.Channel, e.Event.Message != nil)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
@@ -12,19 +14,31 @@ import (
 	"github.com/thehadalone/metachat/metachat"
 )
 
+// maxLength is the Telegram message length limit in UTF-16 code units.
+const maxLength = 4096
+
 type (
 	// Config structure.
 	Config struct {
-		Token string `json:"token"`
+		ID         string `json:"-"`
+		Token      string `json:"token" required:"true"`
+		UploadLong bool   `json:"uploadLongMessages"`
 	}
 
 	// Client is a Telegram client.
 	Client struct {
+		id          string
+		uploadLong  bool
 		api         *tgbotapi.BotAPI
 		messageChan chan metachat.Message
 	}
 )
 
+func init() {
+	metachat.Register("telegram", newMessenger, Config{})
+	metachat.RegisterConverter("telegram", converter{})
+}
+
 // NewClient is a Telegram client constructor.
 func NewClient(config Config) (*Client, error) {
 	if config.Token == "" {
@@ -36,12 +50,34 @@ func NewClient(config Config) (*Client, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	return &Client{api: api, messageChan: make(chan metachat.Message, 100)}, nil
+	id := config.ID
+	if id == "" {
+		id = "Telegram"
+	}
+
+	return &Client{id: id, uploadLong: config.UploadLong, api: api, messageChan: make(chan metachat.Message, 100)}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
 }
 
-// Name returns the messenger name.
+// Name returns the messenger instance ID.
 func (c *Client) Name() string {
-	return "Telegram"
+	return c.id
 }
 
 // Start starts the client main loop.
@@ -64,20 +100,121 @@ func (c *Client) MessageChan() <-chan metachat.Message {
 
 // Send sends a message to chat with the provided ID.
 func (c *Client) Send(message metachat.Message, chat string) error {
+	_, err := c.SendEditable(message, chat)
+
+	return err
+}
+
+// SendEditable sends a message to chat with the provided ID and returns the message ID.
+func (c *Client) SendEditable(message metachat.Message, chat string) (string, error) {
 	id, err := strconv.ParseInt(chat, 10, 64)
 	if err != nil {
-		return errors.WithStack(err)
+		return "", errors.WithStack(err)
 	}
 
 	msg := convertToTelegram(message)
 	msg.BaseChat.ChatID = id
 
-	_, err = c.api.Send(msg)
+	sent, err := c.api.Send(msg)
+	if isEntityError(err) {
+		msg = convertToPlain(message)
+		msg.BaseChat.ChatID = id
+		sent, err = c.api.Send(msg)
+	}
+
+	if err != nil {
+		return "", wrapError(err)
+	}
+
+	return strconv.Itoa(sent.MessageID), nil
+}
+
+// Edit replaces the text of the message with the provided ID.
+func (c *Client) Edit(message metachat.Message, chat, messageID string) error {
+	id, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	msgID, err := strconv.Atoi(messageID)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	return nil
+	content := convertToTelegram(message)
+	edit := tgbotapi.NewEditMessageText(id, msgID, content.Text)
+	edit.ParseMode = content.ParseMode
+
+	_, err = c.api.Send(edit)
+	if isEntityError(err) {
+		edit = tgbotapi.NewEditMessageText(id, msgID, convertToPlain(message).Text)
+		_, err = c.api.Send(edit)
+	}
+
+	return wrapError(err)
+}
+
+// RateLimits returns Telegram limits: a message per second in any chat and
+// 20 messages per minute in groups, spread evenly since Telegram counts them in any minute.
+func (c *Client) RateLimits(chat string) []metachat.RateLimit {
+	limits := []metachat.RateLimit{{Interval: time.Second, Burst: 1}}
+	if strings.HasPrefix(chat, "-") {
+		limits = append(limits, metachat.RateLimit{Interval: time.Minute / 20, Burst: 1})
+	}
+
+	return limits
+}
+
+// MaxLength returns the Telegram message length limit.
+func (c *Client) MaxLength() int {
+	return maxLength
+}
+
+// LengthUnit returns the unit of the Telegram message length limit, it's counted in UTF-16 code units.
+func (c *Client) LengthUnit() metachat.LengthUnit {
+	return metachat.UTF16Units
+}
+
+// UploadLong reports whether messages over the length limit are uploaded as a file.
+func (c *Client) UploadLong() bool {
+	return c.uploadLong
+}
+
+// Upload sends the message text as a document with the author as a caption.
+func (c *Client) Upload(msg metachat.Message, chat string) error {
+	id, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	text := strings.TrimSuffix(msg.Text, metachat.OriginMarker)
+	document := tgbotapi.NewDocumentUpload(id, tgbotapi.FileBytes{Name: "message.txt",
+		Bytes: []byte(metachat.PlainText(text))})
+	document.Caption = convertToPlain(metachat.Message{Author: msg.Author, Text: metachat.OriginMarker}).Text
+
+	_, err = c.api.Send(document)
+
+	return wrapError(err)
+}
+
+// CheckCredentials verifies the token and reports the chats the bot has access to.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	_, err := c.api.GetMe()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	visible := make(map[string]bool)
+	for _, chat := range chats {
+		id, err := strconv.ParseInt(chat, 10, 64)
+		if err == nil {
+			_, err = c.api.GetChat(tgbotapi.ChatConfig{ChatID: id})
+		}
+
+		visible[chat] = err == nil
+	}
+
+	return visible, nil
 }
 
 func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
@@ -95,10 +232,30 @@ func (c *Client) handleEvents(w http.ResponseWriter, r *http.Request) {
 		msg = event.EditedMessage
 	}
 
-	if msg == nil || msg.Text == "" {
+	if msg == nil || msg.Text == "" || c.isOwn(msg) {
 		return
 	}
 
-	c.messageChan <- convertToMetachat(msg, edit)
+	c.messageChan <- c.convertToMetachat(msg, edit)
 	render.JSON(w, r, render.M{})
 }
+
+// isOwn reports whether the message was sent by the metachat bot itself.
+func (c *Client) isOwn(msg *tgbotapi.Message) bool {
+	return msg.From != nil && msg.From.ID == c.api.Self.ID
+}
+
+// isEntityError reports whether Telegram rejected the formatting of a message.
+func isEntityError(err error) bool {
+	apiErr, ok := err.(tgbotapi.Error)
+
+	return ok && strings.Contains(apiErr.Message, "can't parse entities")
+}
+
+func wrapError(err error) error {
+	if apiErr, ok := err.(tgbotapi.Error); ok && apiErr.RetryAfter > 0 {
+		return &metachat.RetryAfterError{Duration: time.Duration(apiErr.RetryAfter) * time.Second}
+	}
+
+	return errors.WithStack(err)
+}
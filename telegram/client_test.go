@@ -0,0 +1,118 @@
+package telegram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// fakeBotAPI records the sent messages and rejects the ones with HTML formatting as Telegram does
+// with entities it can't parse.
+type fakeBotAPI struct {
+	sync.Mutex
+	sent []url.Values
+}
+
+// redirect sends the Bot API requests to the test server.
+type redirect struct {
+	target *url.URL
+}
+
+func TestSendRetriesAsPlainText(t *testing.T) {
+	server := &fakeBotAPI{}
+	c := newClient(t, server)
+
+	id, err := c.SendEditable(metachat.Message{Author: "Alice <3", Text: metachat.Bold("hi") + " a < b"}, "-100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != "5" {
+		t.Errorf("got message ID %q", id)
+	}
+
+	sent := server.messages()
+	if len(sent) != 2 {
+		t.Fatalf("got %d requests instead of 2", len(sent))
+	}
+
+	if sent[0].Get("parse_mode") != tgbotapi.ModeHTML {
+		t.Errorf("first request %v isn't formatted", sent[0])
+	}
+
+	retry := sent[1]
+	if retry.Get("parse_mode") != "" || retry.Get("text") != "[Alice <3] hi a < b" || retry.Get("chat_id") != "-100" {
+		t.Errorf("retry %v isn't the plain text with the author", retry)
+	}
+}
+
+func (s *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/getMe"):
+		w.Write([]byte(`{"ok":true,"result":{"id":99,"first_name":"Bridge","username":"bridge_bot"}}`))
+
+	case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.Lock()
+		s.sent = append(s.sent, r.PostForm)
+		s.Unlock()
+
+		if r.PostForm.Get("parse_mode") != "" {
+			w.Write([]byte(`{"ok":false,"error_code":400,` +
+				`"description":"Bad Request: can't parse entities: unsupported start tag"}`))
+
+			return
+		}
+
+		w.Write([]byte(`{"ok":true,"result":{"message_id":5,"date":0,"chat":{"id":-100,"type":"group"}}}`))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeBotAPI) messages() []url.Values {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]url.Values(nil), s.sent...)
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newClient(t *testing.T, handler http.Handler) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := tgbotapi.NewBotAPIWithClient("token", &http.Client{Transport: redirect{target: target}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Client{id: "telegram", api: api, messageChan: make(chan metachat.Message, 1)}
+}
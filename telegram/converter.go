@@ -1,15 +1,23 @@
 package telegram
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf16"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/pkg/errors"
 	"github.com/thehadalone/metachat/metachat"
 )
 
-func convertToMetachat(msg *tgbotapi.Message, edit bool) metachat.Message {
+var urlRegexp = regexp.MustCompile(`\b(https?://[^\s<>"]+)`)
+
+func (c *Client) convertToMetachat(msg *tgbotapi.Message, edit bool) metachat.Message {
 	content := formatText(msg)
 	if msg.ReplyToMessage != nil {
 		content = metachat.Quote(formatText(msg.ReplyToMessage), author(msg.ReplyToMessage)) + " " + content
@@ -19,78 +27,277 @@ func convertToMetachat(msg *tgbotapi.Message, edit bool) metachat.Message {
 		content = metachat.Edit(content)
 	}
 
+	authorID := ""
+	if msg.From != nil {
+		authorID = strconv.Itoa(msg.From.ID)
+	}
+
 	return metachat.Message{
-		Messenger: "Telegram",
+		Messenger: c.id,
 		Chat:      strconv.FormatInt(msg.Chat.ID, 10),
 		Author:    author(msg),
+		AuthorID:  authorID,
 		Text:      content,
 	}
 }
 
 func convertToTelegram(message metachat.Message) tgbotapi.MessageConfig {
-	content := strings.Replace(message.Text, "*", "\\*", -1)
-	content = strings.Replace(content, "_", "\\_", -1)
-	content = metachat.BoldRegexp.ReplaceAllString(content, "*${1}*")
-	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
-	content = metachat.PreformattedRegexp.ReplaceAllString(content, "```${1}```")
+	content := metachat.EditRegexp.ReplaceAllString(message.Text, "Edit: ${1}")
+
+	var result strings.Builder
+	if message.Author != "" {
+		result.WriteString("<b>[" + html.EscapeString(message.Author) + "]</b> ")
+	}
+
+	last := 0
+	for _, loc := range metachat.PreformattedRegexp.FindAllStringSubmatchIndex(content, -1) {
+		result.WriteString(htmlInline(content[last:loc[0]]))
+		result.WriteString("<pre>" + html.EscapeString(content[loc[2]:loc[3]]) + "</pre>")
+		last = loc[1]
+	}
+
+	result.WriteString(htmlInline(content[last:]))
+
+	msg := tgbotapi.NewMessage(0, result.String())
+	msg.ParseMode = tgbotapi.ModeHTML
+
+	return msg
+}
+
+// convertToPlain renders the message without formatting. It's sent when Telegram rejects the entities
+// of the formatted message.
+func convertToPlain(message metachat.Message) tgbotapi.MessageConfig {
+	content := metachat.BoldRegexp.ReplaceAllString(message.Text, "${1}")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "${1}")
 	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
 	content = metachat.QuoteRegexp.ReplaceAllString(content, "Quote from ${1}:\n${2}\n\n")
 	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
 
 	if message.Author != "" {
-		content = fmt.Sprintf("*[%s]* %s", message.Author, content)
+		content = fmt.Sprintf("[%s] %s", message.Author, content)
 	}
 
-	msg := tgbotapi.NewMessage(0, content)
-	msg.ParseMode = tgbotapi.ModeMarkdown
+	return tgbotapi.NewMessage(0, content)
+}
+
+// mentionHTML renders a mention of a username as is and a mention of a user ID as a link to the user,
+// which Telegram turns into a text_mention entity.
+func mentionHTML(mention string) string {
+	groups := metachat.MentionIDRegexp.FindStringSubmatch(mention)
+	if strings.HasPrefix(groups[1], "@") {
+		return groups[1]
+	}
 
-	return msg
+	return fmt.Sprintf(`<a href="tg://user?id=%s">%s</a>`, groups[1], groups[2])
+}
+
+// htmlInline escapes the text and converts the inline Metachat tags to the HTML subset supported by Telegram.
+func htmlInline(text string) string {
+	content := html.EscapeString(text)
+	content = metachat.BoldRegexp.ReplaceAllString(content, "<b>${1}</b>")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "<i>${1}</i>")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "<s>${1}</s>")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "<u>${1}</u>")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "<tg-spoiler>${1}</tg-spoiler>")
+	content = metachat.MentionIDRegexp.ReplaceAllStringFunc(content, mentionHTML)
+	content = metachat.MentionRegexp.ReplaceAllString(content, "@${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "<blockquote><b>${1}</b>: ${2}</blockquote>")
+	content = urlRegexp.ReplaceAllString(content, `<a href="${1}">${1}</a>`)
+
+	return content
 }
 
+// formatText converts the message entities to Metachat tags. Entity offsets and lengths are counted in UTF-16
+// code units, entities may be nested and are clipped to their parent if they overlap it partially.
 func formatText(msg *tgbotapi.Message) string {
-	content := msg.Text
-	if msg.Entities != nil {
-		chunks := make([]string, 0)
-		lastChunkEnd := 0
-		for _, entity := range *msg.Entities {
-			switch entity.Type {
-			case "mention":
-				start := entity.Offset
-				end := start + entity.Length
-				chunks = append(chunks, content[lastChunkEnd:start])
-				chunks = append(chunks, metachat.Mention(content[start+1:end]))
-				lastChunkEnd = end
-
-			case "bold":
-				start := entity.Offset
-				end := start + entity.Length
-				chunks = append(chunks, content[lastChunkEnd:start])
-				chunks = append(chunks, metachat.Bold(content[start:end]))
-				lastChunkEnd = end
-
-			case "italic":
-				start := entity.Offset
-				end := start + entity.Length
-				chunks = append(chunks, content[lastChunkEnd:start])
-				chunks = append(chunks, metachat.Italic(content[start:end]))
-				lastChunkEnd = end
-
-			case "code", "pre":
-				start := entity.Offset
-				end := start + entity.Length
-				chunks = append(chunks, content[lastChunkEnd:start])
-				chunks = append(chunks, metachat.Preformatted(content[start:end]))
-				lastChunkEnd = end
-			}
+	if msg.Entities == nil {
+		return msg.Text
+	}
+
+	text := utf16.Encode([]rune(msg.Text))
+
+	spans := make([]span, 0, len(*msg.Entities))
+	for _, entity := range *msg.Entities {
+		start := clamp(entity.Offset, 0, len(text))
+		end := clamp(entity.Offset+entity.Length, start, len(text))
+
+		// Bounds splitting a surrogate pair are widened to the whole character.
+		if splitsPair(text, start) {
+			start--
+		}
+
+		if splitsPair(text, end) {
+			end++
 		}
 
-		chunks = append(chunks, content[lastChunkEnd:])
-		content = strings.Join(chunks, "")
+		if start < end {
+			spans = append(spans, span{entity: entity, start: start, end: end})
+		}
 	}
 
-	return content
+	// Parents go before their children: entities are ordered by start and the longest goes first.
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+
+		return spans[i].end > spans[j].end
+	})
+
+	return renderSpans(text, 0, len(text), spans)
 }
 
+// span is an entity with its bounds in UTF-16 code units.
+type span struct {
+	entity     tgbotapi.MessageEntity
+	start, end int
+}
+
+// renderSpans renders text[start:end] with the sorted spans starting inside it.
+func renderSpans(text []uint16, start, end int, spans []span) string {
+	var result strings.Builder
+	pos := start
+	for i := 0; i < len(spans); {
+		s := spans[i]
+		if s.start < pos {
+			s.start = pos
+		}
+
+		if s.start >= end {
+			break
+		}
+
+		if s.end > end {
+			s.end = end
+		}
+
+		children := i + 1
+		for children < len(spans) && spans[children].start < s.end {
+			children++
+		}
+
+		if s.start < s.end {
+			result.WriteString(decode(text[pos:s.start]))
+			result.WriteString(formatEntity(s.entity, decode(text[s.start:s.end]),
+				renderSpans(text, s.start, s.end, spans[i+1:children])))
+			pos = s.end
+		}
+
+		i = children
+	}
+
+	result.WriteString(decode(text[pos:end]))
+
+	return result.String()
+}
+
+// formatEntity converts an entity to Metachat tags. Raw is the entity text, content is the text with
+// the nested entities converted.
+func formatEntity(entity tgbotapi.MessageEntity, raw, content string) string {
+	switch entity.Type {
+	case "mention":
+		return metachat.MentionOf(strings.TrimPrefix(raw, "@"), raw)
+
+	case "text_mention":
+		if entity.User == nil {
+			return content
+		}
+
+		return metachat.MentionOf(fullName(entity.User), strconv.Itoa(entity.User.ID))
+
+	case "bold":
+		return metachat.Bold(content)
+
+	case "italic":
+		return metachat.Italic(content)
+
+	case "strikethrough":
+		return metachat.Strikethrough(content)
+
+	case "underline":
+		return metachat.Underline(content)
+
+	case "spoiler":
+		return metachat.Spoiler(content)
+
+	case "code", "pre":
+		return metachat.Preformatted(raw)
+
+	case "text_link":
+		if entity.URL == "" || entity.URL == raw {
+			return content
+		}
+
+		return fmt.Sprintf("%s (%s)", content, entity.URL)
+
+	case "blockquote":
+		return "> " + strings.Replace(content, "\n", "\n> ", -1)
+
+	default:
+		return content
+	}
+}
+
+func decode(text []uint16) string {
+	return string(utf16.Decode(text))
+}
+
+// splitsPair reports whether the position is between the halves of a surrogate pair.
+func splitsPair(text []uint16, i int) bool {
+	return i > 0 && i < len(text) && text[i-1] >= 0xD800 && text[i-1] < 0xDC00 && text[i] >= 0xDC00 && text[i] < 0xE000
+}
+
+func clamp(value, low, high int) int {
+	if value < low {
+		return low
+	}
+
+	if value > high {
+		return high
+	}
+
+	return value
+}
+
+// author returns the name of the sender, or the chat title for channel posts, which have no sender.
 func author(msg *tgbotapi.Message) string {
-	return fmt.Sprintf("%s %s", msg.From.FirstName, msg.From.LastName)
+	switch {
+	case msg.From != nil:
+		return fullName(msg.From)
+
+	case msg.Chat != nil:
+		return msg.Chat.Title
+
+	default:
+		return ""
+	}
+}
+
+func fullName(u *tgbotapi.User) string {
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+// converter exposes the Telegram conversions. Inbound payloads are messages, outbound ones are the text
+// and the parse mode of sent messages.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	config := convertToTelegram(msg)
+	payload, err := json.MarshalIndent(map[string]string{"text": config.Text, "parse_mode": config.ParseMode}, "", "  ")
+
+	return payload, errors.WithStack(err)
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var msg tgbotapi.Message
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	return (&Client{id: "Telegram"}).convertToMetachat(&msg, msg.EditDate != 0), nil
 }
@@ -0,0 +1,140 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+func TestConvertToMetachatQuotesRelayedMessage(t *testing.T) {
+	c := &Client{id: "telegram"}
+	msg := &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 1, FirstName: "Bob"},
+		Chat: &tgbotapi.Chat{ID: 10},
+		Text: "yes",
+		ReplyToMessage: &tgbotapi.Message{
+			From: &tgbotapi.User{ID: 2, FirstName: "Bridge"},
+			Text: "[Alice] are you there?" + metachat.OriginMarker,
+		},
+	}
+
+	converted := c.convertToMetachat(msg, false)
+	if strings.Contains(converted.Text, metachat.OriginMarker) {
+		t.Errorf("reply %q has the origin marker", converted.Text)
+	}
+
+	if expected := metachat.Quote("[Alice] are you there?", "Bridge") + " yes"; converted.Text != expected {
+		t.Errorf("reply is %q instead of %q", converted.Text, expected)
+	}
+}
+
+func TestConvertToMetachatChannelPost(t *testing.T) {
+	c := &Client{id: "telegram"}
+	msg := &tgbotapi.Message{
+		Chat:           &tgbotapi.Chat{ID: -100, Title: "News"},
+		Text:           "released",
+		ReplyToMessage: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100, Title: "News"}, Text: "soon"},
+	}
+
+	converted := c.convertToMetachat(msg, false)
+	expected := metachat.Message{Messenger: "telegram", Chat: "-100", Author: "News",
+		Text: metachat.Quote("soon", "News") + " released"}
+
+	if converted != expected {
+		t.Errorf("got %+v instead of %+v", converted, expected)
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	user := &tgbotapi.User{ID: 7, FirstName: "Bob", LastName: "Smith"}
+	tests := []struct {
+		name     string
+		text     string
+		entities []tgbotapi.MessageEntity
+		expected string
+	}{
+		{name: "no entities", text: "hello 👋", expected: "hello 👋"},
+		{name: "emoji before bold", text: "👋👋 hi there",
+			entities: []tgbotapi.MessageEntity{{Type: "bold", Offset: 5, Length: 2}},
+			expected: "👋👋 " + metachat.Bold("hi") + " there"},
+		{name: "cyrillic", text: "Привет мир",
+			entities: []tgbotapi.MessageEntity{{Type: "italic", Offset: 7, Length: 3}},
+			expected: "Привет " + metachat.Italic("мир")},
+		{name: "emoji entity", text: "a 👋 b",
+			entities: []tgbotapi.MessageEntity{{Type: "underline", Offset: 2, Length: 2}},
+			expected: "a " + metachat.Underline("👋") + " b"},
+		{name: "entity splitting emoji", text: "a👋b",
+			entities: []tgbotapi.MessageEntity{{Type: "bold", Offset: 2, Length: 2}},
+			expected: "a" + metachat.Bold("👋b")},
+		{name: "nested", text: "bold and italic",
+			entities: []tgbotapi.MessageEntity{{Type: "bold", Offset: 0, Length: 15},
+				{Type: "italic", Offset: 9, Length: 6}},
+			expected: metachat.Bold("bold and " + metachat.Italic("italic"))},
+		{name: "same bounds", text: "🔥 hot",
+			entities: []tgbotapi.MessageEntity{{Type: "strikethrough", Offset: 3, Length: 3},
+				{Type: "bold", Offset: 3, Length: 3}},
+			expected: "🔥 " + metachat.Strikethrough(metachat.Bold("hot"))},
+		{name: "overlapping", text: "abcdef",
+			entities: []tgbotapi.MessageEntity{{Type: "italic", Offset: 2, Length: 4},
+				{Type: "bold", Offset: 0, Length: 4}},
+			expected: metachat.Bold("ab"+metachat.Italic("cd")) + "ef"},
+		{name: "out of bounds", text: "short",
+			entities: []tgbotapi.MessageEntity{{Type: "bold", Offset: 3, Length: 10},
+				{Type: "italic", Offset: 20, Length: 2}, {Type: "spoiler", Offset: -2, Length: 3}},
+			expected: metachat.Spoiler("s") + "ho" + metachat.Bold("rt")},
+		{name: "links and mentions", text: "👋 @alice see docs, ask Bob",
+			entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 6},
+				{Type: "text_link", Offset: 14, Length: 4, URL: "https://example.com"},
+				{Type: "text_mention", Offset: 24, Length: 3, User: user}},
+			expected: "👋 " + metachat.MentionOf("alice", "@alice") + " see docs (https://example.com), ask " +
+				metachat.MentionOf("Bob Smith", "7")},
+		{name: "blockquote", text: "😀 one\ntwo",
+			entities: []tgbotapi.MessageEntity{{Type: "blockquote", Offset: 0, Length: 10},
+				{Type: "pre", Offset: 7, Length: 3}},
+			expected: "> 😀 one\n> " + metachat.Preformatted("two")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &tgbotapi.Message{Text: test.text}
+			if test.entities != nil {
+				msg.Entities = &test.entities
+			}
+
+			if actual := formatText(msg); actual != test.expected {
+				t.Errorf("got %q instead of %q", actual, test.expected)
+			}
+		})
+	}
+}
+
+func FuzzFormatText(f *testing.F) {
+	f.Add("👋👋 hi there", 5, 2, 0, 3, 1)
+	f.Add("a👋b", 2, 2, 1, 1, 3)
+	f.Add("Привет мир", 7, 3, 0, 10, 8)
+
+	types := []string{"bold", "italic", "underline", "strikethrough", "spoiler", "code", "mention", "text_link",
+		"text_mention", "blockquote", "url"}
+
+	f.Fuzz(func(t *testing.T, text string, offset1, length1, offset2, length2, kinds int) {
+		k := uint(kinds)
+		n := uint(len(types))
+		entities := []tgbotapi.MessageEntity{
+			{Type: types[k%n], Offset: offset1, Length: length1, URL: "https://example.com"},
+			{Type: types[k/n%n], Offset: offset2, Length: length2},
+		}
+
+		actual := formatText(&tgbotapi.Message{Text: text, Entities: &entities})
+		if !utf8.ValidString(actual) {
+			t.Errorf("%q is converted to invalid UTF-8 %q", text, actual)
+		}
+
+		valid := string([]rune(text))
+		if !strings.ContainsRune(valid, utf8.RuneError) && strings.ContainsRune(actual, utf8.RuneError) {
+			t.Errorf("%q is converted to %q with a partial surrogate", text, actual)
+		}
+	})
+}
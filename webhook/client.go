@@ -0,0 +1,246 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// SignatureHeader contains the hex-encoded HMAC-SHA256 of the request body prefixed with "sha256=".
+const SignatureHeader = "X-Metachat-Signature"
+
+const maxRetries = 3
+
+// retryBackoff is the pause before the first retry, it doubles with every next one.
+var retryBackoff = time.Second
+
+type (
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// Config structure. Chats are keyed by chat ID.
+	Config struct {
+		ID         string                `json:"-"`
+		Chats      map[string]ChatConfig `json:"chats" required:"true"`
+		HTTPClient httpClient            `json:"-"`
+	}
+
+	// ChatConfig structure. Messages are posted to URL. Secret signs outgoing requests and incoming ones
+	// must be signed with it. Chats without a secret don't accept incoming messages, as anyone could post
+	// them under any name and account ID.
+	ChatConfig struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+
+	// Client is a generic webhook client.
+	Client struct {
+		id          string
+		httpClient  httpClient
+		chats       map[string]ChatConfig
+		messageChan chan metachat.Message
+	}
+
+	// retryableError is a network or server error the request is retried after.
+	retryableError struct {
+		error
+	}
+)
+
+func init() {
+	metachat.Register("webhook", newMessenger, Config{})
+	metachat.RegisterConverter("webhook", converter{})
+}
+
+// NewClient is a webhook client constructor.
+func NewClient(config Config) (*Client, error) {
+	if len(config.Chats) == 0 {
+		return nil, errors.New("chats can't be nil")
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "Webhook"
+	}
+
+	return &Client{
+		id:          id,
+		httpClient:  httpClient,
+		chats:       config.Chats,
+		messageChan: make(chan metachat.Message, 100),
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Start is a no-op as incoming messages are received by the webhook.
+func (c *Client) Start() error {
+	return nil
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/{chat}", c.handleMessage)
+
+	return r
+}
+
+// Send posts a message to the URL of the chat with the provided ID, retrying on server errors.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	config, ok := c.chats[chat]
+	if !ok || config.URL == "" {
+		return errors.Errorf("no outgoing URL for chat '%s'", chat)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err = c.post(config, body)
+		if _, ok := err.(*retryableError); !ok || attempt == maxRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (c *Client) post(config ChatConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if config.Secret != "" {
+		req.Header.Set(SignatureHeader, sign(config.Secret, body))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &retryableError{errors.WithStack(err)}
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || seconds <= 0 {
+			seconds = 1
+		}
+
+		return &metachat.RetryAfterError{Duration: time.Duration(seconds) * time.Second}
+
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return &retryableError{errors.Errorf("got %s from %s", resp.Status, config.URL)}
+
+	case resp.StatusCode >= http.StatusBadRequest:
+		return errors.Errorf("got %s from %s", resp.Status, config.URL)
+	}
+
+	return nil
+}
+
+func (c *Client) handleMessage(w http.ResponseWriter, r *http.Request) {
+	chat := chi.URLParam(r, "chat")
+	config, ok := c.chats[chat]
+	if !ok {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, render.M{})
+		return
+	}
+
+	if config.Secret == "" {
+		render.Status(r, http.StatusForbidden)
+		render.JSON(w, r, render.M{"error": "chat doesn't accept incoming messages"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"error": err.Error()})
+		return
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(sign(config.Secret, body))) {
+		render.Status(r, http.StatusUnauthorized)
+		render.JSON(w, r, render.M{"error": "invalid signature"})
+		return
+	}
+
+	msg := metachat.Message{}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"error": err.Error()})
+		return
+	}
+
+	if msg.Text == "" {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, render.M{"error": "text can't be nil"})
+		return
+	}
+
+	msg.Messenger = c.id
+	msg.Chat = chat
+	c.messageChan <- msg
+
+	render.JSON(w, r, render.M{})
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
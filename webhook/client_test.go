@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+func TestWebhookAcceptsSignedMessages(t *testing.T) {
+	c, err := NewClient(Config{Chats: map[string]ChatConfig{
+		"signed":   {Secret: "secret"},
+		"outgoing": {URL: "https://example.com/hook"},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"author":"Alice","authorID":"U1","text":"hello"}`
+	tests := []struct {
+		name      string
+		chat      string
+		body      string
+		signature string
+		status    int
+	}{
+		{name: "signed", chat: "signed", body: body, signature: sign("secret", []byte(body)), status: http.StatusOK},
+		{name: "unsigned", chat: "signed", body: body, status: http.StatusUnauthorized},
+		{name: "wrong secret", chat: "signed", body: body, signature: sign("wrong", []byte(body)),
+			status: http.StatusUnauthorized},
+		{name: "chat without secret", chat: "outgoing", body: body, status: http.StatusForbidden},
+		{name: "unknown chat", chat: "unknown", body: body, status: http.StatusNotFound},
+		{name: "no text", chat: "signed", body: `{"author":"Alice"}`, signature: sign("secret", []byte(`{"author":"Alice"}`)),
+			status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/"+test.chat, strings.NewReader(test.body))
+			if test.signature != "" {
+				req.Header.Set(SignatureHeader, test.signature)
+			}
+
+			rec := httptest.NewRecorder()
+			c.Webhook().ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Errorf("got %d instead of %d: %s", rec.Code, test.status, rec.Body)
+			}
+
+			select {
+			case msg := <-c.MessageChan():
+				want := metachat.Message{Messenger: "Webhook", Chat: "signed", Author: "Alice", AuthorID: "U1",
+					Text: "hello"}
+
+				if test.status != http.StatusOK || msg != want {
+					t.Errorf("got message %+v", msg)
+				}
+
+			default:
+				if test.status == http.StatusOK {
+					t.Error("message isn't relayed")
+				}
+			}
+		})
+	}
+}
+
+func TestSendSignsAndRetries(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != sign("secret", body) {
+			t.Errorf("request %s has signature %q", body, r.Header.Get(SignatureHeader))
+		}
+
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+
+	defer server.Close()
+
+	c, err := NewClient(Config{Chats: map[string]ChatConfig{"team": {URL: server.URL, Secret: "secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Send(metachat.Message{Author: "Alice", Text: "hello"}, "team")
+	if retry, ok := err.(*metachat.RetryAfterError); !ok || retry.Duration != 7*time.Second {
+		t.Errorf("got %v instead of a rate limit error", err)
+	}
+
+	err = c.Send(metachat.Message{Author: "Alice", Text: "hello"}, "team")
+	if err != nil || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+
+	err = c.Send(metachat.Message{Text: "hello"}, "unknown")
+	if err == nil {
+		t.Error("message is sent to a chat without URL")
+	}
+}
@@ -0,0 +1,29 @@
+package webhook
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// converter exposes the webhook conversions. Payloads are JSON-encoded messages in both directions.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	payload, err := json.MarshalIndent(msg, "", "  ")
+
+	return payload, errors.WithStack(err)
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	var msg metachat.Message
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return metachat.Message{}, errors.WithStack(err)
+	}
+
+	msg.Messenger = "Webhook"
+
+	return msg, nil
+}
@@ -0,0 +1,537 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const (
+	dialTimeout       = 30 * time.Second
+	keepAliveInterval = time.Minute
+	maxRecentMessages = 200
+)
+
+// reconnectDelay is the pause before connecting to the server again.
+var reconnectDelay = 10 * time.Second
+
+type (
+	// Config structure. Rooms are the bare JIDs of the MUC rooms to join with the provided nick.
+	Config struct {
+		ID        string      `json:"-"`
+		JID       string      `json:"jid" required:"true"`
+		Password  string      `json:"password" required:"true"`
+		Server    string      `json:"server"`
+		Nick      string      `json:"nick" required:"true"`
+		Rooms     []string    `json:"rooms"`
+		PlainText bool        `json:"plainText"`
+		TLSConfig *tls.Config `json:"-"`
+	}
+
+	// Client is an XMPP client.
+	Client struct {
+		id          string
+		username    string
+		domain      string
+		resource    string
+		password    string
+		server      string
+		nick        string
+		rooms       *roomSet
+		plainText   bool
+		tlsConfig   *tls.Config
+		messageChan chan metachat.Message
+		streamLock  sync.RWMutex
+		stream      *stream
+		idCounter   int64
+		recent      *recentMessages
+	}
+
+	stanzaMessage struct {
+		XMLName  xml.Name  `xml:"message"`
+		From     string    `xml:"from,attr"`
+		Type     string    `xml:"type,attr"`
+		ID       string    `xml:"id,attr"`
+		Body     string    `xml:"body"`
+		StanzaID *stanzaID `xml:"urn:xmpp:sid:0 stanza-id"`
+		Replace  *struct {
+			ID string `xml:"id,attr"`
+		} `xml:"urn:xmpp:message-correct:0 replace"`
+		Reply *struct {
+			To string `xml:"to,attr"`
+			ID string `xml:"id,attr"`
+		} `xml:"urn:xmpp:reply:0 reply"`
+		Fallbacks []struct {
+			For  string `xml:"for,attr"`
+			Body *struct {
+				Start *int `xml:"start,attr"`
+				End   *int `xml:"end,attr"`
+			} `xml:"body"`
+		} `xml:"urn:xmpp:fallback:0 fallback"`
+		Delay *struct{} `xml:"urn:xmpp:delay delay"`
+	}
+
+	stanzaID struct {
+		ID string `xml:"id,attr"`
+		By string `xml:"by,attr"`
+	}
+
+	stanzaIQ struct {
+		XMLName xml.Name  `xml:"iq"`
+		From    string    `xml:"from,attr"`
+		Type    string    `xml:"type,attr"`
+		ID      string    `xml:"id,attr"`
+		Ping    *struct{} `xml:"urn:xmpp:ping ping"`
+	}
+
+	// recentMessage is kept to quote the original message of XEP-0461 replies without a fallback.
+	recentMessage struct {
+		ids    []string
+		author string
+		text   string
+	}
+
+	recentMessages struct {
+		sync.Mutex
+		messages []recentMessage
+	}
+
+	roomSet struct {
+		sync.Mutex
+		rooms map[string]bool
+	}
+)
+
+func init() {
+	metachat.Register("xmpp", newMessenger, Config{})
+	metachat.RegisterConverter("xmpp", converter{})
+}
+
+// NewClient is an XMPP client constructor.
+func NewClient(config Config) (*Client, error) {
+	if config.JID == "" || config.Password == "" || config.Nick == "" {
+		return nil, errors.New("JID, password and nick can't be nil")
+	}
+
+	bare, resource := splitResource(config.JID)
+	at := strings.Index(bare, "@")
+	if at <= 0 {
+		return nil, errors.Errorf("invalid JID '%s'", config.JID)
+	}
+
+	if resource == "" {
+		resource = "metachat"
+	}
+
+	server := config.Server
+	if server == "" {
+		server = bare[at+1:] + ":5222"
+	}
+
+	rooms := &roomSet{rooms: make(map[string]bool)}
+	for _, room := range config.Rooms {
+		rooms.add(room)
+	}
+
+	id := config.ID
+	if id == "" {
+		id = "XMPP"
+	}
+
+	return &Client{
+		id:          id,
+		username:    bare[:at],
+		domain:      bare[at+1:],
+		resource:    resource,
+		password:    config.Password,
+		server:      server,
+		nick:        config.Nick,
+		rooms:       rooms,
+		plainText:   config.PlainText,
+		tlsConfig:   config.TLSConfig,
+		messageChan: make(chan metachat.Message, 100),
+		recent:      &recentMessages{},
+	}, nil
+}
+
+func newMessenger(id string, config json.RawMessage) (metachat.Messenger, error) {
+	var c Config
+	err := json.Unmarshal(config, &c)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c.ID = id
+
+	client, err := NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Name returns the messenger instance ID.
+func (c *Client) Name() string {
+	return c.id
+}
+
+// MessageChan returns a read-only message channel.
+func (c *Client) MessageChan() <-chan metachat.Message {
+	return c.messageChan
+}
+
+// Webhook returns HTTP handler for webhook requests.
+func (c *Client) Webhook() http.Handler {
+	return nil
+}
+
+// Start connects to the server and reconnects whenever the connection is lost.
+// It returns only if the server rejects the credentials.
+func (c *Client) Start() error {
+	for {
+		err := c.run()
+		if _, ok := errors.Cause(err).(*authError); ok {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// Send sends a message to the MUC room with the provided JID.
+func (c *Client) Send(msg metachat.Message, chat string) error {
+	_, err := c.SendEditable(msg, chat)
+
+	return err
+}
+
+// SendEditable sends a message to the MUC room with the provided JID and returns the message ID.
+func (c *Client) SendEditable(msg metachat.Message, chat string) (string, error) {
+	s, err := c.prepareRoom(chat)
+	if err != nil {
+		return "", err
+	}
+
+	id := c.nextID()
+	err = s.write(fmt.Sprintf("<message to='%s' type='groupchat' id='%s'><body>%s</body></message>",
+		escape(chat), id, escape(convertToXMPP(msg))))
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Edit corrects the message with the provided ID using XEP-0308.
+func (c *Client) Edit(msg metachat.Message, chat, id string) error {
+	s, err := c.prepareRoom(chat)
+	if err != nil {
+		return err
+	}
+
+	return s.write(fmt.Sprintf("<message to='%s' type='groupchat' id='%s'><body>%s</body>"+
+		"<replace id='%s' xmlns='%s'/></message>", escape(chat), c.nextID(), escape(convertToXMPP(msg)), escape(id),
+		nsCorrect))
+}
+
+// CheckCredentials authenticates on the server. MUC rooms can be joined by anyone allowed to, so the
+// visibility of the chats is unknown.
+func (c *Client) CheckCredentials(chats []string) (map[string]bool, error) {
+	conn, err := net.DialTimeout("tcp", c.server, dialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	defer conn.Close()
+
+	_, err = c.negotiate(conn)
+
+	return nil, err
+}
+
+func (c *Client) run() error {
+	conn, err := net.DialTimeout("tcp", c.server, dialTimeout)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	defer conn.Close()
+
+	s, err := c.negotiate(conn)
+	if err != nil {
+		return err
+	}
+
+	err = s.write("<presence/>")
+	if err != nil {
+		return err
+	}
+
+	for _, room := range c.rooms.list() {
+		err = c.join(s, room)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.setStream(s)
+	defer c.setStream(nil)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go keepAlive(s, done)
+
+	for {
+		start, err := s.nextStart()
+		if err != nil {
+			return err
+		}
+
+		switch start.Name.Local {
+		case "message":
+			var msg stanzaMessage
+			err = s.decoder.DecodeElement(&msg, &start)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			c.handleMessage(msg)
+
+		case "iq":
+			var iq stanzaIQ
+			err = s.decoder.DecodeElement(&iq, &start)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if iq.Type == "get" && iq.Ping != nil {
+				err = s.write(fmt.Sprintf("<iq type='result' to='%s' id='%s'/>", escape(iq.From), escape(iq.ID)))
+				if err != nil {
+					return err
+				}
+			}
+
+		default:
+			err = s.decoder.Skip()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func (c *Client) handleMessage(msg stanzaMessage) {
+	room, nick := splitResource(msg.From)
+	if msg.Type != "groupchat" || msg.Body == "" || nick == "" || msg.Delay != nil {
+		return
+	}
+
+	ids := []string{msg.ID}
+	if msg.StanzaID != nil && msg.StanzaID.By == room {
+		ids = append(ids, msg.StanzaID.ID)
+	}
+
+	if nick == c.nick {
+		return
+	}
+
+	body, quote := c.splitReply(msg)
+	text := convertToMetachat(body)
+	c.recent.add(recentMessage{ids: ids, author: nick, text: text})
+
+	if quote != "" {
+		text = quote + " " + text
+	}
+
+	if msg.Replace != nil {
+		text = metachat.Edit(text)
+	}
+
+	c.messageChan <- metachat.Message{
+		Messenger: c.id,
+		Chat:      room,
+		Author:    nick,
+		AuthorID:  nick,
+		Text:      text,
+	}
+}
+
+// splitReply separates the XEP-0461 reply fallback from the message body and returns
+// the body and the replied message as a Metachat quote.
+func (c *Client) splitReply(msg stanzaMessage) (string, string) {
+	if msg.Reply == nil {
+		return msg.Body, ""
+	}
+
+	_, author := splitResource(msg.Reply.To)
+	body := msg.Body
+	quoted := ""
+
+	for _, fallback := range msg.Fallbacks {
+		if fallback.For != nsReply || fallback.Body == nil || fallback.Body.Start == nil || fallback.Body.End == nil {
+			continue
+		}
+
+		runes := []rune(msg.Body)
+		start, end := *fallback.Body.Start, *fallback.Body.End
+		if start < 0 || end > len(runes) || start > end {
+			continue
+		}
+
+		quoted = stripQuotePrefix(string(runes[start:end]))
+		body = string(runes[:start]) + string(runes[end:])
+	}
+
+	if original, ok := c.recent.find(msg.Reply.ID); ok {
+		if author == "" {
+			author = original.author
+		}
+
+		return body, metachat.Quote(original.text, author)
+	}
+
+	if quoted == "" {
+		return body, ""
+	}
+
+	return body, metachat.Quote(convertToMetachat(quoted), author)
+}
+
+// prepareRoom returns the current stream joining the room if it wasn't joined before.
+func (c *Client) prepareRoom(room string) (*stream, error) {
+	c.streamLock.RLock()
+	s := c.stream
+	c.streamLock.RUnlock()
+
+	if s == nil {
+		return nil, errors.New("not connected to the XMPP server")
+	}
+
+	if c.rooms.add(room) {
+		err := c.join(s, room)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (c *Client) join(s *stream, room string) error {
+	return s.write(fmt.Sprintf("<presence to='%s/%s'><x xmlns='%s'><history maxstanzas='0'/></x></presence>",
+		escape(room), escape(c.nick), nsMUC))
+}
+
+func (c *Client) setStream(s *stream) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+
+	c.stream = s
+}
+
+func (c *Client) nextID() string {
+	return "metachat-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" +
+		strconv.FormatInt(atomic.AddInt64(&c.idCounter, 1), 10)
+}
+
+// keepAlive sends whitespace pings so that idle connections aren't dropped.
+func keepAlive(s *stream, done <-chan struct{}) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.write(" "); err != nil {
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *recentMessages) add(msg recentMessage) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.messages = append(r.messages, msg)
+	if len(r.messages) > maxRecentMessages {
+		r.messages = r.messages[1:]
+	}
+}
+
+func (r *recentMessages) find(id string) (recentMessage, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	for i := len(r.messages) - 1; i >= 0; i-- {
+		if contains(r.messages[i].ids, id) {
+			return r.messages[i], true
+		}
+	}
+
+	return recentMessage{}, false
+}
+
+func (s *roomSet) add(room string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rooms[room] {
+		return false
+	}
+
+	s.rooms[room] = true
+
+	return true
+}
+
+func (s *roomSet) list() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	result := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		result = append(result, room)
+	}
+
+	return result
+}
+
+func splitResource(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i], jid[i+1:]
+	}
+
+	return jid, ""
+}
+
+func stripQuotePrefix(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(l, ">"), " ")
+	}
+
+	return strings.Join(lines, "\n")
+}
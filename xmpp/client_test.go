@@ -0,0 +1,404 @@
+package xmpp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+const (
+	testTimeout = 5 * time.Second
+	testRoom    = "team@conference.example.com"
+)
+
+// fakeServer is an in-process XMPP server handing accepted connections over to the test.
+type fakeServer struct {
+	listener net.Listener
+	conns    chan *serverConn
+}
+
+// serverConn is the server side of a client stream.
+type serverConn struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *xml.Decoder
+}
+
+// element is a stanza or a nonza sent by the client.
+type element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{listener: listener, conns: make(chan *serverConn, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.conns <- &serverConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+		}
+	}()
+
+	return s
+}
+
+// accept waits for the client to connect.
+func (s *fakeServer) accept(t *testing.T) *serverConn {
+	t.Helper()
+
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.conn.Close() })
+		return conn
+
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't connect")
+		return nil
+	}
+}
+
+// login authenticates the client, binds the resource and waits for the initial presence.
+func (c *serverConn) login() {
+	c.t.Helper()
+
+	c.open(fmt.Sprintf("<mechanisms xmlns='%s'><mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism>"+
+		"</mechanisms>", nsSASL))
+
+	auth := c.expect("auth")
+	if c.credentials(auth) != "\x00bot\x00secret" {
+		c.t.Fatalf("unexpected credentials %q", c.credentials(auth))
+	}
+
+	c.send("<success xmlns='%s'/>", nsSASL)
+	c.open(fmt.Sprintf("<bind xmlns='%s'/>", nsBind))
+
+	bind := c.expect("iq")
+	if !strings.Contains(bind.Inner, "<resource>metachat</resource>") {
+		c.t.Errorf("unexpected bind %s", bind.Inner)
+	}
+
+	c.send("<iq type='result' id='%s'><bind xmlns='%s'><jid>bot@example.com/metachat</jid></bind></iq>",
+		bind.attr("id"), nsBind)
+	c.expect("presence")
+}
+
+// fail rejects the credentials, which makes the client return from Start.
+func (c *serverConn) fail(errs <-chan error) {
+	c.t.Helper()
+
+	c.open(fmt.Sprintf("<mechanisms xmlns='%s'><mechanism>PLAIN</mechanism></mechanisms>", nsSASL))
+	c.expect("auth")
+	c.send("<failure xmlns='%s'><not-authorized/></failure>", nsSASL)
+
+	select {
+	case err := <-errs:
+		if _, ok := err.(*authError); !ok {
+			c.t.Errorf("Start returned %v after an authentication failure", err)
+		}
+
+	case <-time.After(testTimeout):
+		c.t.Error("Start didn't return after an authentication failure")
+	}
+}
+
+// open waits for the client stream header and answers with the server one and the features.
+func (c *serverConn) open(features string) {
+	c.t.Helper()
+
+	c.decoder = xml.NewDecoder(c.reader)
+	for {
+		start, ok := c.token().(xml.StartElement)
+		if ok && start.Name.Space == nsStream && start.Name.Local == "stream" {
+			break
+		}
+	}
+
+	c.send("<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='%s' from='example.com' "+
+		"id='s1' version='1.0'><stream:features>%s</stream:features>", nsStream, features)
+}
+
+// expect reads the next element from the client and checks its name.
+func (c *serverConn) expect(name string) element {
+	c.t.Helper()
+
+	for {
+		start, ok := c.token().(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		var e element
+		err := c.decoder.DecodeElement(&e, &start)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+
+		if e.XMLName.Local != name {
+			c.t.Fatalf("got <%s %v>%s instead of <%s>", e.XMLName.Local, e.Attrs, e.Inner, name)
+		}
+
+		return e
+	}
+}
+
+func (c *serverConn) token() xml.Token {
+	c.t.Helper()
+
+	err := c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	token, err := c.decoder.Token()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return token
+}
+
+func (c *serverConn) send(format string, args ...interface{}) {
+	c.t.Helper()
+
+	_, err := fmt.Fprintf(c.conn, format, args...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *serverConn) credentials(auth element) string {
+	c.t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(auth.Inner)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return string(decoded)
+}
+
+func (e element) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+func TestClientJoinsRoomsAndRelaysMessages(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.login()
+	expectJoin(t, conn, testRoom)
+
+	tests := []struct {
+		name   string
+		stanza string
+		want   string
+	}{
+		{name: "message", stanza: "<message from='%s/alice' type='groupchat' id='a1'><body>hello *world*</body>" +
+			"<stanza-id xmlns='urn:xmpp:sid:0' id='s1' by='%[1]s'/></message>", want: "hello " + metachat.Bold("world")},
+		{name: "history", stanza: "<message from='%s/alice' type='groupchat' id='a0'><body>old</body>" +
+			"<delay xmlns='urn:xmpp:delay' stamp='2020-01-01T00:00:00Z'/></message>"},
+		{name: "own message", stanza: "<message from='%s/bridge' type='groupchat' id='b1'><body>echo</body></message>"},
+		{name: "subject", stanza: "<message from='%s' type='groupchat'><subject>Team</subject></message>"},
+		{name: "private message", stanza: "<message from='%s/alice' type='chat'><body>psst</body></message>"},
+		{name: "correction", stanza: "<message from='%s/alice' type='groupchat' id='a2'><body>hello everyone</body>" +
+			"<replace xmlns='urn:xmpp:message-correct:0' id='a1'/></message>", want: metachat.Edit("hello everyone")},
+		{name: "reply", stanza: "<message from='%s/bob' type='groupchat' id='b2'><body>&gt; alice: hello\nhi</body>" +
+			"<reply xmlns='urn:xmpp:reply:0' to='%[1]s/alice' id='s1'/><fallback xmlns='urn:xmpp:fallback:0' " +
+			"for='urn:xmpp:reply:0'><body start='0' end='15'/></fallback></message>",
+			want: metachat.Quote("hello "+metachat.Bold("world"), "alice") + " hi"},
+	}
+
+	for _, test := range tests {
+		conn.send(test.stanza, testRoom)
+
+		select {
+		case msg := <-c.MessageChan():
+			if test.want == "" {
+				t.Errorf("%s: message %+v is relayed", test.name, msg)
+			} else if msg.Text != test.want || msg.Chat != testRoom || msg.Messenger != "XMPP" {
+				t.Errorf("%s: got %+v instead of %q", test.name, msg, test.want)
+			}
+
+		case <-time.After(100 * time.Millisecond):
+			if test.want != "" {
+				t.Errorf("%s: message isn't relayed", test.name)
+			}
+		}
+	}
+
+	conn.send("<iq from='example.com' type='get' id='ping1'><ping xmlns='urn:xmpp:ping'/></iq>")
+	pong := conn.expect("iq")
+	if pong.attr("type") != "result" || pong.attr("id") != "ping1" || pong.attr("to") != "example.com" {
+		t.Errorf("unexpected ping result %v", pong.Attrs)
+	}
+
+	conn.conn.Close()
+	s.accept(t).fail(errs)
+}
+
+func TestClientSendsAndCorrectsMessages(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.login()
+	expectJoin(t, conn, testRoom)
+	waitConnected(t, c, conn)
+
+	id, err := c.SendEditable(metachat.Message{Author: "carol", Text: "a < b & " + metachat.Bold("c")},
+		"other@conference.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectJoin(t, conn, "other@conference.example.com")
+
+	msg := conn.expect("message")
+	if msg.attr("to") != "other@conference.example.com" || msg.attr("type") != "groupchat" || msg.attr("id") != id ||
+		msg.Inner != "<body>*[carol]* a &lt; b &amp; *c*</body>" {
+		t.Errorf("unexpected message %v %s", msg.Attrs, msg.Inner)
+	}
+
+	err = c.Edit(metachat.Message{Author: "carol", Text: "fixed"}, "other@conference.example.com", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	correction := conn.expect("message")
+	if correction.attr("id") == id || !strings.Contains(correction.Inner, "<body>*[carol]* fixed</body>") ||
+		!strings.Contains(correction.Inner, fmt.Sprintf("<replace id='%s' xmlns='%s'/>", id, nsCorrect)) {
+		t.Errorf("unexpected correction %v %s", correction.Attrs, correction.Inner)
+	}
+
+	conn.conn.Close()
+	s.accept(t).fail(errs)
+}
+
+func TestClientReconnectsAndRejoins(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 10 * time.Millisecond
+
+	s := newFakeServer(t)
+	c := newTestClient(t, s)
+
+	errs := startClient(c)
+
+	conn := s.accept(t)
+	conn.login()
+	expectJoin(t, conn, testRoom)
+	waitConnected(t, c, conn)
+
+	err := c.Send(metachat.Message{Text: "hi"}, "other@conference.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectJoin(t, conn, "other@conference.example.com")
+	conn.expect("message")
+	conn.send("</stream:stream>")
+
+	conn = s.accept(t)
+	conn.login()
+
+	joined := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		joined[strings.SplitN(conn.expect("presence").attr("to"), "/", 2)[0]] = true
+	}
+
+	if !joined[testRoom] || !joined["other@conference.example.com"] {
+		t.Errorf("client joined %v after reconnecting", joined)
+	}
+
+	conn.conn.Close()
+	s.accept(t).fail(errs)
+}
+
+func TestSendWithoutConnection(t *testing.T) {
+	c := newTestClient(t, newFakeServer(t))
+
+	err := c.Send(metachat.Message{Text: "hi"}, testRoom)
+	if err == nil {
+		t.Error("message is sent without a connection")
+	}
+}
+
+func newTestClient(t *testing.T, s *fakeServer) *Client {
+	t.Helper()
+
+	c, err := NewClient(Config{JID: "bot@example.com", Password: "secret", Server: s.listener.Addr().String(),
+		Nick: "bridge", Rooms: []string{testRoom}, PlainText: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func startClient(c *Client) <-chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- c.Start() }()
+
+	return errs
+}
+
+// expectJoin checks that the client joins the MUC room without history.
+func expectJoin(t *testing.T, conn *serverConn, room string) {
+	t.Helper()
+
+	presence := conn.expect("presence")
+	if presence.attr("to") != room+"/bridge" || !strings.Contains(presence.Inner, "<history maxstanzas='0'/>") {
+		t.Errorf("unexpected join %v %s", presence.Attrs, presence.Inner)
+	}
+}
+
+// waitConnected waits until the client handles stanzas, so that it can send messages.
+func waitConnected(t *testing.T, c *Client, conn *serverConn) {
+	t.Helper()
+
+	conn.send("<message from='%s/alice' type='groupchat' id='w1'><body>ready</body></message>", testRoom)
+
+	select {
+	case <-c.MessageChan():
+	case <-time.After(testTimeout):
+		t.Fatal("client didn't relay a message")
+	}
+}
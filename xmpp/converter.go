@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/thehadalone/metachat/metachat"
+)
+
+// Regular expressions for XEP-0393 message styling.
+var (
+	preformattedRegexp  = regexp.MustCompile("(?sm)^```[^\n]*\n(.*?)\n```$")
+	codeRegexp          = regexp.MustCompile("`([^`\\s](?:[^`\n]*?[^`\\s])?)`")
+	boldRegexp          = regexp.MustCompile(`\B\*([^*\s](?:[^*\n]*?[^*\s])?)\*\B`)
+	italicRegexp        = regexp.MustCompile(`\b_([^_\s](?:[^_\n]*?[^_\s])?)_\b`)
+	strikethroughRegexp = regexp.MustCompile(`\B~([^~\s](?:[^~\n]*?[^~\s])?)~\B`)
+)
+
+func convertToXMPP(msg metachat.Message) string {
+	content := metachat.BoldRegexp.ReplaceAllString(msg.Text, "*${1}*")
+	content = metachat.ItalicRegexp.ReplaceAllString(content, "_${1}_")
+	content = metachat.StrikethroughRegexp.ReplaceAllString(content, "~${1}~")
+	content = metachat.UnderlineRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.SpoilerRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.PreformattedRegexp.ReplaceAllString(content, "\n```\n${1}\n```\n")
+	content = metachat.MentionRegexp.ReplaceAllString(content, "${1}")
+	content = metachat.QuoteRegexp.ReplaceAllString(content, "> *${1}*: ${2}\n")
+	content = metachat.EditRegexp.ReplaceAllString(content, "Edit: ${1}")
+
+	if msg.Author != "" {
+		content = fmt.Sprintf("*[%s]* %s", msg.Author, content)
+	}
+
+	return content
+}
+
+func convertToMetachat(body string) string {
+	content := preformattedRegexp.ReplaceAllString(body, metachat.Preformatted("${1}"))
+	content = codeRegexp.ReplaceAllString(content, metachat.Preformatted("${1}"))
+	content = boldRegexp.ReplaceAllString(content, metachat.Bold("${1}"))
+	content = italicRegexp.ReplaceAllString(content, metachat.Italic("${1}"))
+	content = strikethroughRegexp.ReplaceAllString(content, metachat.Strikethrough("${1}"))
+
+	return content
+}
+
+// converter exposes the XMPP conversions. Payloads are message bodies.
+type converter struct{}
+
+func (converter) ToNative(msg metachat.Message) ([]byte, error) {
+	return []byte(convertToXMPP(msg)), nil
+}
+
+func (converter) FromNative(payload []byte) (metachat.Message, error) {
+	return metachat.Message{Messenger: "XMPP", Text: convertToMetachat(string(payload))}, nil
+}
@@ -0,0 +1,244 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	nsStream  = "http://etherx.jabber.org/streams"
+	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsMUC     = "http://jabber.org/protocol/muc"
+	nsCorrect = "urn:xmpp:message-correct:0"
+	nsReply   = "urn:xmpp:reply:0"
+)
+
+type (
+	// stream is a negotiated XMPP client stream.
+	stream struct {
+		sync.Mutex
+		conn    net.Conn
+		decoder *xml.Decoder
+		jid     string
+	}
+
+	features struct {
+		XMLName    xml.Name  `xml:"http://etherx.jabber.org/streams features"`
+		StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+		Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+		Bind       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	}
+
+	bindResult struct {
+		XMLName xml.Name `xml:"iq"`
+		Type    string   `xml:"type,attr"`
+		JID     string   `xml:"urn:ietf:params:xml:ns:xmpp-bind bind>jid"`
+	}
+
+	authError struct {
+		condition string
+	}
+)
+
+// negotiate opens the stream, upgrades it to TLS, authenticates and binds a resource.
+func (c *Client) negotiate(conn net.Conn) (*stream, error) {
+	s := &stream{conn: conn}
+
+	f, err := s.open(c.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.plainText {
+		if f.StartTLS == nil {
+			return nil, errors.New("server doesn't support STARTTLS")
+		}
+
+		err = s.write(fmt.Sprintf("<starttls xmlns='%s'/>", nsTLS))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.expect("proceed")
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig := c.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: c.domain}
+		}
+
+		s.conn = tls.Client(conn, tlsConfig)
+		f, err = s.open(c.domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !contains(f.Mechanisms, "PLAIN") {
+		return nil, &authError{condition: "PLAIN mechanism is not supported"}
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + c.username + "\x00" + c.password))
+	err = s.write(fmt.Sprintf("<auth xmlns='%s' mechanism='PLAIN'>%s</auth>", nsSASL, credentials))
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := s.expect("success", "failure")
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "failure" {
+		return nil, &authError{condition: "not authorized"}
+	}
+
+	f, err = s.open(c.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Bind == nil {
+		return nil, errors.New("server doesn't support resource binding")
+	}
+
+	err = s.write(fmt.Sprintf("<iq type='set' id='bind'><bind xmlns='%s'><resource>%s</resource></bind></iq>",
+		nsBind, escape(c.resource)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var bind bindResult
+	err = s.next(&bind)
+	if err != nil {
+		return nil, err
+	}
+
+	if bind.Type != "result" {
+		return nil, errors.New("resource binding failed")
+	}
+
+	s.jid = bind.JID
+
+	return s, nil
+}
+
+// open sends the stream header and reads the stream features.
+func (s *stream) open(domain string) (features, error) {
+	err := s.write(fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' version='1.0' xmlns='jabber:client' "+
+		"xmlns:stream='%s'>", escape(domain), nsStream))
+
+	if err != nil {
+		return features{}, err
+	}
+
+	s.decoder = xml.NewDecoder(s.conn)
+
+	for {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return features{}, errors.WithStack(err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local == "stream" {
+			continue
+		}
+
+		var f features
+		err = s.decoder.DecodeElement(&f, &start)
+
+		return f, errors.WithStack(err)
+	}
+}
+
+// expect reads the next top-level element and returns its name if it's one of the provided names.
+func (s *stream) expect(names ...string) (string, error) {
+	start, err := s.nextStart()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.decoder.Skip()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if !contains(names, start.Name.Local) {
+		return "", errors.Errorf("got <%s> instead of <%s>", start.Name.Local, strings.Join(names, "> or <"))
+	}
+
+	return start.Name.Local, nil
+}
+
+// next decodes the next top-level element to v.
+func (s *stream) next(v interface{}) error {
+	start, err := s.nextStart()
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(s.decoder.DecodeElement(v, &start))
+}
+
+func (s *stream) nextStart() (xml.StartElement, error) {
+	for {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, errors.WithStack(err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, nil
+
+		case xml.EndElement:
+			if t.Name.Space == nsStream && t.Name.Local == "stream" {
+				return xml.StartElement{}, errors.New("server closed the stream")
+			}
+		}
+	}
+}
+
+// write sends raw XML. Writes are serialized as stanzas must not interleave.
+func (s *stream) write(data string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	_, err := s.conn.Write([]byte(data))
+
+	return errors.WithStack(err)
+}
+
+func (e *authError) Error() string {
+	return "XMPP authentication failed: " + e.condition
+}
+
+func escape(text string) string {
+	var result strings.Builder
+	_ = xml.EscapeText(&result, []byte(text))
+
+	return result.String()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}